@@ -0,0 +1,215 @@
+package httpcache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/sillygod/cdp-cache/backends"
+)
+
+// hasObjectSizeLimits tells whether the object size limits are configured
+func hasObjectSizeLimits(config *Config) bool {
+	return config.MinObjectSize > 0 || config.MaxObjectSize > 0
+}
+
+// admitObjectSize decides whether the response can be stored by its size.
+// The second return value is false when the size is unknown from the
+// Content-Length header so it should be decided by the streamed bytes.
+func admitObjectSize(respHeaders http.Header, config *Config) (bool, bool) {
+	if !hasObjectSizeLimits(config) {
+		return true, true
+	}
+
+	size, err := strconv.ParseInt(respHeaders.Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return true, false
+	}
+
+	return isObjectSizeAdmitted(size, config), true
+}
+
+func isObjectSizeAdmitted(size int64, config *Config) bool {
+	if config.MinObjectSize > 0 && size < int64(config.MinObjectSize) {
+		return false
+	}
+
+	if config.MaxObjectSize > 0 && size > int64(config.MaxObjectSize) {
+		return false
+	}
+
+	return true
+}
+
+// errObjectNotAdmitted is returned to the readers of the content dropped
+// because it exceeds the max object size.
+var errObjectNotAdmitted = errors.New("the object exceeds the max object size")
+
+// admissionBackend writes the content to the client and the backend at the
+// same time and counts the bytes. Once they exceed the max object size, the
+// backend is dropped and the rest is only written to the client.
+type admissionBackend struct {
+	backends.Backend
+	config    *Config
+	written   int64
+	abandoned bool
+	client    io.Writer
+	clientErr error
+	onDrop    func()
+	done      chan struct{}
+}
+
+func newAdmissionBackend(backend backends.Backend, client io.Writer, config *Config, onDrop func()) *admissionBackend {
+	return &admissionBackend{
+		Backend: backend,
+		config:  config,
+		client:  client,
+		onDrop:  onDrop,
+		done:    make(chan struct{}),
+	}
+}
+
+// Write writes the content to the client and the backend until it exceeds
+// the max object size. The client's errors don't stop filling the backend
+// for the other requests.
+func (a *admissionBackend) Write(p []byte) (int, error) {
+	if a.clientErr == nil {
+		_, a.clientErr = a.client.Write(p)
+	}
+
+	if a.abandoned {
+		return len(p), nil
+	}
+
+	if a.config.MaxObjectSize > 0 && a.written+int64(len(p)) > int64(a.config.MaxObjectSize) {
+		a.abandoned = true
+		a.Backend.Close()
+		return len(p), nil
+	}
+
+	n, err := a.Backend.Write(p)
+	a.written += int64(n)
+	return n, err
+}
+
+// Flush flushes the client and the backend
+func (a *admissionBackend) Flush() error {
+	if f, ok := a.client.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	if a.abandoned {
+		return nil
+	}
+
+	return a.Backend.Flush()
+}
+
+// Close closes the backend unless it's already dropped. The content out of
+// the object size limits is dropped before the readers are notified.
+func (a *admissionBackend) Close() error {
+	defer close(a.done)
+
+	var err error
+	if !a.abandoned {
+		err = a.Backend.Close()
+	}
+
+	if !a.admitted() {
+		a.onDrop()
+	}
+
+	return err
+}
+
+// admitted tells whether the completely written content is within the object
+// size limits. It should be called after the backend is closed.
+func (a *admissionBackend) admitted() bool {
+	return !a.abandoned && isObjectSizeAdmitted(a.written, a.config)
+}
+
+// GetReader gets the reader of the content unless it's dropped
+func (a *admissionBackend) GetReader() (io.ReadCloser, error) {
+	if a.abandoned {
+		return nil, errObjectNotAdmitted
+	}
+
+	return a.Backend.GetReader()
+}
+
+// GetStreamReader streams the content being written when it can't exceed
+// the max object size. Otherwise, the reader is returned once the content
+// is completely written so it's never a truncated one.
+func (a *admissionBackend) GetStreamReader() (io.ReadCloser, error) {
+	if streamer, ok := a.Backend.(backends.Streamer); ok && a.config.MaxObjectSize <= 0 {
+		return streamer.GetStreamReader()
+	}
+
+	<-a.done
+	return a.GetReader()
+}
+
+// SaveMetadata saves the metadata in the backend if it supports it and
+// the content is kept.
+func (a *admissionBackend) SaveMetadata(metadata []byte) error {
+	if !a.admitted() {
+		return nil
+	}
+
+	if persister, ok := a.Backend.(backends.Persister); ok {
+		return persister.SaveMetadata(metadata)
+	}
+
+	return nil
+}
+
+// admitAndRespond stores the response whose size is unknown in advance while
+// it's streamed to the client. Like a normal miss, the entry is put in the
+// cache and the lock is released before the body is written so the waiting
+// requests are served from it. The entry is removed once the content turns
+// out to be out of the object size limits, and the requests which can't be
+// served then fetch the upstream by themselves.
+func (h *Handler) admitAndRespond(w http.ResponseWriter, r *http.Request, entry *Entry, lock *KeyLock) error {
+	backend, err := entry.newBackend(r.Context(), h.Config)
+	if err != nil {
+		entry.Response.SetBody(&discardBackend{})
+		return err
+	}
+
+	h.writeHeaders(w, entry, cacheMiss)
+
+	// the range requests are answered with the full content because
+	// the object isn't stored yet
+	var client io.Writer = w
+	switch {
+	case entry.Response.Code == http.StatusOK && isNotModified(r, entry.Response.snapHeader):
+		writeNotModified(w)
+		client = io.Discard
+	case r.Method == http.MethodHead:
+		w.WriteHeader(entry.Response.Code)
+		client = io.Discard
+	default:
+		w.WriteHeader(entry.Response.Code)
+	}
+
+	admission := newAdmissionBackend(backend, client, h.Config, func() {
+		h.Cache.removeEntry(entry)
+	})
+	entry.Response.SetBody(admission)
+
+	h.Cache.Put(r, entry, h.Config)
+	lock.Unlock()
+
+	entry.Response.WaitClose()
+
+	if !admission.admitted() {
+		// the empty content may be dropped before the entry is put. The
+		// readers streaming the small content are waited by the backend.
+		h.Cache.removeEntry(entry)
+		h.Cache.disk.remove(entry)
+		entry.Clean()
+	}
+
+	return admission.clientErr
+}
@@ -0,0 +1,150 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type AdmissionTestSuite struct {
+	suite.Suite
+	handler *Handler
+}
+
+func (suite *AdmissionTestSuite) SetupSuite() {
+	config := getDefaultConfig()
+	config.Path = "/tmp/caddy-cache-admission"
+	config.MinObjectSize = 4
+	config.MaxObjectSize = 16
+	useTypedStorage(config)
+
+	suite.handler = &Handler{
+		Config:   config,
+		Cache:    NewHTTPCache(config, false),
+		URLLocks: NewURLLock(config),
+		logger:   zap.NewNop(),
+	}
+}
+
+// streamed returns the upstream writing the content by chunks without the
+// Content-Length header
+func (suite *AdmissionTestSuite) streamed(chunks ...string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+		}
+		return nil
+	})
+}
+
+func (suite *AdmissionTestSuite) serve(key string, next caddyhttp.Handler) *httptest.ResponseRecorder {
+	req := makeRequest("/", http.Header{})
+	entry, err := suite.handler.fetchUpstream(req, next, key)
+	suite.Nil(err)
+	suite.True(entry.isPublic)
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.admitAndRespond(rw, req, entry, suite.handler.URLLocks.Acquire(key)))
+	return rw
+}
+
+func (suite *AdmissionTestSuite) TestAdmitObjectSize() {
+	config := suite.handler.Config
+
+	admitted, known := admitObjectSize(makeHeader("Content-Length", "8"), config)
+	suite.True(admitted)
+	suite.True(known)
+
+	admitted, known = admitObjectSize(makeHeader("Content-Length", "2"), config)
+	suite.False(admitted)
+	suite.True(known)
+
+	admitted, known = admitObjectSize(makeHeader("Content-Length", "32"), config)
+	suite.False(admitted)
+	suite.True(known)
+
+	admitted, known = admitObjectSize(http.Header{}, config)
+	suite.True(admitted)
+	suite.False(known, "it should be decided by the streamed bytes")
+
+	admitted, known = admitObjectSize(makeHeader("Content-Length", "32"), getDefaultConfig())
+	suite.True(admitted, "no limits are configured")
+	suite.True(known)
+}
+
+func (suite *AdmissionTestSuite) TestStreamedWithinLimits() {
+	rw := suite.serve("GET /fit", suite.streamed("rain ", "cats"))
+	suite.Equal("rain cats", rw.Body.String())
+	suite.Equal(cacheMiss, rw.Header().Get(defaultStatusHeader))
+
+	_, exists := suite.handler.Cache.Get("GET /fit", makeRequest("/", http.Header{}), false)
+	suite.True(exists)
+}
+
+func (suite *AdmissionTestSuite) TestStreamedTooSmall() {
+	rw := suite.serve("GET /small", suite.streamed("ok"))
+	suite.Equal("ok", rw.Body.String())
+	suite.Equal(cacheMiss, rw.Header().Get(defaultStatusHeader), "the status is sent before the size is known")
+
+	_, exists := suite.handler.Cache.Get("GET /small", makeRequest("/", http.Header{}), false)
+	suite.False(exists)
+}
+
+func (suite *AdmissionTestSuite) TestStreamedTooLarge() {
+	chunks := []string{"rain cats ", "and dogs ", "all day ", "long"}
+	rw := suite.serve("GET /large", suite.streamed(chunks...))
+	suite.Equal(strings.Join(chunks, ""), rw.Body.String(), "the content should be streamed to the client")
+	suite.Equal(cacheMiss, rw.Header().Get(defaultStatusHeader), "the status is sent before the size is known")
+	suite.Equal(http.StatusOK, rw.Code)
+
+	_, exists := suite.handler.Cache.Get("GET /large", makeRequest("/", http.Header{}), false)
+	suite.False(exists)
+}
+
+func (suite *AdmissionTestSuite) TestLockReleasedWhileStreaming() {
+	release := make(chan struct{})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("rain "))
+		<-release
+		w.Write([]byte("cats"))
+		return nil
+	})
+
+	key := "GET /streaming"
+	req := makeRequest("/", http.Header{})
+	entry, err := suite.handler.fetchUpstream(req, next, key)
+	suite.Nil(err)
+
+	rw := httptest.NewRecorder()
+	done := make(chan error)
+	go func() {
+		done <- suite.handler.admitAndRespond(rw, req, entry, suite.handler.URLLocks.Acquire(key))
+	}()
+
+	lock, ok := suite.handler.URLLocks.AcquireWithTimeout(key, time.Second)
+	suite.True(ok, "the waiting requests shouldn't wait for the whole body")
+	lock.Unlock()
+
+	close(release)
+
+	// the response is read after the admission is decided
+	suite.Nil(<-done)
+	suite.Equal("rain cats", rw.Body.String())
+
+	_, exists := suite.handler.Cache.Get(key, makeRequest("/", http.Header{}), false)
+	suite.True(exists)
+}
+
+func TestAdmissionTestSuite(t *testing.T) {
+	suite.Run(t, new(AdmissionTestSuite))
+}
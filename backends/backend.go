@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"time"
 )
 
 // Backend is the cache storage backend.
@@ -14,6 +15,31 @@ type Backend interface {
 	Clean() error
 	Flush() error
 	GetReader() (io.ReadCloser, error)
+	GetSeekableReader() (io.ReadSeekCloser, error)
+}
+
+// Refresher is implemented by the backends whose content has its own time
+// to live. The time to live is extended when the entry is revalidated.
+type Refresher interface {
+	Refresh(expiration time.Time) error
+}
+
+// Persister is implemented by the backends which keep the entry's metadata
+// next to the content so the cache index can be rebuilt after a restart.
+type Persister interface {
+	SaveMetadata(metadata []byte) error
+}
+
+// Streamer is implemented by the backends whose content can be read while
+// it's still being written.
+type Streamer interface {
+	GetStreamReader() (io.ReadCloser, error)
+}
+
+// Stored is the content found in the storage with its metadata
+type Stored struct {
+	Backend  Backend
+	Metadata []byte
 }
 
 // Base wraps the http.ResponseWriter to match the Backend interface
@@ -55,6 +81,21 @@ func (b *Base) GetReader() (io.ReadCloser, error) {
 	return nil, errors.New("private responses are not readable")
 }
 
+// GetSeekableReader no reader for base backend
+func (b *Base) GetSeekableReader() (io.ReadSeekCloser, error) {
+	return nil, errors.New("private responses are not readable")
+}
+
+// nopReadSeekCloser wraps the in memory content which is no need to be closed
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+// Close does nothing
+func (nopReadSeekCloser) Close() error {
+	return nil
+}
+
 // WrapResponseWriterToBackend wrap the responseWriter to match the backend's interface
 func WrapResponseWriterToBackend(w http.ResponseWriter) Backend {
 	return &Base{
@@ -0,0 +1,683 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltFileName is the name of the database file under the path
+const boltFileName = "caddy-cache.db"
+
+// boltChunkSize is the size of the chunks the contents are kept in
+var boltChunkSize = 1 << 20
+
+// boltCompactionBatch is the max number of the contents removed in a
+// transaction of the compaction so the writes aren't blocked for long
+var boltCompactionBatch = 1000
+
+var (
+	bodyBucket       = []byte("body")
+	metadataBucket   = []byte("metadata")
+	expirationBucket = []byte("expiration")
+	// expiryBucket indexes the ids by their expiration followed by the id so
+	// the expired ones are found in order
+	expiryBucket = []byte("expiry")
+
+	errBoltRecordNotFound = errors.New("the content is not found in the bolt database")
+
+	boltLock sync.Mutex
+	boltDBs  = map[string]*boltDB{}
+)
+
+// boltDB is an opened database shared by the storages of the same path.
+// It's closed when no storage uses it.
+type boltDB struct {
+	db   *bolt.DB
+	refs int
+	stop chan struct{}
+}
+
+// OpenBoltDB opens the database under the path and compacts it in the
+// interval. The database is shared when it's already opened.
+func OpenBoltDB(path string, interval time.Duration) (*bolt.DB, error) {
+	boltLock.Lock()
+	defer boltLock.Unlock()
+
+	name := filepath.Join(path, boltFileName)
+	if opened, ok := boltDBs[name]; ok {
+		opened.refs++
+		return opened.db, nil
+	}
+
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(name, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bodyBucket, metadataBucket, expirationBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return buildExpiryIndex(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	opened := &boltDB{db: db, refs: 1, stop: make(chan struct{})}
+	boltDBs[name] = opened
+	go compactBoltDB(db, interval, opened.stop)
+
+	return db, nil
+}
+
+// ReleaseBoltDB closes the database under the path when no one uses it
+func ReleaseBoltDB(path string) error {
+	boltLock.Lock()
+	defer boltLock.Unlock()
+
+	name := filepath.Join(path, boltFileName)
+	opened, ok := boltDBs[name]
+	if !ok {
+		return nil
+	}
+
+	opened.refs--
+	if opened.refs > 0 {
+		return nil
+	}
+
+	delete(boltDBs, name)
+	close(opened.stop)
+	return opened.db.Close()
+}
+
+// compactBoltDB removes the expired contents in the interval until it's stopped
+func compactBoltDB(db *bolt.DB, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			CompactBoltDB(db, now)
+		}
+	}
+}
+
+// buildExpiryIndex indexes the contents written by the previous versions
+// which don't have the expiry index
+func buildExpiryIndex(tx *bolt.Tx) error {
+	if tx.Bucket(expiryBucket) != nil {
+		return nil
+	}
+
+	index, err := tx.CreateBucket(expiryBucket)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(expirationBucket).ForEach(func(id, value []byte) error {
+		return index.Put(expiryKey(value, id), []byte{})
+	})
+}
+
+// CompactBoltDB removes the contents expired before the time. The pages
+// they take are reused by the later contents so the file stops growing.
+// They're removed in batches so the writes can go between them.
+func CompactBoltDB(db *bolt.DB, now time.Time) error {
+	for {
+		removed := 0
+		err := db.Update(func(tx *bolt.Tx) error {
+			expired := [][]byte{}
+
+			// the cursor stops at the first content not expired
+			c := tx.Bucket(expiryBucket).Cursor()
+			for key, _ := c.First(); key != nil && len(expired) < boltCompactionBatch; key, _ = c.Next() {
+				if len(key) < 8 || now.Before(decodeExpiration(key[:8])) {
+					break
+				}
+				expired = append(expired, append([]byte{}, key[8:]...))
+			}
+
+			for _, id := range expired {
+				if err := deleteBoltRecord(tx, id); err != nil {
+					return err
+				}
+			}
+
+			removed = len(expired)
+			return nil
+		})
+
+		if err != nil || removed < boltCompactionBatch {
+			return err
+		}
+	}
+}
+
+// LoadBoltBackends loads the contents kept in the database with their
+// metadata. The contents without the metadata are left by the incomplete
+// writes so they are removed, and so are the ones kept in a single value by
+// the previous versions.
+func LoadBoltBackends(db *bolt.DB) ([]Stored, error) {
+	stored := []Stored{}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		incomplete := [][]byte{}
+		bodies := tx.Bucket(bodyBucket)
+		metadata := tx.Bucket(metadataBucket)
+		expirations := tx.Bucket(expirationBucket)
+
+		c := bodies.Cursor()
+		for id, value := c.First(); id != nil; id, value = c.Next() {
+			m := metadata.Get(id)
+			if m == nil || value != nil {
+				incomplete = append(incomplete, append([]byte{}, id...))
+				continue
+			}
+
+			length := 0
+			bodies.Bucket(id).ForEach(func(_, chunk []byte) error {
+				length += len(chunk)
+				return nil
+			})
+
+			backend := &BoltBackend{
+				db:         db,
+				id:         append([]byte{}, id...),
+				expiration: decodeExpiration(expirations.Get(id)),
+				length:     length,
+				closed:     true,
+			}
+			stored = append(stored, Stored{Backend: backend, Metadata: append([]byte{}, m...)})
+		}
+
+		for _, id := range incomplete {
+			if err := deleteBoltRecord(tx, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// BoltBackend saves the content into a bolt database. The content is kept in
+// the chunks of boltChunkSize which are written once they're full, so only a
+// chunk is buffered while writing or reading a large content.
+type BoltBackend struct {
+	db         *bolt.DB
+	key        string
+	id         []byte
+	expiration time.Time
+	chunk      bytes.Buffer
+	chunks     uint64
+	length     int
+
+	lock    sync.Mutex
+	closed  bool
+	cleaned bool
+}
+
+// NewBoltBackend new a bolt database backend for cache's storage
+func NewBoltBackend(db *bolt.DB, key string, expiration time.Time) (Backend, error) {
+	return &BoltBackend{
+		db:         db,
+		key:        key,
+		expiration: expiration,
+	}, nil
+}
+
+// Write buffers the response content and writes the full chunks
+func (b *BoltBackend) Write(p []byte) (n int, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for n < len(p) {
+		size := boltChunkSize - b.chunk.Len()
+		if size > len(p)-n {
+			size = len(p) - n
+		}
+
+		b.chunk.Write(p[n : n+size])
+		n += size
+		b.length += size
+
+		if b.chunk.Len() == boltChunkSize {
+			if err := b.writeChunk(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// writeChunk writes the buffered chunk to the database. Each content is
+// kept in its own record so replacing an entry of the same key doesn't
+// remove the new content. The record expires as the content so the one
+// abandoned while it's written is compacted as well.
+func (b *BoltBackend) writeChunk() error {
+	defer b.chunk.Reset()
+
+	if b.cleaned {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bodies := tx.Bucket(bodyBucket)
+
+		if b.id == nil {
+			seq, err := bodies.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			id := []byte(fmt.Sprintf("%s#%d", b.key, seq))
+			if _, err := bodies.CreateBucket(id); err != nil {
+				return err
+			}
+			if err := putBoltExpiration(tx, id, b.expiration); err != nil {
+				return err
+			}
+			b.id = id
+		}
+
+		if b.chunk.Len() == 0 {
+			return nil
+		}
+
+		if err := bodies.Bucket(b.id).Put(encodeChunkIndex(b.chunks), b.chunk.Bytes()); err != nil {
+			return err
+		}
+		b.chunks++
+		return nil
+	})
+}
+
+// Flush do nothing here
+func (b *BoltBackend) Flush() error {
+	return nil
+}
+
+// Length return the cache content's length
+func (b *BoltBackend) Length() int {
+	return b.length
+}
+
+// Close writes the last chunk to the database
+func (b *BoltBackend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	return b.writeChunk()
+}
+
+// Clean performs the purge storage
+func (b *BoltBackend) Clean() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.cleaned = true
+	b.chunk = bytes.Buffer{}
+	if b.id == nil {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return deleteBoltRecord(tx, b.id)
+	})
+}
+
+// Refresh extends the time to live of the content
+func (b *BoltBackend) Refresh(expiration time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.expiration = expiration
+	if b.id == nil || b.cleaned {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putBoltExpiration(tx, b.id, expiration)
+	})
+}
+
+// SaveMetadata keeps the metadata next to the content
+func (b *BoltBackend) SaveMetadata(metadata []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.id == nil || b.cleaned {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bodyBucket).Bucket(b.id) == nil {
+			return errBoltRecordNotFound
+		}
+		return tx.Bucket(metadataBucket).Put(b.id, metadata)
+	})
+}
+
+// GetReader return a reader for the write public response
+func (b *BoltBackend) GetReader() (io.ReadCloser, error) {
+	return b.GetSeekableReader()
+}
+
+// GetSeekableReader return a seekable reader for serving the range requests.
+// The content is read by chunks.
+func (b *BoltBackend) GetSeekableReader() (io.ReadSeekCloser, error) {
+	b.lock.Lock()
+	id, length := b.id, b.length
+	b.lock.Unlock()
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if id == nil || tx.Bucket(bodyBucket).Bucket(id) == nil {
+			return errBoltRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltReader{db: b.db, id: id, length: int64(length)}, nil
+}
+
+// boltReader reads the content from its chunks. Only the chunk being read is
+// copied out of the transaction.
+type boltReader struct {
+	db     *bolt.DB
+	id     []byte
+	length int64
+	offset int64
+
+	index uint64
+	chunk []byte // the chunk of the index, nil when it's not loaded
+}
+
+// Read reads the content from the chunk where the offset is
+func (r *boltReader) Read(p []byte) (int, error) {
+	if r.offset >= r.length {
+		return 0, io.EOF
+	}
+
+	index := uint64(r.offset / int64(boltChunkSize))
+	if r.chunk == nil || r.index != index {
+		if err := r.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+
+	start := r.offset % int64(boltChunkSize)
+	if start >= int64(len(r.chunk)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n := copy(p, r.chunk[start:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *boltReader) loadChunk(index uint64) error {
+	return r.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bodyBucket).Bucket(r.id)
+		if bucket == nil {
+			return errBoltRecordNotFound
+		}
+
+		chunk := bucket.Get(encodeChunkIndex(index))
+		if chunk == nil {
+			return errBoltRecordNotFound
+		}
+
+		// the value is only valid in the transaction
+		r.chunk = append(r.chunk[:0], chunk...)
+		r.index = index
+		return nil
+	})
+}
+
+// Seek sets the offset for the next Read
+func (r *boltReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.length + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.offset = abs
+	return abs, nil
+}
+
+// Close releases the chunk
+func (r *boltReader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+// deleteBoltRecord deletes the content of the id with its metadata
+func deleteBoltRecord(tx *bolt.Tx, id []byte) error {
+	bodies := tx.Bucket(bodyBucket)
+	if bodies.Bucket(id) != nil {
+		if err := bodies.DeleteBucket(id); err != nil {
+			return err
+		}
+	} else if err := bodies.Delete(id); err != nil {
+		return err
+	}
+
+	if err := deleteBoltExpiration(tx, id); err != nil {
+		return err
+	}
+	return tx.Bucket(metadataBucket).Delete(id)
+}
+
+// putBoltExpiration sets the expiration of the id and moves it in the
+// expiry index
+func putBoltExpiration(tx *bolt.Tx, id []byte, expiration time.Time) error {
+	if err := deleteBoltExpiration(tx, id); err != nil {
+		return err
+	}
+
+	value := encodeExpiration(expiration)
+	if err := tx.Bucket(expiryBucket).Put(expiryKey(value, id), []byte{}); err != nil {
+		return err
+	}
+	return tx.Bucket(expirationBucket).Put(id, value)
+}
+
+// deleteBoltExpiration deletes the expiration of the id and its key in the
+// expiry index
+func deleteBoltExpiration(tx *bolt.Tx, id []byte) error {
+	expirations := tx.Bucket(expirationBucket)
+	if value := expirations.Get(id); value != nil {
+		if err := tx.Bucket(expiryBucket).Delete(expiryKey(value, id)); err != nil {
+			return err
+		}
+	}
+	return expirations.Delete(id)
+}
+
+// expiryKey returns the key of the id in the expiry index. The encoded
+// expiration is in big endian so the keys are sorted by the time.
+func expiryKey(expiration []byte, id []byte) []byte {
+	return append(append([]byte{}, expiration...), id...)
+}
+
+func encodeChunkIndex(index uint64) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, index)
+	return value
+}
+
+func encodeExpiration(expiration time.Time) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(expiration.UnixNano()))
+	return value
+}
+
+func decodeExpiration(value []byte) time.Time {
+	if len(value) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+}
+
+var (
+	_ Refresher = (*BoltBackend)(nil)
+	_ Persister = (*BoltBackend)(nil)
+)
+
+const (
+	defaultCompaction = 10 * time.Minute
+	keyCompaction     = "compaction_interval"
+)
+
+func init() {
+	caddy.RegisterModule(BoltStorage{})
+}
+
+// BoltStorage keeps the contents and their metadata in a bolt database
+// under the path
+type BoltStorage struct {
+	Path               string         `json:"path,omitempty"`
+	CompactionInterval caddy.Duration `json:"compaction_interval,omitempty"`
+
+	db *bolt.DB
+}
+
+// CaddyModule returns the Caddy module information
+func (BoltStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  StorageNamespace + ".bolt",
+		New: func() caddy.Module { return new(BoltStorage) },
+	}
+}
+
+// Provision opens the database
+func (s *BoltStorage) Provision(ctx caddy.Context) error {
+	if s.Path == "" {
+		s.Path = defaultFilePath
+	}
+	if s.CompactionInterval == 0 {
+		s.CompactionInterval = caddy.Duration(defaultCompaction)
+	}
+
+	db, err := OpenBoltDB(s.Path, time.Duration(s.CompactionInterval))
+	if err != nil {
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+// Cleanup closes the database
+func (s *BoltStorage) Cleanup() error {
+	return ReleaseBoltDB(s.Path)
+}
+
+// NewBackend creates a backend keeping the content in the database
+func (s *BoltStorage) NewBackend(ctx context.Context, key string, expiration time.Time) (Backend, error) {
+	return NewBoltBackend(s.db, key, expiration)
+}
+
+// OnDisk reports the database is kept on the local disk
+func (s *BoltStorage) OnDisk() bool {
+	return true
+}
+
+// Load loads the contents kept in the database
+func (s *BoltStorage) Load(ctx context.Context) ([]Stored, error) {
+	return LoadBoltBackends(s.db)
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into the bolt storage
+//
+//	storage bolt {
+//	  path /tmp/caddy_cache
+//	  compaction_interval 10m
+//	}
+func (s *BoltStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			parameter := d.Val()
+			args := d.RemainingArgs()
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+
+			switch parameter {
+			case keyPath:
+				s.Path = args[0]
+
+			case keyCompaction:
+				interval, err := caddy.ParseDuration(args[0])
+				if err != nil || interval <= 0 {
+					return d.Errf("invalid %s: %s", keyCompaction, args[0])
+				}
+				s.CompactionInterval = caddy.Duration(interval)
+
+			default:
+				return d.Errf("unrecognized subdirective %s", parameter)
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ Storage               = (*BoltStorage)(nil)
+	_ Loader                = (*BoltStorage)(nil)
+	_ DiskStorage           = (*BoltStorage)(nil)
+	_ caddy.Provisioner     = (*BoltStorage)(nil)
+	_ caddy.CleanerUpper    = (*BoltStorage)(nil)
+	_ caddyfile.Unmarshaler = (*BoltStorage)(nil)
+)
@@ -0,0 +1,214 @@
+package backends
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type BoltBackendTestSuite struct {
+	suite.Suite
+	path string
+	db   *bolt.DB
+}
+
+func (suite *BoltBackendTestSuite) SetupTest() {
+	suite.path = suite.T().TempDir()
+	db, err := OpenBoltDB(suite.path, time.Hour)
+	suite.Require().Nil(err)
+	suite.db = db
+}
+
+func (suite *BoltBackendTestSuite) TearDownTest() {
+	suite.Nil(ReleaseBoltDB(suite.path))
+}
+
+func (suite *BoltBackendTestSuite) store(key, content string, expiration time.Time) Backend {
+	backend, err := NewBoltBackend(suite.db, key, expiration)
+	suite.Require().Nil(err)
+	backend.Write([]byte(content))
+	suite.Require().Nil(backend.Close())
+	suite.Require().Nil(backend.(Persister).SaveMetadata([]byte(`{"key": "` + key + `"}`)))
+	return backend
+}
+
+func (suite *BoltBackendTestSuite) TestReadAfterClose() {
+	backend := suite.store("hello", "hello world", time.Now().Add(time.Hour))
+	suite.Equal(11, backend.Length())
+
+	reader, err := backend.GetReader()
+	suite.Nil(err)
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	suite.Nil(err)
+	suite.Equal("hello world", string(content))
+
+	seeker, err := backend.GetSeekableReader()
+	suite.Nil(err)
+	seeker.Seek(6, io.SeekStart)
+	content, _ = io.ReadAll(seeker)
+	suite.Equal("world", string(content))
+}
+
+func (suite *BoltBackendTestSuite) TestReadByChunks() {
+	defer func(size int) { boltChunkSize = size }(boltChunkSize)
+	boltChunkSize = 4
+
+	backend, _ := NewBoltBackend(suite.db, "chunks", time.Now().Add(time.Hour))
+	backend.Write([]byte("rain c"))
+	backend.Write([]byte("ats and dogs"))
+	suite.Nil(backend.Close())
+	suite.Nil(backend.(Persister).SaveMetadata([]byte(`{}`)))
+
+	reader, err := backend.GetSeekableReader()
+	suite.Nil(err)
+	content, _ := io.ReadAll(reader)
+	suite.Equal("rain cats and dogs", string(content))
+
+	// the seek crosses the chunks
+	reader.Seek(-7, io.SeekEnd)
+	content, _ = io.ReadAll(reader)
+	suite.Equal("nd dogs", string(content))
+	reader.Seek(5, io.SeekStart)
+	buf := make([]byte, 4)
+	n, _ := io.ReadFull(reader, buf)
+	suite.Equal("cats", string(buf[:n]))
+
+	stored, err := LoadBoltBackends(suite.db)
+	suite.Nil(err)
+	suite.Len(stored, 1)
+	suite.Equal(18, stored[0].Backend.Length())
+}
+
+func (suite *BoltBackendTestSuite) TestDropSingleValueContent() {
+	suite.Nil(suite.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bodyBucket).Put([]byte("legacy#1"), []byte("content")); err != nil {
+			return err
+		}
+		return tx.Bucket(metadataBucket).Put([]byte("legacy#1"), []byte(`{}`))
+	}))
+
+	stored, err := LoadBoltBackends(suite.db)
+	suite.Nil(err)
+	suite.Len(stored, 0, "the content kept in a single value should be removed")
+}
+
+func (suite *BoltBackendTestSuite) TestReplaceKey() {
+	previous := suite.store("key", "previous", time.Now().Add(time.Hour))
+	current := suite.store("key", "current", time.Now().Add(time.Hour))
+
+	suite.Nil(previous.Clean())
+	reader, err := current.GetReader()
+	suite.Nil(err, "cleaning the previous content should not remove the current one")
+	content, _ := io.ReadAll(reader)
+	suite.Equal("current", string(content))
+}
+
+func (suite *BoltBackendTestSuite) TestCleanBeforeClose() {
+	backend, _ := NewBoltBackend(suite.db, "cleaned", time.Now().Add(time.Hour))
+	backend.Write([]byte("content"))
+	suite.Nil(backend.Clean())
+	suite.Nil(backend.Close())
+
+	stored, err := LoadBoltBackends(suite.db)
+	suite.Nil(err)
+	suite.Len(stored, 0)
+}
+
+func (suite *BoltBackendTestSuite) TestLoadAfterReopen() {
+	suite.store("kept", "content", time.Now().Add(time.Hour))
+
+	incomplete, _ := NewBoltBackend(suite.db, "incomplete", time.Now().Add(time.Hour))
+	incomplete.Write([]byte("content"))
+	suite.Nil(incomplete.Close())
+
+	suite.Nil(ReleaseBoltDB(suite.path))
+	db, err := OpenBoltDB(suite.path, time.Hour)
+	suite.Require().Nil(err)
+	suite.db = db
+
+	stored, err := LoadBoltBackends(suite.db)
+	suite.Nil(err)
+	suite.Len(stored, 1, "the content without metadata should be removed")
+	suite.Equal(`{"key": "kept"}`, string(stored[0].Metadata))
+
+	reader, err := stored[0].Backend.GetReader()
+	suite.Nil(err)
+	content, _ := io.ReadAll(reader)
+	suite.Equal("content", string(content))
+	suite.Equal(7, stored[0].Backend.Length())
+}
+
+func (suite *BoltBackendTestSuite) TestCompaction() {
+	now := time.Now()
+	expired := suite.store("expired", "content", now.Add(time.Minute))
+	refreshed := suite.store("refreshed", "content", now.Add(time.Minute))
+	suite.store("fresh", "content", now.Add(time.Hour))
+
+	suite.Nil(refreshed.(Refresher).Refresh(now.Add(time.Hour)))
+	suite.Nil(CompactBoltDB(suite.db, now.Add(2*time.Minute)))
+
+	_, err := expired.GetReader()
+	suite.Error(err)
+
+	stored, err := LoadBoltBackends(suite.db)
+	suite.Nil(err)
+	suite.Len(stored, 2)
+}
+
+func (suite *BoltBackendTestSuite) TestCompactInBatches() {
+	defer func(size int) { boltCompactionBatch = size }(boltCompactionBatch)
+	boltCompactionBatch = 2
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		suite.store(fmt.Sprintf("expired-%d", i), "content", now.Add(time.Duration(i)*time.Second))
+	}
+	suite.store("fresh", "content", now.Add(time.Hour))
+
+	suite.Nil(CompactBoltDB(suite.db, now.Add(time.Minute)))
+
+	stored, err := LoadBoltBackends(suite.db)
+	suite.Nil(err)
+	suite.Len(stored, 1)
+	suite.Equal(`{"key": "fresh"}`, string(stored[0].Metadata))
+}
+
+func (suite *BoltBackendTestSuite) TestBuildExpiryIndex() {
+	now := time.Now()
+	suite.store("expired", "content", now.Add(time.Minute))
+	suite.store("fresh", "content", now.Add(time.Hour))
+
+	// the database written by the previous versions has no expiry index
+	suite.Nil(suite.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(expiryBucket); err != nil {
+			return err
+		}
+		return buildExpiryIndex(tx)
+	}))
+
+	suite.Nil(CompactBoltDB(suite.db, now.Add(2*time.Minute)))
+
+	stored, err := LoadBoltBackends(suite.db)
+	suite.Nil(err)
+	suite.Len(stored, 1)
+}
+
+func (suite *BoltBackendTestSuite) TestShareDatabase() {
+	db, err := OpenBoltDB(suite.path, time.Hour)
+	suite.Nil(err)
+	suite.Equal(suite.db, db)
+	suite.Nil(ReleaseBoltDB(suite.path))
+
+	backend := suite.store("shared", "content", time.Now().Add(time.Hour))
+	_, err = backend.GetReader()
+	suite.Nil(err, "the database should be kept open for the other users")
+}
+
+func TestBoltBackendTestSuite(t *testing.T) {
+	suite.Run(t, new(BoltBackendTestSuite))
+}
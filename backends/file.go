@@ -1,15 +1,30 @@
 package backends
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+const (
+	filePrefix     = "caddy-cache-"
+	metadataSuffix = ".meta"
 )
 
 // FileBackend saves the content into a file
 type FileBackend struct {
 	file         *os.File
+	name         string
 	subscription *Subscription
+	length       int
 }
 
 // NewFileBackend new a disk storage backend
@@ -19,26 +34,88 @@ func NewFileBackend(path string) (Backend, error) {
 		return nil, err
 	}
 
-	file, err := os.CreateTemp(path, "caddy-cache-")
+	file, err := os.CreateTemp(path, filePrefix)
 	if err != nil {
 		return nil, err
 	}
 
 	return &FileBackend{
 		file:         file,
+		name:         file.Name(),
 		subscription: NewSubscription(),
 	}, nil
 }
 
+// LoadFileBackends loads the contents kept in the path with their metadata.
+// The contents without the metadata are left by the incomplete writes so
+// they are removed. The unreadable ones are skipped.
+func LoadFileBackends(path string) ([]Stored, error) {
+	names, err := filepath.Glob(filepath.Join(path, filePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	stored := []Stored{}
+	for _, name := range names {
+		if strings.HasSuffix(name, metadataSuffix) {
+			// the metadata whose content is removed
+			if _, err := os.Stat(strings.TrimSuffix(name, metadataSuffix)); os.IsNotExist(err) {
+				os.Remove(name)
+			}
+			continue
+		}
+
+		metadata, err := os.ReadFile(name + metadataSuffix)
+		if os.IsNotExist(err) {
+			os.Remove(name)
+			continue
+		}
+		if err != nil {
+			caddy.Log().Named("backend:file").Warn(fmt.Sprintf("skip loading %s: %s", name, err.Error()))
+			continue
+		}
+
+		backend, err := openFileBackend(name)
+		if err != nil {
+			caddy.Log().Named("backend:file").Warn(fmt.Sprintf("skip loading %s: %s", name, err.Error()))
+			continue
+		}
+
+		stored = append(stored, Stored{Backend: backend, Metadata: metadata})
+	}
+
+	return stored, nil
+}
+
+// openFileBackend refers to the completely written content in the file.
+// The file isn't kept open, it's opened by each reader.
+func openFileBackend(name string) (*FileBackend, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := NewSubscription()
+	subscription.Close()
+
+	return &FileBackend{
+		name:         name,
+		subscription: subscription,
+		length:       int(info.Size()),
+	}, nil
+}
+
 // Length return the cache content's length
 func (f *FileBackend) Length() int {
-	return 0
+	return f.length
 }
 
 // Write writes the content to file
 func (f *FileBackend) Write(p []byte) (n int, err error) {
 	defer f.subscription.NotifyAll(len(p))
-	return f.file.Write(p)
+	n, err = f.file.Write(p)
+	f.length += n
+	return n, err
 }
 
 // Flush syncs the underlying file
@@ -50,18 +127,38 @@ func (f *FileBackend) Flush() error {
 // Clean performs the purge storage
 func (f *FileBackend) Clean() error {
 	f.subscription.WaitAll()
-	return os.Remove(f.file.Name())
+
+	err := os.Remove(f.name + metadataSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(f.name)
+}
+
+// SaveMetadata writes the metadata next to the content. It's written to
+// a temp file first so an incomplete one is never loaded.
+func (f *FileBackend) SaveMetadata(metadata []byte) error {
+	name := f.name + metadataSuffix
+	if err := os.WriteFile(name+".tmp", metadata, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(name+".tmp", name)
 }
 
-// Close performs the file close
+// Close performs the file close. The loaded content has no file to close.
 func (f *FileBackend) Close() error {
 	f.subscription.Close()
+	if f.file == nil {
+		return nil
+	}
 	return f.file.Close()
 }
 
 // GetReader get the ReadCloser from the file backend
 func (f *FileBackend) GetReader() (io.ReadCloser, error) {
-	newFile, err := os.Open(f.file.Name())
+	newFile, err := os.Open(f.name)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +170,17 @@ func (f *FileBackend) GetReader() (io.ReadCloser, error) {
 	}, nil
 }
 
+// GetStreamReader gets the reader following the content being written
+func (f *FileBackend) GetStreamReader() (io.ReadCloser, error) {
+	return f.GetReader()
+}
+
+// GetSeekableReader get the ReadSeekCloser from the file backend.
+// It should be called after the content is completely written.
+func (f *FileBackend) GetSeekableReader() (io.ReadSeekCloser, error) {
+	return os.Open(f.name)
+}
+
 // FileReader is the common code to read the storages until the subscription channel is closed
 type FileReader struct {
 	subscription <-chan int
@@ -80,17 +188,24 @@ type FileReader struct {
 	unsubscribe  func(<-chan int)
 }
 
-// Read reads the content
+// Read reads the content. The content written before the reader is created
+// is read first and then it waits for the new content until the subscription
+// channel is closed.
 func (r *FileReader) Read(p []byte) (n int, err error) {
-	for range r.subscription {
+	for {
 		n, err := r.content.Read(p)
 		if err != io.EOF {
 			return n, err
 		}
-	}
+		if n > 0 {
+			return n, nil
+		}
 
-	// if there is no subscription, just read
-	return r.content.Read(p)
+		if _, ok := <-r.subscription; !ok {
+			// if there is no subscription, just read
+			return r.content.Read(p)
+		}
+	}
 }
 
 // Close closes the underlying storage
@@ -203,3 +318,88 @@ func (s *Subscription) WaitAll() {
 
 	<-s.noSubscriberChan
 }
+
+var (
+	_ Persister = (*FileBackend)(nil)
+	_ Streamer  = (*FileBackend)(nil)
+)
+
+const (
+	defaultFilePath = "/tmp/caddy_cache"
+	keyPath         = "path"
+)
+
+func init() {
+	caddy.RegisterModule(FileStorage{})
+}
+
+// FileStorage keeps each content in a file under the path
+type FileStorage struct {
+	Path string `json:"path,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (FileStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  StorageNamespace + ".file",
+		New: func() caddy.Module { return new(FileStorage) },
+	}
+}
+
+// Provision sets up the default path
+func (s *FileStorage) Provision(ctx caddy.Context) error {
+	if s.Path == "" {
+		s.Path = defaultFilePath
+	}
+	return nil
+}
+
+// NewBackend creates a file for the content
+func (s *FileStorage) NewBackend(ctx context.Context, key string, expiration time.Time) (Backend, error) {
+	return NewFileBackend(s.Path)
+}
+
+// OnDisk reports the files are kept on the local disk
+func (s *FileStorage) OnDisk() bool {
+	return true
+}
+
+// Load loads the files kept under the path
+func (s *FileStorage) Load(ctx context.Context) ([]Stored, error) {
+	return LoadFileBackends(s.Path)
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into the file storage
+//
+//	storage file {
+//	  path /tmp/caddy_cache
+//	}
+func (s *FileStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			parameter := d.Val()
+			args := d.RemainingArgs()
+
+			switch parameter {
+			case keyPath:
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				s.Path = args[0]
+
+			default:
+				return d.Errf("unrecognized subdirective %s", parameter)
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ Storage               = (*FileStorage)(nil)
+	_ Loader                = (*FileStorage)(nil)
+	_ DiskStorage           = (*FileStorage)(nil)
+	_ caddy.Provisioner     = (*FileStorage)(nil)
+	_ caddyfile.Unmarshaler = (*FileStorage)(nil)
+)
@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -43,6 +44,29 @@ func (suite *FileBackendTestSuite) TestReadAfterWrite() {
 	suite.Equal(content, buf)
 }
 
+func (suite *FileBackendTestSuite) TestSeekableReader() {
+	backend, err := NewFileBackend("/tmp/test")
+	suite.Nil(err)
+
+	backend.Write([]byte("hello world"))
+	backend.Close()
+	defer backend.Clean()
+
+	reader, err := backend.GetSeekableReader()
+	suite.Nil(err)
+	defer reader.Close()
+
+	size, err := reader.Seek(0, io.SeekEnd)
+	suite.Nil(err)
+	suite.Equal(int64(11), size)
+
+	_, err = reader.Seek(6, io.SeekStart)
+	suite.Nil(err)
+	result, err := io.ReadAll(reader)
+	suite.Nil(err)
+	suite.Equal([]byte("world"), result)
+}
+
 func (suite *FileBackendTestSuite) TestAutoCreateDirIfNonExist() {
 	path := suite.generateRandomPath(5)
 	dirName := filepath.Join("/tmp", path)
@@ -71,6 +95,64 @@ func (suite *FileBackendTestSuite) TestLengthShouldBeZero() {
 	suite.Equal(0, n)
 }
 
+func (suite *FileBackendTestSuite) TestLengthAfterWrite() {
+	backend, err := NewFileBackend("/tmp/hello")
+	suite.Nil(err)
+	defer backend.Clean()
+
+	backend.Write([]byte("hello "))
+	backend.Write([]byte("world"))
+	backend.Close()
+	suite.Equal(11, backend.Length())
+}
+
+func (suite *FileBackendTestSuite) TestLoadFileBackends() {
+	path := suite.T().TempDir()
+
+	stored, err := NewFileBackend(path)
+	suite.Nil(err)
+	stored.Write([]byte("hello world"))
+	stored.Close()
+	suite.Nil(stored.(Persister).SaveMetadata([]byte(`{"key": "stored"}`)))
+
+	// the incomplete write without the metadata
+	orphan, err := NewFileBackend(path)
+	suite.Nil(err)
+	orphan.Write([]byte("hello"))
+	orphan.Close()
+
+	// the unreadable metadata is skipped instead of failing the whole load
+	unreadable, err := NewFileBackend(path)
+	suite.Nil(err)
+	unreadable.Close()
+	unreadableName := unreadable.(*FileBackend).file.Name()
+	suite.Nil(os.Mkdir(unreadableName+metadataSuffix, 0o755))
+	defer os.RemoveAll(unreadableName + metadataSuffix)
+	defer os.Remove(unreadableName)
+
+	loaded, err := LoadFileBackends(path)
+	suite.Nil(err)
+	suite.Len(loaded, 1)
+	suite.Equal([]byte(`{"key": "stored"}`), loaded[0].Metadata)
+	suite.Equal(11, loaded[0].Backend.Length())
+
+	reader, err := loaded[0].Backend.GetReader()
+	suite.Nil(err)
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	suite.Nil(err)
+	suite.Equal("hello world", string(content))
+
+	_, err = os.Stat(orphan.(*FileBackend).file.Name())
+	suite.True(os.IsNotExist(err), "the orphan content should be removed")
+
+	suite.Nil(loaded[0].Backend.Close())
+	suite.Nil(loaded[0].Backend.Clean())
+	names, _ := filepath.Glob(filepath.Join(path, "*"))
+	suite.ElementsMatch([]string{unreadableName, unreadableName + metadataSuffix}, names,
+		"the metadata should be removed with the content")
+}
+
 func (suite *FileBackendTestSuite) TestDeleteFileAfterCleaned() {
 	backend, err := NewFileBackend("/tmp/hello")
 	suite.Nil(err)
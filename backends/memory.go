@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/mailgun/groupcache/v2"
 	"github.com/sillygod/cdp-cache/pkg/helper"
 )
@@ -37,12 +42,23 @@ const (
 	getterTTLCtxKey ctxKey = "getterTTL"
 )
 
+const (
+	// DefaultPeerListenAddr is the address serving the peers by default
+	DefaultPeerListenAddr = ":http"
+	// DefaultPeerBasePath is the base path of the peers' requests by default
+	DefaultPeerBasePath = "/_groupcache/"
+)
+
 var (
-	groupName = "http_cache"
-	groupch   *groupcache.Group
-	pool      *groupcache.HTTPPool
-	l         sync.Mutex
-	srv       *http.Server
+	groupName    = "http_cache"
+	groupch      *groupcache.Group
+	pool         *groupcache.HTTPPool
+	l            sync.Mutex
+	srv          *http.Server
+	peerAddr     string
+	peerBasePath string
+	peerPort     string
+	peerRefs     int
 )
 
 // InMemoryBackend saves the content into memory with the groupcache.
@@ -55,66 +71,107 @@ type InMemoryBackend struct {
 	cachedBytes      []byte
 }
 
-// GetGroupCachePool gets the groupcache's httppool
+// GetGroupCachePool gets the groupcache's httppool. It's nil when the
+// groupcache is not shared with the peers.
 func GetGroupCachePool() *groupcache.HTTPPool {
 	return pool
 }
 
+// GroupCachePeerURL returns the url of the peer serving on the ip. The
+// peers serve on the same port as this node.
+func GroupCachePeerURL(ip string) string {
+	return "http://" + net.JoinHostPort(ip, peerPort)
+}
+
 // ReleaseGroupCacheRes releases the resources the memory backend
-// collects
+// collects. The server for the peers is shut down when no one uses it.
 func ReleaseGroupCacheRes() error {
-	if srv != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := srv.Shutdown(ctx); err != nil {
-			return err
-		}
+	l.Lock()
+	defer l.Unlock()
+
+	if srv == nil {
+		return nil
 	}
-	return nil
+
+	peerRefs--
+	if peerRefs > 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	srv = nil
+	return err
 }
 
 // InitGroupCacheRes init the resources for groupcache
-// init this in the handler provision stage.
+// init this in the handler provision stage. The groupcache runs in the
+// process until it's shared with the peers by InitGroupCachePeers.
 func InitGroupCacheRes(maxSize int) error {
-	var err error
-
 	l.Lock()
 	defer l.Unlock()
 
-	poolOptions := &groupcache.HTTPPoolOptions{}
+	if groupch == nil {
+		groupch = groupcache.NewGroup(groupName, int64(maxSize), groupcache.GetterFunc(getter))
+	}
 
-	ip, err := helper.IPAddr()
-	if err != nil {
-		return err
+	return nil
+}
+
+// InitGroupCachePeers serves the groupcache to the peers on the listen
+// address with the base path. The server is shared by the callers and it's
+// released by ReleaseGroupCacheRes. The address and the base path can't be
+// changed without a restart because the groupcache keeps the first ones.
+func InitGroupCachePeers(listenAddr, basePath string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if pool != nil && (listenAddr != peerAddr || basePath != peerBasePath) {
+		return fmt.Errorf("the groupcache peers serve on %s%s, it can't be changed without a restart", peerAddr, peerBasePath)
 	}
 
-	self := "http://" + ip.String()
 	if pool == nil {
-		pool = groupcache.NewHTTPPoolOpts(self, poolOptions)
+		_, port, err := net.SplitHostPort(listenAddr)
+		if err != nil {
+			return err
+		}
+
+		portNum, err := net.LookupPort("tcp", port)
+		if err != nil {
+			return err
+		}
+
+		ip, err := helper.IPAddr()
+		if err != nil {
+			return err
+		}
+
+		peerAddr, peerBasePath, peerPort = listenAddr, basePath, strconv.Itoa(portNum)
+		pool = groupcache.NewHTTPPoolOpts(GroupCachePeerURL(ip.String()), &groupcache.HTTPPoolOptions{BasePath: basePath})
 	}
 
-	if groupch == nil {
-		groupch = groupcache.NewGroup(groupName, int64(maxSize), groupcache.GetterFunc(getter))
+	if srv != nil {
+		peerRefs++
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/_groupcache/", pool)
+	mux.Handle(basePath, pool)
 	srv = &http.Server{
-		Addr:    ":http",
+		Addr:    listenAddr,
 		Handler: mux,
 	}
+	peerRefs = 1
 
-	errChan := make(chan error, 1)
-
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errChan <- err
-		}
-	}()
-
-	errChan <- nil
-
-	return <-errChan
+	go srv.Serve(ln)
+	return nil
 }
 
 func getter(ctx context.Context, key string, dest groupcache.Sink) error {
@@ -191,18 +248,181 @@ func (i *InMemoryBackend) Length() int {
 	return 0
 }
 
-// GetReader return a reader for the write public response
-func (i *InMemoryBackend) GetReader() (io.ReadCloser, error) {
+// Refresh sets the content in the groupcache again with the new expiration
+// because the groupcache can not update the expiration of a key.
+func (i *InMemoryBackend) Refresh(expiration time.Time) error {
+	i.expiration = expiration
 
-	if len(i.cachedBytes) == 0 {
-		err := groupch.Get(i.Ctx, i.Key, groupcache.AllocatingByteSliceSink(&i.cachedBytes))
-		if err != nil {
-			caddy.Log().Named("backend:memory").Warn(err.Error())
-			return nil, err
-		}
+	if err := i.loadCachedBytes(); err != nil {
+		return err
+	}
+
+	return groupch.Set(i.Ctx, i.Key, i.cachedBytes, expiration, false)
+}
+
+// loadCachedBytes gets the content from the groupcache if it's not loaded yet
+func (i *InMemoryBackend) loadCachedBytes() error {
+	if len(i.cachedBytes) != 0 {
+		return nil
+	}
 
+	err := groupch.Get(i.Ctx, i.Key, groupcache.AllocatingByteSliceSink(&i.cachedBytes))
+	if err != nil {
+		caddy.Log().Named("backend:memory").Warn(err.Error())
+	}
+
+	return err
+}
+
+// GetReader return a reader for the write public response
+func (i *InMemoryBackend) GetReader() (io.ReadCloser, error) {
+	if err := i.loadCachedBytes(); err != nil {
+		return nil, err
 	}
 
 	rc := io.NopCloser(bytes.NewReader(i.cachedBytes))
 	return rc, nil
 }
+
+// GetSeekableReader return a seekable reader for serving the range requests
+func (i *InMemoryBackend) GetSeekableReader() (io.ReadSeekCloser, error) {
+	if err := i.loadCachedBytes(); err != nil {
+		return nil, err
+	}
+
+	return nopReadSeekCloser{bytes.NewReader(i.cachedBytes)}, nil
+}
+
+var (
+	_ Refresher = (*InMemoryBackend)(nil)
+)
+
+const (
+	defaultMaxMemorySize = 1 << 30 // 1 GB
+	keyMaxMemorySize     = "max_memory_size"
+	keyPeerAddr          = "peer_listen_addr"
+	keyPeerBasePath      = "peer_base_path"
+)
+
+func init() {
+	caddy.RegisterModule(InMemoryStorage{})
+}
+
+// InMemoryStorage keeps the contents in memory with the groupcache. It runs
+// in the process unless the cache is distributed.
+type InMemoryStorage struct {
+	MaxMemorySize  int    `json:"max_memory_size,omitempty"`
+	PeerListenAddr string `json:"peer_listen_addr,omitempty"`
+	PeerBasePath   string `json:"peer_base_path,omitempty"`
+
+	serving bool
+}
+
+// CaddyModule returns the Caddy module information
+func (InMemoryStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  StorageNamespace + ".in_memory",
+		New: func() caddy.Module { return new(InMemoryStorage) },
+	}
+}
+
+// Provision inits the resources of the groupcache
+func (s *InMemoryStorage) Provision(ctx caddy.Context) error {
+	if s.MaxMemorySize == 0 {
+		s.MaxMemorySize = defaultMaxMemorySize
+	}
+	if s.PeerListenAddr == "" {
+		s.PeerListenAddr = DefaultPeerListenAddr
+	}
+	if s.PeerBasePath == "" {
+		s.PeerBasePath = DefaultPeerBasePath
+	}
+	if !strings.HasSuffix(s.PeerBasePath, "/") {
+		s.PeerBasePath += "/"
+	}
+	return InitGroupCacheRes(s.MaxMemorySize)
+}
+
+// ServePeers serves the groupcache to the peers
+func (s *InMemoryStorage) ServePeers() error {
+	if err := InitGroupCachePeers(s.PeerListenAddr, s.PeerBasePath); err != nil {
+		return err
+	}
+
+	s.serving = true
+	return nil
+}
+
+// Cleanup releases the resources of the groupcache
+func (s *InMemoryStorage) Cleanup() error {
+	if !s.serving {
+		return nil
+	}
+
+	s.serving = false
+	return ReleaseGroupCacheRes()
+}
+
+// NewBackend creates a backend keeping the content in the groupcache
+func (s *InMemoryStorage) NewBackend(ctx context.Context, key string, expiration time.Time) (Backend, error) {
+	return NewInMemoryBackend(ctx, key, expiration)
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into the in memory storage
+//
+//	storage in_memory {
+//	  max_memory_size 1073741824
+//	  peer_listen_addr :7070
+//	  peer_base_path /_groupcache/
+//	}
+func (s *InMemoryStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			parameter := d.Val()
+			args := d.RemainingArgs()
+
+			switch parameter {
+			case keyMaxMemorySize:
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(args[0])
+				if err != nil || size <= 0 {
+					return d.Errf("invalid %s: %s", keyMaxMemorySize, args[0])
+				}
+				s.MaxMemorySize = size
+
+			case keyPeerAddr:
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				if _, _, err := net.SplitHostPort(args[0]); err != nil {
+					return d.Errf("invalid %s: %s", keyPeerAddr, args[0])
+				}
+				s.PeerListenAddr = args[0]
+
+			case keyPeerBasePath:
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				if !strings.HasPrefix(args[0], "/") {
+					return d.Errf("invalid %s: %s, it should start with /", keyPeerBasePath, args[0])
+				}
+				s.PeerBasePath = args[0]
+
+			default:
+				return d.Errf("unrecognized subdirective %s", parameter)
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ Storage               = (*InMemoryStorage)(nil)
+	_ caddy.Provisioner     = (*InMemoryStorage)(nil)
+	_ caddy.CleanerUpper    = (*InMemoryStorage)(nil)
+	_ Peering               = (*InMemoryStorage)(nil)
+	_ caddyfile.Unmarshaler = (*InMemoryStorage)(nil)
+)
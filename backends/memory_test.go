@@ -3,6 +3,8 @@ package backends
 import (
 	"context"
 	"io"
+	"net"
+	"net/http"
 	"testing"
 	"time"
 
@@ -70,6 +72,23 @@ func (suite *MemoryBackendTestSuite) TestReadExistingCacheInGroupCache() {
 
 }
 
+func (suite *MemoryBackendTestSuite) TestSeekableReader() {
+	backend, err := NewInMemoryBackend(context.Background(), "seekable", time.Now().Add(1*time.Minute))
+	suite.Assert().NoError(err)
+	backend.Write([]byte("hello world"))
+	backend.Close()
+
+	reader, err := backend.GetSeekableReader()
+	suite.Assert().NoError(err)
+	defer reader.Close()
+
+	_, err = reader.Seek(6, io.SeekStart)
+	suite.Assert().NoError(err)
+	result, err := io.ReadAll(reader)
+	suite.Assert().NoError(err)
+	suite.Equal([]byte("world"), result)
+}
+
 func (suite *MemoryBackendTestSuite) TestCleanCache() {
 	ctx := context.Background()
 	backend, err := NewInMemoryBackend(ctx, "be_cleaned_key", time.Now().Add(1*time.Minute))
@@ -83,6 +102,39 @@ func (suite *MemoryBackendTestSuite) TestCleanCache() {
 	suite.True(ok)
 }
 
+func (suite *MemoryBackendTestSuite) TestInProcessByDefault() {
+	suite.Nil(GetGroupCachePool(), "the groupcache should not serve the peers")
+	suite.Nil(ReleaseGroupCacheRes())
+}
+
+func (suite *MemoryBackendTestSuite) TestServePeers() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	suite.Require().NoError(InitGroupCachePeers(addr, "/_peers/"))
+	suite.NotNil(GetGroupCachePool())
+	suite.NoError(InitGroupCachePeers(addr, "/_peers/"), "the server should be shared")
+	suite.Error(InitGroupCachePeers(addr, "/_groupcache/"), "the base path can't be changed")
+
+	_, port, _ := net.SplitHostPort(addr)
+	suite.Equal("http://10.0.0.2:"+port, GroupCachePeerURL("10.0.0.2"))
+
+	res, err := http.Get("http://" + addr + "/_peers/" + groupName + "/hello")
+	suite.Require().NoError(err)
+	res.Body.Close()
+	suite.NotEqual(http.StatusNotFound, res.StatusCode, "the peers' requests should be served on the base path")
+
+	suite.NoError(ReleaseGroupCacheRes())
+	_, err = http.Get("http://" + addr + "/_peers/")
+	suite.NoError(err, "the server should be kept for the other user")
+
+	suite.NoError(ReleaseGroupCacheRes())
+	_, err = http.Get("http://" + addr + "/_peers/")
+	suite.Error(err, "the server should be shut down")
+}
+
 func TestMemoryBackendTestSuite(t *testing.T) {
 	suite.Run(t, new(MemoryBackendTestSuite))
 }
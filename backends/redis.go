@@ -8,9 +8,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/redis/go-redis/v9"
 )
 
+// metadataPrefix is the prefix of the keys keeping the entries' metadata
+const metadataPrefix = "cdp-cache-meta:"
+
 var (
 	client *redis.Client
 )
@@ -78,6 +83,38 @@ func NewRedisBackend(ctx context.Context, key string, expiration time.Time) (Bac
 	}, nil
 }
 
+// LoadRedisBackends loads the contents kept in redis with their metadata
+func LoadRedisBackends(ctx context.Context) ([]Stored, error) {
+	stored := []Stored{}
+
+	iter := client.Scan(ctx, 0, metadataPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		metadataKey := iter.Val()
+		key := strings.TrimPrefix(metadataKey, metadataPrefix)
+
+		metadata, err := client.Get(ctx, metadataKey).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the metadata whose content is expired or removed
+		if n, err := client.Exists(ctx, key).Result(); err != nil || n == 0 {
+			client.Del(ctx, metadataKey)
+			continue
+		}
+
+		stored = append(stored, Stored{
+			Backend:  &RedisBackend{Ctx: ctx, Key: key},
+			Metadata: metadata,
+		})
+	}
+
+	return stored, iter.Err()
+}
+
 // Write writes the response content in a temp buffer
 func (r *RedisBackend) Write(p []byte) (n int, err error) {
 	return r.content.Write(p)
@@ -101,7 +138,24 @@ func (r *RedisBackend) Close() error {
 
 // Clean performs the purge storage
 func (r *RedisBackend) Clean() error {
-	_, err := client.Del(r.Ctx, r.Key).Result()
+	_, err := client.Del(r.Ctx, r.Key, metadataPrefix+r.Key).Result()
+	return err
+}
+
+// Refresh extends the time to live of the content kept in redis
+func (r *RedisBackend) Refresh(expiration time.Time) error {
+	r.expiration = expiration
+	if _, err := client.ExpireAt(r.Ctx, r.Key, expiration).Result(); err != nil {
+		return err
+	}
+
+	_, err := client.ExpireAt(r.Ctx, metadataPrefix+r.Key, expiration).Result()
+	return err
+}
+
+// SaveMetadata keeps the metadata in redis as long as the content
+func (r *RedisBackend) SaveMetadata(metadata []byte) error {
+	_, err := client.Set(r.Ctx, metadataPrefix+r.Key, metadata, time.Until(r.expiration)).Result()
 	return err
 }
 
@@ -115,3 +169,108 @@ func (r *RedisBackend) GetReader() (io.ReadCloser, error) {
 	rc := io.NopCloser(strings.NewReader(content))
 	return rc, nil
 }
+
+// GetSeekableReader return a seekable reader for serving the range requests
+func (r *RedisBackend) GetSeekableReader() (io.ReadSeekCloser, error) {
+	content, err := client.Get(r.Ctx, r.Key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return nopReadSeekCloser{strings.NewReader(content)}, nil
+}
+
+var (
+	_ Refresher = (*RedisBackend)(nil)
+	_ Persister = (*RedisBackend)(nil)
+)
+
+const (
+	defaultRedisAddr = "localhost:6379"
+	keyAddr          = "addr"
+	keyDB            = "db"
+	keyPassword      = "password"
+)
+
+func init() {
+	caddy.RegisterModule(RedisStorage{})
+}
+
+// RedisStorage keeps the contents in redis
+type RedisStorage struct {
+	Addr     string `json:"addr,omitempty"`
+	DB       int    `json:"db,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (RedisStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  StorageNamespace + ".redis",
+		New: func() caddy.Module { return new(RedisStorage) },
+	}
+}
+
+// Provision connects to the redis
+func (s *RedisStorage) Provision(ctx caddy.Context) error {
+	if s.Addr == "" {
+		s.Addr = defaultRedisAddr
+	}
+	return InitRedisClient(s.Addr, s.Password, s.DB)
+}
+
+// NewBackend creates a backend keeping the content in redis
+func (s *RedisStorage) NewBackend(ctx context.Context, key string, expiration time.Time) (Backend, error) {
+	return NewRedisBackend(ctx, key, expiration)
+}
+
+// Load loads the contents kept in redis
+func (s *RedisStorage) Load(ctx context.Context) ([]Stored, error) {
+	return LoadRedisBackends(ctx)
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into the redis storage
+//
+//	storage redis {
+//	  addr localhost:6379
+//	  db 0
+//	  password secret
+//	}
+func (s *RedisStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			parameter := d.Val()
+			args := d.RemainingArgs()
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+
+			switch parameter {
+			case keyAddr:
+				s.Addr = args[0]
+
+			case keyDB:
+				db, err := strconv.Atoi(args[0])
+				if err != nil {
+					return d.Errf("invalid %s: %s", keyDB, args[0])
+				}
+				s.DB = db
+
+			case keyPassword:
+				s.Password = args[0]
+
+			default:
+				return d.Errf("unrecognized subdirective %s", parameter)
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ Storage               = (*RedisStorage)(nil)
+	_ Loader                = (*RedisStorage)(nil)
+	_ caddy.Provisioner     = (*RedisStorage)(nil)
+	_ caddyfile.Unmarshaler = (*RedisStorage)(nil)
+)
@@ -0,0 +1,520 @@
+package backends
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// errS3Cleaned aborts the upload of the content cleaned before it's complete
+var errS3Cleaned = errors.New("the content is cleaned before the upload completes")
+
+// S3Client is the client of the bucket shared by the backends of a node
+type S3Client struct {
+	Client    *s3.S3
+	Uploader  *s3manager.Uploader
+	Bucket    string
+	Prefix    string
+	RangeSize int64
+}
+
+// S3Backend saves the content into an S3-compatible bucket. The content is
+// streamed to the bucket with a multipart upload while it's written.
+type S3Backend struct {
+	client     *S3Client
+	object     string
+	expiration time.Time
+	length     int
+
+	lock    sync.Mutex
+	started bool
+	writer  *io.PipeWriter
+	done    chan error
+	err     error
+}
+
+// NewS3Backend new a S3 backend for cache's storage. Each content is kept in
+// its own object so replacing an entry of the same key doesn't remove the
+// new content. The requests to the bucket aren't bound to the context of the
+// client's request because the content outlives it.
+func NewS3Backend(client *S3Client, key string, expiration time.Time) (Backend, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	return &S3Backend{
+		client:     client,
+		object:     client.Prefix + hex.EncodeToString(hash[:]) + "-" + hex.EncodeToString(suffix),
+		expiration: expiration,
+	}, nil
+}
+
+// LoadS3Backends loads the contents kept under the prefix with their
+// metadata. The prefix belongs to one node because the contents are removed
+// by the node which indexes them. The contents without the metadata are left
+// to the lifecycle rules of the bucket.
+func LoadS3Backends(ctx context.Context, client *S3Client) ([]Stored, error) {
+	sizes := map[string]int64{}
+	metadataObjects := []string{}
+
+	err := client.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(client.Bucket),
+		Prefix: aws.String(client.Prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if strings.HasSuffix(key, metadataSuffix) {
+				metadataObjects = append(metadataObjects, key)
+				continue
+			}
+			sizes[key] = aws.Int64Value(object.Size)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stored := []Stored{}
+	for _, metadataObject := range metadataObjects {
+		object := strings.TrimSuffix(metadataObject, metadataSuffix)
+		size, ok := sizes[object]
+		if !ok {
+			continue
+		}
+
+		// the metadata may be removed after it's listed, ex. by the lifecycle
+		// rules, so the unreadable one is skipped
+		output, err := client.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(client.Bucket),
+			Key:    aws.String(metadataObject),
+		})
+		if err != nil {
+			caddy.Log().Named("backend:s3").Warn(fmt.Sprintf("skip loading %s: %s", metadataObject, err.Error()))
+			continue
+		}
+
+		metadata, err := io.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			caddy.Log().Named("backend:s3").Warn(fmt.Sprintf("skip loading %s: %s", metadataObject, err.Error()))
+			continue
+		}
+
+		backend := &S3Backend{
+			client:  client,
+			object:  object,
+			length:  int(size),
+			started: true,
+			done:    make(chan error, 1),
+		}
+		backend.done <- nil
+
+		stored = append(stored, Stored{Backend: backend, Metadata: metadata})
+	}
+
+	return stored, nil
+}
+
+// start starts the upload reading the content from a pipe
+func (b *S3Backend) start() {
+	if b.started {
+		return
+	}
+
+	reader, writer := io.Pipe()
+	b.started = true
+	b.writer = writer
+	b.done = make(chan error, 1)
+
+	go func() {
+		_, err := b.client.Uploader.UploadWithContext(context.Background(), &s3manager.UploadInput{
+			Bucket:  aws.String(b.client.Bucket),
+			Key:     aws.String(b.object),
+			Body:    reader,
+			Expires: aws.Time(b.expiration),
+		})
+		reader.CloseWithError(err)
+		b.done <- err
+	}()
+}
+
+// wait waits the upload to be finished and reports its error
+func (b *S3Backend) wait() error {
+	if b.done != nil {
+		b.err = <-b.done
+		b.done = nil
+	}
+	return b.err
+}
+
+// Write writes the response content to the upload
+func (b *S3Backend) Write(p []byte) (n int, err error) {
+	b.lock.Lock()
+	b.start()
+	writer := b.writer
+	b.lock.Unlock()
+
+	n, err = writer.Write(p)
+
+	// the length is read by the readers in the other goroutines
+	b.lock.Lock()
+	b.length += n
+	b.lock.Unlock()
+	return n, err
+}
+
+// Flush do nothing here
+func (b *S3Backend) Flush() error {
+	return nil
+}
+
+// Length return the cache content's length
+func (b *S3Backend) Length() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.length
+}
+
+// Close completes the upload
+func (b *S3Backend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.start()
+	b.writer.Close()
+	return b.wait()
+}
+
+// Clean performs the purge storage. The upload not completed is aborted.
+func (b *S3Backend) Clean() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.started {
+		return nil
+	}
+
+	if b.writer != nil {
+		b.writer.CloseWithError(errS3Cleaned)
+	}
+	b.wait()
+
+	for _, object := range []string{b.object, b.object + metadataSuffix} {
+		_, err := b.client.Client.DeleteObjectWithContext(context.Background(), &s3.DeleteObjectInput{
+			Bucket: aws.String(b.client.Bucket),
+			Key:    aws.String(object),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SaveMetadata keeps the metadata in the object next to the content
+func (b *S3Backend) SaveMetadata(metadata []byte) error {
+	_, err := b.client.Client.PutObjectWithContext(context.Background(), &s3.PutObjectInput{
+		Bucket:  aws.String(b.client.Bucket),
+		Key:     aws.String(b.object + metadataSuffix),
+		Body:    aws.ReadSeekCloser(strings.NewReader(string(metadata))),
+		Expires: aws.Time(b.expiration),
+	})
+	return err
+}
+
+// GetReader return a reader getting the content in ranges
+func (b *S3Backend) GetReader() (io.ReadCloser, error) {
+	return b.GetSeekableReader()
+}
+
+// GetSeekableReader return a seekable reader getting the content in ranges
+// so only the requested part of the content is downloaded.
+func (b *S3Backend) GetSeekableReader() (io.ReadSeekCloser, error) {
+	return &S3Reader{
+		client: b.client,
+		object: b.object,
+		size:   int64(b.Length()),
+	}, nil
+}
+
+// S3Reader reads the content of an object with the ranged GETs
+type S3Reader struct {
+	client *S3Client
+	object string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read reads the content from the range being got. The next range is got
+// when the previous one is read.
+func (r *S3Reader) Read(p []byte) (n int, err error) {
+	for {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+
+		if r.body == nil {
+			end := r.offset + r.client.RangeSize
+			if end > r.size {
+				end = r.size
+			}
+
+			output, err := r.client.Client.GetObjectWithContext(context.Background(), &s3.GetObjectInput{
+				Bucket: aws.String(r.client.Bucket),
+				Key:    aws.String(r.object),
+				Range:  aws.String(fmt.Sprintf("bytes=%d-%d", r.offset, end-1)),
+			})
+			if err != nil {
+				return 0, err
+			}
+			r.body = output.Body
+		}
+
+		n, err = r.body.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			r.body.Close()
+			r.body = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Seek moves the offset. The range is got from the offset in the next read.
+func (r *S3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+// Close closes the range being got
+func (r *S3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+var (
+	_ Persister         = (*S3Backend)(nil)
+	_ io.ReadSeekCloser = (*S3Reader)(nil)
+)
+
+const (
+	defaultS3RangeSize = 8 << 20 // 8 MB
+	keyBucket          = "bucket"
+	keyRegion          = "region"
+	keyEndpoint        = "endpoint"
+	keyAccessKeyID     = "access_key_id"
+	keySecretKey       = "secret_access_key"
+	keyPrefix          = "prefix"
+	keyPathStyle       = "force_path_style"
+	keyPartSize        = "part_size"
+	keyRangeSize       = "range_size"
+)
+
+func init() {
+	caddy.RegisterModule(S3Storage{})
+}
+
+// S3Storage keeps the contents and their metadata in an S3-compatible
+// bucket. Each node should have its own prefix in the bucket. The
+// credentials are taken from the environment when they're not set.
+type S3Storage struct {
+	Bucket          string `json:"bucket,omitempty"`
+	Region          string `json:"region,omitempty"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	Prefix          string `json:"prefix,omitempty"`
+	ForcePathStyle  bool   `json:"force_path_style,omitempty"`
+	PartSize        int64  `json:"part_size,omitempty"`
+	RangeSize       int64  `json:"range_size,omitempty"`
+
+	client *S3Client
+}
+
+// CaddyModule returns the Caddy module information
+func (S3Storage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  StorageNamespace + ".s3",
+		New: func() caddy.Module { return new(S3Storage) },
+	}
+}
+
+// Provision sets up the client of the bucket
+func (s *S3Storage) Provision(ctx caddy.Context) error {
+	if s.Bucket == "" {
+		return errors.New("the bucket of the s3 storage is not set")
+	}
+	if s.PartSize == 0 {
+		s.PartSize = s3manager.DefaultUploadPartSize
+	}
+	if s.RangeSize == 0 {
+		s.RangeSize = defaultS3RangeSize
+	}
+
+	config := aws.NewConfig().WithS3ForcePathStyle(s.ForcePathStyle)
+	if s.Region != "" {
+		config = config.WithRegion(s.Region)
+	}
+	if s.Endpoint != "" {
+		config = config.WithEndpoint(s.Endpoint)
+	}
+	if s.AccessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(s.AccessKeyID, s.SecretAccessKey, ""))
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return err
+	}
+
+	client := s3.New(sess)
+	s.client = &S3Client{
+		Client: client,
+		Uploader: s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+			u.PartSize = s.PartSize
+		}),
+		Bucket:    s.Bucket,
+		Prefix:    s.Prefix,
+		RangeSize: s.RangeSize,
+	}
+
+	return nil
+}
+
+// NewBackend creates a backend keeping the content in the bucket
+func (s *S3Storage) NewBackend(ctx context.Context, key string, expiration time.Time) (Backend, error) {
+	return NewS3Backend(s.client, key, expiration)
+}
+
+// Load loads the contents kept under the prefix
+func (s *S3Storage) Load(ctx context.Context) ([]Stored, error) {
+	return LoadS3Backends(ctx, s.client)
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into the s3 storage
+//
+//	storage s3 {
+//	  bucket cache
+//	  region us-east-1
+//	  endpoint http://localhost:9000
+//	  access_key_id minio
+//	  secret_access_key minio123
+//	  prefix edge/
+//	  force_path_style
+//	  part_size 5242880
+//	  range_size 8388608
+//	}
+func (s *S3Storage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			parameter := d.Val()
+			args := d.RemainingArgs()
+
+			if parameter == keyPathStyle {
+				if len(args) != 0 {
+					return d.ArgErr()
+				}
+				s.ForcePathStyle = true
+				continue
+			}
+
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+
+			switch parameter {
+			case keyBucket:
+				s.Bucket = args[0]
+
+			case keyRegion:
+				s.Region = args[0]
+
+			case keyEndpoint:
+				s.Endpoint = args[0]
+
+			case keyAccessKeyID:
+				s.AccessKeyID = args[0]
+
+			case keySecretKey:
+				s.SecretAccessKey = args[0]
+
+			case keyPrefix:
+				s.Prefix = args[0]
+
+			case keyPartSize:
+				size, err := strconv.ParseInt(args[0], 10, 64)
+				if err != nil || size < s3manager.MinUploadPartSize {
+					return d.Errf("invalid %s: %s, it should be at least %d bytes", keyPartSize, args[0], s3manager.MinUploadPartSize)
+				}
+				s.PartSize = size
+
+			case keyRangeSize:
+				size, err := strconv.ParseInt(args[0], 10, 64)
+				if err != nil || size <= 0 {
+					return d.Errf("invalid %s: %s", keyRangeSize, args[0])
+				}
+				s.RangeSize = size
+
+			default:
+				return d.Errf("unrecognized subdirective %s", parameter)
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ Storage               = (*S3Storage)(nil)
+	_ Loader                = (*S3Storage)(nil)
+	_ caddy.Provisioner     = (*S3Storage)(nil)
+	_ caddyfile.Unmarshaler = (*S3Storage)(nil)
+)
@@ -0,0 +1,262 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeS3 serves the part of the S3 api used by the backend with the path
+// style requests
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	parts   map[string]map[int][]byte
+	uploads int
+	ranges  []string
+	// the objects listed but failed to be got
+	unreadable map[string]bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, parts: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// the path is /bucket/key
+	key := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[1:]
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && (len(key) == 0 || key[0] == ""):
+		f.list(w, query.Get("prefix"))
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.uploads++
+		uploadID := strconv.Itoa(f.uploads)
+		f.parts[uploadID] = map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, uploadID)
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.parts[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", strconv.Quote(query.Get("partNumber")))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.parts[query.Get("uploadId")]
+		numbers := []int{}
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+
+		content := []byte{}
+		for _, number := range numbers {
+			content = append(content, parts[number]...)
+		}
+		f.objects[key[0]] = content
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>`, key[0])
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.parts, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		f.objects[key[0]] = body
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key[0])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet:
+		f.get(w, r, key[0])
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string
+		Size int
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}{}
+
+	for key, object := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: len(object)})
+		}
+	}
+
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := f.objects[key]
+	if !ok || f.unreadable[key] {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+		return
+	}
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		w.Write(object)
+		return
+	}
+
+	f.ranges = append(f.ranges, rangeHeader)
+	var start, end int
+	fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(object[start : end+1])
+}
+
+type S3BackendTestSuite struct {
+	suite.Suite
+	fake    *fakeS3
+	server  *httptest.Server
+	storage *S3Storage
+}
+
+func (suite *S3BackendTestSuite) SetupTest() {
+	suite.fake = newFakeS3()
+	suite.server = httptest.NewServer(suite.fake)
+	suite.storage = &S3Storage{
+		Bucket:          "cache",
+		Region:          "us-east-1",
+		Endpoint:        suite.server.URL,
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+		Prefix:          "edge/",
+		ForcePathStyle:  true,
+		RangeSize:       4,
+	}
+	suite.Require().Nil(suite.storage.Provision(caddy.Context{}))
+}
+
+func (suite *S3BackendTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *S3BackendTestSuite) store(key string, content []byte) Backend {
+	backend, err := suite.storage.NewBackend(context.Background(), key, time.Now().Add(time.Hour))
+	suite.Require().Nil(err)
+	_, err = backend.Write(content)
+	suite.Require().Nil(err)
+	suite.Require().Nil(backend.Close())
+	suite.Require().Nil(backend.(Persister).SaveMetadata([]byte(`{"key": "` + key + `"}`)))
+	return backend
+}
+
+func (suite *S3BackendTestSuite) TestReadInRanges() {
+	backend := suite.store("GET /hello", []byte("hello world"))
+	suite.Equal(11, backend.Length())
+
+	reader, err := backend.GetReader()
+	suite.Nil(err)
+	content, err := io.ReadAll(reader)
+	suite.Nil(err)
+	reader.Close()
+	suite.Equal("hello world", string(content))
+	suite.Equal([]string{"bytes=0-3", "bytes=4-7", "bytes=8-10"}, suite.fake.ranges)
+
+	suite.fake.ranges = nil
+	seeker, err := backend.GetSeekableReader()
+	suite.Nil(err)
+	seeker.Seek(6, io.SeekStart)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(seeker, buf)
+	suite.Nil(err)
+	seeker.Close()
+	suite.Equal("wor", string(buf))
+	suite.Equal([]string{"bytes=6-9"}, suite.fake.ranges, "only the requested part should be got")
+}
+
+func (suite *S3BackendTestSuite) TestMultipartUpload() {
+	suite.storage.PartSize = 5 << 20
+	suite.Require().Nil(suite.storage.Provision(caddy.Context{}))
+
+	content := bytes.Repeat([]byte("a"), 6<<20)
+	backend := suite.store("GET /large", content)
+
+	suite.Equal(1, suite.fake.uploads)
+	object := backend.(*S3Backend).object
+	suite.Equal(content, suite.fake.objects[object])
+}
+
+func (suite *S3BackendTestSuite) TestObjectKeys() {
+	previous := suite.store("GET /key", []byte("previous"))
+	current := suite.store("GET /key", []byte("current"))
+
+	for _, backend := range []Backend{previous, current} {
+		object := backend.(*S3Backend).object
+		suite.True(strings.HasPrefix(object, "edge/"))
+		suite.Contains(suite.fake.objects, object+metadataSuffix)
+	}
+
+	suite.Nil(previous.Clean())
+	suite.Len(suite.fake.objects, 2, "cleaning the previous content should not remove the current one")
+}
+
+func (suite *S3BackendTestSuite) TestCleanBeforeClose() {
+	backend, _ := suite.storage.NewBackend(context.Background(), "GET /cleaned", time.Now().Add(time.Hour))
+	backend.Write([]byte("content"))
+	suite.Nil(backend.Clean())
+	suite.Empty(suite.fake.objects)
+}
+
+func (suite *S3BackendTestSuite) TestLoad() {
+	suite.store("GET /kept", []byte("content"))
+	suite.fake.objects["edge/uploading"] = []byte("content")
+	suite.fake.objects["other/ignored.meta"] = []byte("{}")
+
+	stored, err := suite.storage.Load(context.Background())
+	suite.Nil(err)
+	suite.Len(stored, 1)
+	suite.Equal(`{"key": "GET /kept"}`, string(stored[0].Metadata))
+	suite.Equal(7, stored[0].Backend.Length())
+
+	reader, _ := stored[0].Backend.GetReader()
+	content, _ := io.ReadAll(reader)
+	suite.Equal("content", string(content))
+
+	suite.Contains(suite.fake.objects, "edge/uploading", "the content may be written by the other nodes")
+}
+
+func (suite *S3BackendTestSuite) TestLoadSkipUnreadable() {
+	suite.store("GET /kept", []byte("content"))
+	unreadable := suite.store("GET /unreadable", []byte("content")).(*S3Backend).object
+	suite.fake.unreadable = map[string]bool{unreadable + metadataSuffix: true}
+
+	stored, err := suite.storage.Load(context.Background())
+	suite.Nil(err)
+	suite.Len(stored, 1, "the unreadable content should be skipped")
+	suite.Equal(`{"key": "GET /kept"}`, string(stored[0].Metadata))
+}
+
+func TestS3BackendTestSuite(t *testing.T) {
+	suite.Run(t, new(S3BackendTestSuite))
+}
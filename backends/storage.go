@@ -0,0 +1,36 @@
+package backends
+
+import (
+	"context"
+	"time"
+)
+
+// StorageNamespace is the caddy module namespace of the storages. A custom
+// storage can be shipped as a caddy module in this namespace.
+const StorageNamespace = "http.handlers.http_cache.storage"
+
+// Storage creates the backends keeping the cached contents. The resources
+// it needs are set up and released by implementing caddy.Provisioner and
+// caddy.CleanerUpper.
+type Storage interface {
+	NewBackend(ctx context.Context, key string, expiration time.Time) (Backend, error)
+}
+
+// Loader is implemented by the storages which keep the contents across
+// restarts so the cache index can be rebuilt from them.
+type Loader interface {
+	Load(ctx context.Context) ([]Stored, error)
+}
+
+// DiskStorage is implemented by the storages which keep the contents on the
+// local disk. The disk limits of the cache only apply to them.
+type DiskStorage interface {
+	OnDisk() bool
+}
+
+// Peering is implemented by the storages shared with the peers when the
+// cache is distributed. The handler starts the peering before the
+// distributed module is loaded.
+type Peering interface {
+	ServePeers() error
+}
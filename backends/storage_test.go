@@ -0,0 +1,138 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/suite"
+)
+
+type StorageTestSuite struct {
+	suite.Suite
+}
+
+func (suite *StorageTestSuite) TestRegisteredModules() {
+	for _, name := range []string{"file", "in_memory", "redis", "bolt", "s3", "tiered"} {
+		mod, err := caddy.GetModule(StorageNamespace + "." + name)
+		suite.Nil(err)
+		suite.Implements((*Storage)(nil), mod.New())
+	}
+}
+
+func (suite *StorageTestSuite) TestFileStorage() {
+	storage := &FileStorage{Path: suite.T().TempDir()}
+	suite.Nil(storage.Provision(caddy.Context{}))
+
+	backend, err := storage.NewBackend(context.Background(), "key", time.Now().Add(time.Minute))
+	suite.Nil(err)
+	backend.Write([]byte("hello"))
+	suite.Nil(backend.Close())
+	suite.Nil(backend.(Persister).SaveMetadata([]byte("{}")))
+
+	stored, err := storage.Load(context.Background())
+	suite.Nil(err)
+	suite.Len(stored, 1)
+	suite.Equal([]byte("{}"), stored[0].Metadata)
+}
+
+func (suite *StorageTestSuite) TestDefaultFilePath() {
+	storage := &FileStorage{}
+	suite.Nil(storage.Provision(caddy.Context{}))
+	suite.Equal(defaultFilePath, storage.Path)
+}
+
+func (suite *StorageTestSuite) TestInMemoryStorage() {
+	storage := &InMemoryStorage{PeerBasePath: "/_peers"}
+	suite.Nil(storage.Provision(caddy.Context{}))
+	suite.Equal(DefaultPeerListenAddr, storage.PeerListenAddr)
+	suite.Equal("/_peers/", storage.PeerBasePath)
+	suite.Nil(storage.Cleanup(), "nothing to release when the peers are not served")
+}
+
+func (suite *StorageTestSuite) TestUnmarshalCaddyfile() {
+	file := &FileStorage{}
+	err := file.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	file {
+		path /tmp/storage
+	}`))
+	suite.Nil(err)
+	suite.Equal("/tmp/storage", file.Path)
+
+	memory := &InMemoryStorage{}
+	err = memory.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	in_memory {
+		max_memory_size 1024
+	}`))
+	suite.Nil(err)
+	suite.Equal(1024, memory.MaxMemorySize)
+
+	err = memory.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	in_memory {
+		peer_listen_addr :7070
+		peer_base_path /_cache_peers/
+	}`))
+	suite.Nil(err)
+	suite.Equal(":7070", memory.PeerListenAddr)
+	suite.Equal("/_cache_peers/", memory.PeerBasePath)
+
+	err = memory.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	in_memory {
+		peer_listen_addr 7070
+	}`))
+	suite.Error(err, "it should be an address with a port")
+
+	err = memory.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	in_memory {
+		max_memory_size 1GB
+	}`))
+	suite.Error(err, "it should be a number of bytes")
+
+	redis := &RedisStorage{}
+	err = redis.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	redis {
+		addr redis:6379
+		db 2
+		password secret
+	}`))
+	suite.Nil(err)
+	suite.Equal(&RedisStorage{Addr: "redis:6379", DB: 2, Password: "secret"}, redis)
+
+	err = redis.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	redis {
+		host redis
+	}`))
+	suite.Error(err, "unrecognized subdirective")
+
+	s3 := &S3Storage{}
+	err = s3.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	s3 {
+		bucket cache
+		endpoint http://localhost:9000
+		prefix edge/
+		force_path_style
+		part_size 5242880
+	}`))
+	suite.Nil(err)
+	suite.Equal(&S3Storage{
+		Bucket:         "cache",
+		Endpoint:       "http://localhost:9000",
+		Prefix:         "edge/",
+		ForcePathStyle: true,
+		PartSize:       5242880,
+	}, s3)
+
+	err = s3.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	s3 {
+		part_size 1024
+	}`))
+	suite.Error(err, "the part size should be at least 5MB")
+
+	suite.Error((&S3Storage{}).Provision(caddy.Context{}), "the bucket should be set")
+}
+
+func TestStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(StorageTestSuite))
+}
@@ -0,0 +1,421 @@
+package backends
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// memoryLRU keeps the contents in memory within the max size. The least
+// recently used ones are evicted when it's exceeded.
+type memoryLRU struct {
+	lock     sync.Mutex
+	maxSize  int
+	size     int
+	order    *list.List
+	contents map[*TieredBackend]*list.Element
+}
+
+type lruItem struct {
+	backend *TieredBackend
+	content []byte
+}
+
+func newMemoryLRU(maxSize int) *memoryLRU {
+	return &memoryLRU{
+		maxSize:  maxSize,
+		order:    list.New(),
+		contents: map[*TieredBackend]*list.Element{},
+	}
+}
+
+// get returns the content of the backend and marks it recently used
+func (m *memoryLRU) get(backend *TieredBackend) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	element, ok := m.contents[backend]
+	if !ok {
+		return nil, false
+	}
+
+	m.order.MoveToFront(element)
+	return element.Value.(*lruItem).content, true
+}
+
+// add keeps the content of the backend and evicts the least recently used
+// ones until the size is within the max size
+func (m *memoryLRU) add(backend *TieredBackend, content []byte) {
+	if len(content) > m.maxSize {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.contents[backend]; ok || backend.cleaned {
+		return
+	}
+
+	m.contents[backend] = m.order.PushFront(&lruItem{backend: backend, content: content})
+	m.size += len(content)
+
+	for m.size > m.maxSize {
+		m.removeElement(m.order.Back())
+	}
+}
+
+// remove drops the content of the backend. The backend is not kept again
+// so the content promoted while it's being cleaned doesn't stay.
+func (m *memoryLRU) remove(backend *TieredBackend) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	backend.cleaned = true
+
+	if element, ok := m.contents[backend]; ok {
+		m.removeElement(element)
+	}
+}
+
+func (m *memoryLRU) removeElement(element *list.Element) {
+	item := element.Value.(*lruItem)
+	m.order.Remove(element)
+	delete(m.contents, item.backend)
+	m.size -= len(item.content)
+}
+
+// total returns the size of the contents kept
+func (m *memoryLRU) total() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.size
+}
+
+// TieredBackend keeps the content in the second tier backend and the small
+// one in the memory as well. The content read from the second tier is
+// promoted to the memory.
+type TieredBackend struct {
+	l1            *memoryLRU
+	l2            Backend
+	maxObjectSize int
+
+	buffer    bytes.Buffer
+	oversized bool
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	cleaned   bool // guarded by the lock of the memory
+}
+
+// newTieredBackend wraps the second tier backend with the memory
+func newTieredBackend(l1 *memoryLRU, l2 Backend, maxObjectSize int) *TieredBackend {
+	return &TieredBackend{
+		l1:            l1,
+		l2:            l2,
+		maxObjectSize: maxObjectSize,
+		done:          make(chan struct{}),
+	}
+}
+
+// restoreTieredBackend wraps the complete content restored in the second tier
+func restoreTieredBackend(l1 *memoryLRU, l2 Backend, maxObjectSize int) *TieredBackend {
+	t := newTieredBackend(l1, l2, maxObjectSize)
+	t.closeOnce.Do(func() { close(t.done) })
+	return t
+}
+
+// Write writes the content to the second tier and buffers the small one
+func (t *TieredBackend) Write(p []byte) (n int, err error) {
+	n, err = t.l2.Write(p)
+
+	if !t.oversized {
+		if t.buffer.Len()+n > t.maxObjectSize {
+			t.oversized = true
+			t.buffer = bytes.Buffer{}
+		} else {
+			t.buffer.Write(p[:n])
+		}
+	}
+
+	return n, err
+}
+
+// Flush flushes the second tier
+func (t *TieredBackend) Flush() error {
+	return t.l2.Flush()
+}
+
+// Length return the cache content's length
+func (t *TieredBackend) Length() int {
+	return t.l2.Length()
+}
+
+// Close closes the second tier and keeps the small content in the memory.
+// Only the first call takes effect.
+func (t *TieredBackend) Close() error {
+	t.closeOnce.Do(func() {
+		defer close(t.done)
+		t.closeErr = t.close()
+	})
+	return t.closeErr
+}
+
+func (t *TieredBackend) close() error {
+	if err := t.l2.Close(); err != nil {
+		return err
+	}
+
+	if !t.oversized {
+		t.l1.add(t, t.buffer.Bytes())
+	}
+	t.buffer = bytes.Buffer{}
+	return nil
+}
+
+// Clean removes the content from the memory and the second tier
+func (t *TieredBackend) Clean() error {
+	t.l1.remove(t)
+	return t.l2.Clean()
+}
+
+// Refresh extends the time to live of the content in the second tier
+func (t *TieredBackend) Refresh(expiration time.Time) error {
+	if refresher, ok := t.l2.(Refresher); ok {
+		return refresher.Refresh(expiration)
+	}
+	return nil
+}
+
+// SaveMetadata keeps the metadata in the second tier
+func (t *TieredBackend) SaveMetadata(metadata []byte) error {
+	if persister, ok := t.l2.(Persister); ok {
+		return persister.SaveMetadata(metadata)
+	}
+	return nil
+}
+
+// content returns the content in the memory. The small content not in the
+// memory is read from the second tier and promoted.
+func (t *TieredBackend) content() ([]byte, bool, error) {
+	if content, ok := t.l1.get(t); ok {
+		return content, true, nil
+	}
+
+	if t.Length() > t.maxObjectSize {
+		return nil, false, nil
+	}
+
+	reader, err := t.l2.GetReader()
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.l1.add(t, content)
+	return content, true, nil
+}
+
+// GetReader return a reader from the memory or the second tier
+func (t *TieredBackend) GetReader() (io.ReadCloser, error) {
+	return t.GetSeekableReader()
+}
+
+// GetSeekableReader return a seekable reader from the memory or the second tier
+func (t *TieredBackend) GetSeekableReader() (io.ReadSeekCloser, error) {
+	content, ok, err := t.content()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nopReadSeekCloser{bytes.NewReader(content)}, nil
+	}
+
+	return t.l2.GetSeekableReader()
+}
+
+// GetStreamReader follows the content being written in the second tier.
+// It waits the content to be complete when the second tier can't do it.
+func (t *TieredBackend) GetStreamReader() (io.ReadCloser, error) {
+	if streamer, ok := t.l2.(Streamer); ok {
+		return streamer.GetStreamReader()
+	}
+
+	<-t.done
+	return t.GetReader()
+}
+
+var (
+	_ Backend   = (*TieredBackend)(nil)
+	_ Refresher = (*TieredBackend)(nil)
+	_ Persister = (*TieredBackend)(nil)
+	_ Streamer  = (*TieredBackend)(nil)
+)
+
+const (
+	defaultL1MemorySize = 256 << 20 // 256 MB
+	defaultL1ObjectSize = 1 << 20   // 1 MB
+	keyMaxObjectSize    = "max_object_size"
+	keyL2               = "l2"
+)
+
+func init() {
+	caddy.RegisterModule(TieredStorage{})
+}
+
+// TieredStorage keeps the small contents in a size-bounded memory as the
+// first tier and all the contents in the second tier storage.
+type TieredStorage struct {
+	MaxMemorySize int             `json:"max_memory_size,omitempty"`
+	MaxObjectSize int             `json:"max_object_size,omitempty"`
+	L2Raw         json.RawMessage `json:"l2,omitempty" caddy:"namespace=http.handlers.http_cache.storage inline_key=backend"`
+
+	l1 *memoryLRU
+	l2 Storage
+}
+
+// CaddyModule returns the Caddy module information
+func (TieredStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  StorageNamespace + ".tiered",
+		New: func() caddy.Module { return new(TieredStorage) },
+	}
+}
+
+// Provision sets up the memory and loads the second tier storage. The file
+// storage is the second tier when it's not set.
+func (s *TieredStorage) Provision(ctx caddy.Context) error {
+	if s.MaxMemorySize == 0 {
+		s.MaxMemorySize = defaultL1MemorySize
+	}
+	if s.MaxObjectSize == 0 {
+		s.MaxObjectSize = defaultL1ObjectSize
+	}
+	if s.L2Raw == nil {
+		s.L2Raw = caddyconfig.JSONModuleObject(&FileStorage{}, "backend", "file", nil)
+	}
+
+	val, err := ctx.LoadModule(s, "L2Raw") // this will call provision
+	if err != nil {
+		return fmt.Errorf("loading l2 storage module: %s", err.Error())
+	}
+
+	s.l1 = newMemoryLRU(s.MaxMemorySize)
+	s.l2 = val.(Storage)
+	return nil
+}
+
+// NewBackend creates a backend keeping the content in both tiers
+func (s *TieredStorage) NewBackend(ctx context.Context, key string, expiration time.Time) (Backend, error) {
+	l2, err := s.l2.NewBackend(ctx, key, expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTieredBackend(s.l1, l2, s.MaxObjectSize), nil
+}
+
+// OnDisk reports whether the second tier keeps the contents on the local disk
+func (s *TieredStorage) OnDisk() bool {
+	disk, ok := s.l2.(DiskStorage)
+	return ok && disk.OnDisk()
+}
+
+// Load loads the contents kept in the second tier. They're promoted to the
+// memory when they're read.
+func (s *TieredStorage) Load(ctx context.Context) ([]Stored, error) {
+	loader, ok := s.l2.(Loader)
+	if !ok {
+		return nil, nil
+	}
+
+	stored, err := loader.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range stored {
+		stored[i].Backend = restoreTieredBackend(s.l1, stored[i].Backend, s.MaxObjectSize)
+	}
+
+	return stored, nil
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into the tiered storage
+//
+//	storage tiered {
+//	  max_memory_size 268435456
+//	  max_object_size 1048576
+//	  l2 file {
+//	    path /tmp/caddy_cache
+//	  }
+//	}
+func (s *TieredStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			parameter := d.Val()
+			args := d.RemainingArgs()
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+
+			switch parameter {
+			case keyMaxMemorySize, keyMaxObjectSize:
+				size, err := strconv.Atoi(args[0])
+				if err != nil || size <= 0 {
+					return d.Errf("invalid %s: %s", parameter, args[0])
+				}
+				if parameter == keyMaxMemorySize {
+					s.MaxMemorySize = size
+				} else {
+					s.MaxObjectSize = size
+				}
+
+			case keyL2:
+				name := args[0]
+				mod, err := caddy.GetModule(StorageNamespace + "." + name)
+				if err != nil {
+					return d.Errf("getting storage module '%s': '%v'", name, err)
+				}
+
+				unm, ok := mod.New().(caddyfile.Unmarshaler)
+				if !ok {
+					return d.Errf("storage module '%s' is not a Caddyfile unmarshaler", name)
+				}
+
+				if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+				s.L2Raw = caddyconfig.JSONModuleObject(unm, "backend", name, nil)
+
+			default:
+				return d.Errf("unrecognized subdirective %s", parameter)
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ Storage               = (*TieredStorage)(nil)
+	_ Loader                = (*TieredStorage)(nil)
+	_ DiskStorage           = (*TieredStorage)(nil)
+	_ caddy.Provisioner     = (*TieredStorage)(nil)
+	_ caddyfile.Unmarshaler = (*TieredStorage)(nil)
+)
@@ -0,0 +1,145 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/suite"
+)
+
+type TieredBackendTestSuite struct {
+	suite.Suite
+	storage *TieredStorage
+	cancel  context.CancelFunc
+}
+
+func (suite *TieredBackendTestSuite) SetupTest() {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	suite.cancel = cancel
+	suite.storage = &TieredStorage{
+		MaxMemorySize: 12,
+		MaxObjectSize: 8,
+		L2Raw:         []byte(`{"backend": "file", "path": "` + suite.T().TempDir() + `"}`),
+	}
+	suite.Require().Nil(suite.storage.Provision(ctx))
+}
+
+func (suite *TieredBackendTestSuite) TearDownTest() {
+	suite.cancel()
+}
+
+func (suite *TieredBackendTestSuite) store(content string) *TieredBackend {
+	backend, err := suite.storage.NewBackend(context.Background(), "key", time.Now().Add(time.Hour))
+	suite.Require().Nil(err)
+	backend.Write([]byte(content))
+	suite.Require().Nil(backend.Close())
+	return backend.(*TieredBackend)
+}
+
+func (suite *TieredBackendTestSuite) read(backend Backend) string {
+	reader, err := backend.GetReader()
+	suite.Require().Nil(err)
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	suite.Require().Nil(err)
+	return string(content)
+}
+
+// removeL2 removes the file of the second tier so only the memory is readable
+func (suite *TieredBackendTestSuite) removeL2(backend *TieredBackend) {
+	suite.Nil(os.Remove(backend.l2.(*FileBackend).file.Name()))
+}
+
+func (suite *TieredBackendTestSuite) TestServeFromMemory() {
+	backend := suite.store("small")
+	suite.Equal(5, suite.storage.l1.total())
+
+	suite.removeL2(backend)
+	suite.Equal("small", suite.read(backend))
+}
+
+func (suite *TieredBackendTestSuite) TestKeepLargeInL2() {
+	backend := suite.store("larger than the max object size")
+	suite.Equal(0, suite.storage.l1.total())
+	suite.Equal("larger than the max object size", suite.read(backend))
+	suite.Equal(0, suite.storage.l1.total(), "the large content should not be promoted")
+}
+
+func (suite *TieredBackendTestSuite) TestEvictAndPromote() {
+	first := suite.store("first")
+	suite.store("second")
+	suite.store("third")
+	suite.Equal(11, suite.storage.l1.total(), "the least recently used one should be evicted")
+
+	_, ok := suite.storage.l1.get(first)
+	suite.False(ok)
+
+	suite.Equal("first", suite.read(first))
+	_, ok = suite.storage.l1.get(first)
+	suite.True(ok, "the content read from the second tier should be promoted")
+}
+
+func (suite *TieredBackendTestSuite) TestClean() {
+	backend := suite.store("small")
+	suite.Nil(backend.Clean())
+	suite.Equal(0, suite.storage.l1.total())
+
+	suite.storage.l1.add(backend, []byte("small"))
+	suite.Equal(0, suite.storage.l1.total(), "the cleaned content should not be kept")
+}
+
+func (suite *TieredBackendTestSuite) TestLoad() {
+	backend := suite.store("small")
+	suite.Nil(backend.SaveMetadata([]byte("{}")))
+
+	stored, err := suite.storage.Load(context.Background())
+	suite.Nil(err)
+	suite.Len(stored, 1)
+
+	loaded := stored[0].Backend.(*TieredBackend)
+	_, ok := suite.storage.l1.get(loaded)
+	suite.False(ok)
+	suite.Equal("small", suite.read(loaded))
+	_, ok = suite.storage.l1.get(loaded)
+	suite.True(ok)
+}
+
+func (suite *TieredBackendTestSuite) TestCloseTwice() {
+	backend := suite.store("small")
+	suite.Nil(backend.Close(), "closing again should not panic")
+
+	suite.store("other").SaveMetadata([]byte("{}"))
+	backend.SaveMetadata([]byte("{}"))
+	stored, err := suite.storage.Load(context.Background())
+	suite.Nil(err)
+	suite.Len(stored, 2)
+
+	// every restored backend is closed on its own
+	for _, s := range stored {
+		suite.Nil(s.Backend.Close())
+		suite.Nil(s.Backend.Close())
+	}
+}
+
+func (suite *TieredBackendTestSuite) TestUnmarshalCaddyfile() {
+	storage := &TieredStorage{}
+	err := storage.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	tiered {
+		l2 file {
+			path /tmp/tiered
+		}
+		max_object_size 1024
+	}`))
+	suite.Nil(err)
+	suite.Equal(1024, storage.MaxObjectSize)
+	suite.JSONEq(`{"backend": "file", "path": "/tmp/tiered"}`, string(storage.L2Raw))
+}
+
+func TestTieredBackendTestSuite(t *testing.T) {
+	suite.Run(t, new(TieredBackendTestSuite))
+}
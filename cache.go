@@ -31,6 +31,9 @@ import (
 var (
 	entries     []map[string][]*Entry
 	entriesLock []*sync.RWMutex
+	tags        *tagIndex
+	disk        *diskUsage
+	expiry      *expiryScheduler
 	l           sync.RWMutex
 	keyBufPool  = sync.Pool{
 		New: func() interface{} {
@@ -39,6 +42,15 @@ var (
 	}
 )
 
+// headersNotToRefresh lists the headers which describe the stored body so
+// they should be kept when the entry is refreshed by a 304 response.
+var headersNotToRefresh = map[string]struct{}{
+	"Content-Length":    {},
+	"Content-Encoding":  {},
+	"Content-Range":     {},
+	"Transfer-Encoding": {},
+}
+
 // intend to mock for test
 var now = func() time.Time { return time.Now().UTC() }
 
@@ -225,11 +237,18 @@ func getCacheStatus(req *http.Request, response *Response, config *Config) (bool
 		return false, now()
 	}
 
-	reasonsNotToCache, expiration, _, _, err := judgeResponseShouldCacheOrNot(req, response.Code, response.snapHeader, false)
+	reasonsNotToCache, expiration, _, _, err := judgeResponseShouldCacheOrNot(req, response.Code, cacheControlHeaders(response.snapHeader, config), false)
 	if err != nil {
 		return false, time.Time{}
 	}
 
+	// the status with a configured ttl is cached even if it's not cacheable
+	// by default, ex. 302 or 503
+	ttl, hasStatusTTL := getStatusTTL(response.Code, config)
+	if hasStatusTTL {
+		reasonsNotToCache = withoutReason(reasonsNotToCache, cacheobject.ReasonResponseUncachableByDefault)
+	}
+
 	isPublic := len(reasonsNotToCache) == 0
 	if !isPublic {
 		return false, now().Add(config.LockTimeout)
@@ -247,19 +266,184 @@ func getCacheStatus(req *http.Request, response *Response, config *Config) (bool
 	}
 
 	if now().After(expiration.Add(-1 * time.Second)) {
-		expiration = now().Add(config.DefaultMaxAge)
+		if hasStatusTTL {
+			expiration = now().Add(ttl)
+		} else if lifetime, ok := heuristicFreshness(response.snapHeader, config); ok {
+			expiration = now().Add(lifetime)
+		} else {
+			expiration = now().Add(config.DefaultMaxAge)
+		}
 	}
 
 	return true, expiration
 }
 
-func matchVary(curReq *http.Request, entry *Entry) bool {
+// getStatusTTL returns the configured ttl of the status code. The exact
+// code takes precedence over its class, ex. 503 over 5xx.
+func getStatusTTL(code int, config *Config) (time.Duration, bool) {
+	if ttl, ok := config.StatusTTL[strconv.Itoa(code)]; ok {
+		return ttl, true
+	}
+
+	ttl, ok := config.StatusTTL[fmt.Sprintf("%dxx", code/100)]
+	return ttl, ok
+}
+
+func withoutReason(reasons []cacheobject.Reason, reason cacheobject.Reason) []cacheobject.Reason {
+	result := []cacheobject.Reason{}
+	for _, r := range reasons {
+		if r != reason {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// heuristicFreshness returns the freshness lifetime as a fraction of the time
+// since the response was last modified. It's only applied when the heuristic
+// mode is on and the response has no explicit expiration.
+// https://httpwg.org/specs/rfc7234.html#heuristic.freshness
+func heuristicFreshness(respHeaders http.Header, config *Config) (time.Duration, bool) {
+	if !config.HeuristicFreshness {
+		return 0, false
+	}
+
+	respHeaders = cacheControlHeaders(respHeaders, config)
+
+	respDir, err := cacheobject.ParseResponseCacheControl(respHeaders.Get("Cache-Control"))
+	if err != nil || respDir.MaxAge != -1 || respDir.SMaxAge != -1 || respHeaders.Get("Expires") != "" {
+		return 0, false
+	}
+
+	lastModified, err := http.ParseTime(respHeaders.Get("Last-Modified"))
+	if err != nil {
+		return 0, false
+	}
+
+	date, err := http.ParseTime(respHeaders.Get("Date"))
+	if err != nil {
+		date = now()
+	}
+
+	lifetime := time.Duration(float64(date.Sub(lastModified)) * config.HeuristicFraction)
+	if lifetime <= 0 {
+		return 0, false
+	}
+
+	if config.HeuristicMaxAge > 0 && lifetime > config.HeuristicMaxAge {
+		lifetime = config.HeuristicMaxAge
+	}
+
+	return lifetime, true
+}
+
+// getCacheTags returns the tags of the response in the configured header
+func getCacheTags(respHeaders http.Header, config *Config) []string {
+	if config.CacheTagHeader == "" {
+		return nil
+	}
+	return parseCacheTags(respHeaders.Get(config.CacheTagHeader))
+}
+
+func isHeuristic(respHeaders http.Header, config *Config) bool {
+	_, ok := heuristicFreshness(respHeaders, config)
+	return ok
+}
+
+// heuristicWarning returns the 113 warning which should be attached to the
+// response when its freshness is heuristic and it's older than 24 hours.
+// https://httpwg.org/specs/rfc7234.html#warn.113
+func (e *Entry) heuristicWarning() (string, bool) {
+	e.lock.RLock()
+	heuristic, header := e.heuristic, e.Response.snapHeader
+	e.lock.RUnlock()
+
+	if !heuristic {
+		return "", false
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil || now().Sub(date) <= 24*time.Hour {
+		return "", false
+	}
+
+	return `113 - "Heuristic Expiration"`, true
+}
+
+// getStaleWhileRevalidate returns the stale-while-revalidate window of the
+// response. The config's one is used when the response doesn't specify it.
+// https://httpwg.org/specs/rfc5861.html#n-the-stale-while-revalidate-cache-control-extension
+func getStaleWhileRevalidate(respHeaders http.Header, config *Config) time.Duration {
+	respHeaders = cacheControlHeaders(respHeaders, config)
+	respDir, err := cacheobject.ParseResponseCacheControl(respHeaders.Get("Cache-Control"))
+	if err == nil && respDir.StaleWhileRevalidate != -1 {
+		return time.Duration(respDir.StaleWhileRevalidate) * time.Second
+	}
+
+	return config.StaleWhileRevalidate
+}
+
+// getStaleIfError returns the stale-if-error window of the response which is
+// limited by the config's one. It's zero when the config's one is not set.
+// https://httpwg.org/specs/rfc5861.html#n-the-stale-if-error-cache-control-extension
+func getStaleIfError(respHeaders http.Header, config *Config) time.Duration {
+	if config.StaleIfError == 0 {
+		return 0
+	}
+
+	respHeaders = cacheControlHeaders(respHeaders, config)
+
+	respDir, err := cacheobject.ParseResponseCacheControl(respHeaders.Get("Cache-Control"))
+	if err != nil || respDir.StaleIfError == -1 {
+		return 0
+	}
+
+	return minDuration(time.Duration(respDir.StaleIfError)*time.Second, config.StaleIfError)
+}
+
+// getRequestStaleIfError returns the stale-if-error window the client accepts
+// which is limited by the config's one.
+func getRequestStaleIfError(r *http.Request, config *Config) time.Duration {
+	if config.StaleIfError == 0 || r == nil {
+		return 0
+	}
+
+	reqDir, err := cacheobject.ParseRequestCacheControl(r.Header.Get("Cache-Control"))
+	if err != nil {
+		return 0
+	}
+
+	// the request's stale-if-error is parsed as an extension by cacheobject
+	for _, ext := range reqDir.Extensions {
+		value := strings.TrimPrefix(ext, "stale-if-error=")
+		if value == ext {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return 0
+		}
+
+		return minDuration(time.Duration(seconds)*time.Second, config.StaleIfError)
+	}
+
+	return 0
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func matchVary(curReq *http.Request, entry *Entry, normalizeVary map[string][]string) bool {
 	// NOTE: https://httpwg.org/specs/rfc7231.html#header.vary
-	vary := entry.Response.HeaderMap.Get("Vary")
+	vary := entry.header().Get("Vary")
 
 	for _, searchedHeader := range strings.Split(vary, ",") {
-		searchedHeader = strings.TrimSpace(searchedHeader)
-		if curReq.Header.Get(searchedHeader) != entry.Request.Header.Get(searchedHeader) {
+		if varyValue(curReq, searchedHeader, normalizeVary) != varyValue(entry.Request, searchedHeader, normalizeVary) {
 			return false
 		}
 	}
@@ -268,14 +452,22 @@ func matchVary(curReq *http.Request, entry *Entry) bool {
 }
 
 // Entry consists of a cache key and one or more response corresponding to
-// the prior requests.
+// the prior requests. The lock guards the metadata updated by the
+// revalidation, the stored headers and the freshness, because they're read
+// by the other requests at the same time.
 // https://httpwg.org/specs/rfc7234.html#caching.overview
 type Entry struct {
-	isPublic   bool
-	expiration time.Time
-	key        string
-	Request    *http.Request
-	Response   *Response
+	lock                 sync.RWMutex
+	isPublic             bool
+	expiration           time.Time
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	heuristic            bool
+	responseTime         time.Time
+	tags                 []string
+	key                  string
+	Request              *http.Request
+	Response             *Response
 }
 
 // NewEntry creates a new Entry for the given request and response
@@ -284,11 +476,16 @@ func NewEntry(key string, request *http.Request, response *Response, config *Con
 	isPublic, expiration := getCacheStatus(request, response, config)
 
 	return &Entry{
-		isPublic:   isPublic,
-		key:        key,
-		expiration: expiration,
-		Request:    request,
-		Response:   response,
+		isPublic:             isPublic,
+		key:                  key,
+		expiration:           expiration,
+		staleWhileRevalidate: getStaleWhileRevalidate(response.snapHeader, config),
+		staleIfError:         getStaleIfError(response.snapHeader, config),
+		heuristic:            isPublic && isHeuristic(response.snapHeader, config),
+		responseTime:         now(),
+		tags:                 getCacheTags(response.snapHeader, config),
+		Request:              request,
+		Response:             response,
 	}
 }
 
@@ -297,6 +494,28 @@ func (e *Entry) Key() string {
 	return e.key
 }
 
+// header returns the stored headers. They're replaced instead of being
+// updated in place so the returned ones can be read without the lock.
+func (e *Entry) header() http.Header {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.Response.snapHeader
+}
+
+// freshUntil returns the time the entry expires
+func (e *Entry) freshUntil() time.Time {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.expiration
+}
+
+// cleanAt returns the time the entry is removed after it's expired
+func (e *Entry) cleanAt(config *Config) time.Time {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.expiration.Add(e.staleMaxAgeLocked(config))
+}
+
 // Clean purges the cache
 func (e *Entry) Clean() error {
 	return e.Response.Clean()
@@ -316,7 +535,8 @@ func (e *Entry) writePublicResponse(w http.ResponseWriter) error {
 	// https://golang.org/pkg/net/http/#ResponseWriter
 	length := w.Header().Get("Content-Length")
 
-	if length == "" {
+	// the length is unknown until the content being streamed is complete
+	if length == "" && e.Response.isBodyComplete() {
 		contentLength := strconv.Itoa(e.Response.body.Length())
 		if contentLength != "0" {
 			w.Header().Set("Content-Length", contentLength)
@@ -348,12 +568,169 @@ func (e *Entry) WriteBodyTo(w http.ResponseWriter) error {
 	return e.writePublicResponse(w)
 }
 
+// WriteRangeTo sends the byte ranges requested by the client from the completely
+// cached body. The single and multipart ranges, If-Range and the 416 response
+// are handled by http.ServeContent.
+func (e *Entry) WriteRangeTo(w http.ResponseWriter, r *http.Request) error {
+	reader, err := e.Response.GetSeekableReader()
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	// the length of the partial content is decided by http.ServeContent
+	w.Header().Del("Content-Length")
+
+	modtime, _ := http.ParseTime(e.header().Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, reader)
+	return nil
+}
+
+// hasValidators indicates the stored response carries a validator which
+// can be used to revalidate it against the upstream.
+func (e *Entry) hasValidators() bool {
+	header := e.header()
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// refresh updates the stored headers and the expiration with the 304 response
+// returned by the upstream when revalidating. It returns false when the entry
+// is no longer cacheable according to the updated headers.
+// https://httpwg.org/specs/rfc7234.html#freshening.responses
+func (e *Entry) refresh(notModified *Response, config *Config) bool {
+	// build a new header instead of updating the stored one in place because
+	// it may be read by the other requests at the same time.
+	header := e.header().Clone()
+	for k, values := range notModified.snapHeader {
+		if _, skip := headersNotToRefresh[http.CanonicalHeaderKey(k)]; skip {
+			continue
+		}
+		header[k] = values
+	}
+
+	// the age is counted from the 304 response now
+	if notModified.snapHeader.Get("Age") == "" {
+		header.Del("Age")
+	}
+
+	isPublic, expiration := getCacheStatus(e.Request, &Response{Code: e.Response.Code, snapHeader: header}, config)
+	if !isPublic {
+		return false
+	}
+
+	e.lock.Lock()
+	e.Response.snapHeader = header
+	e.expiration = expiration
+	e.staleWhileRevalidate = getStaleWhileRevalidate(header, config)
+	e.staleIfError = getStaleIfError(header, config)
+	e.heuristic = isHeuristic(header, config)
+	e.responseTime = now()
+	e.lock.Unlock()
+
+	if err := e.Response.refresh(e.cleanAt(config)); err != nil {
+		caddy.Log().Named("http.handlers.http_cache").Error(fmt.Sprintf("refresh entry error: %s", err.Error()))
+		return false
+	}
+
+	return true
+}
+
+// currentAge returns the age of the entry which is the time since it was
+// generated by the upstream.
+// https://httpwg.org/specs/rfc9111.html#age.calculations
+func (e *Entry) currentAge() time.Duration {
+	e.lock.RLock()
+	header, responseTime := e.Response.snapHeader, e.responseTime
+	e.lock.RUnlock()
+
+	var initialAge time.Duration
+	if date, err := http.ParseTime(header.Get("Date")); err == nil && responseTime.After(date) {
+		initialAge = responseTime.Sub(date)
+	}
+
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		if ageValue := time.Duration(age) * time.Second; ageValue > initialAge {
+			initialAge = ageValue
+		}
+	}
+
+	residentTime := now().Sub(responseTime)
+	if residentTime < 0 {
+		residentTime = 0
+	}
+
+	return initialAge + residentTime
+}
+
+// formatAge formats the age as the value of the Age header in seconds
+func formatAge(age time.Duration) string {
+	return strconv.FormatInt(int64(age/time.Second), 10)
+}
+
 // IsFresh indicates this entry is not expired
 func (e *Entry) IsFresh() bool {
-	return e.expiration.After(time.Now())
+	return e.freshUntil().After(time.Now())
+}
+
+// isStaleWhileRevalidate indicates this entry is expired but it's still in the
+// stale-while-revalidate window so it can be served while being refreshed.
+func (e *Entry) isStaleWhileRevalidate() bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	t := time.Now()
+	return !e.expiration.After(t) && e.expiration.Add(e.staleWhileRevalidate).After(t)
 }
 
-func (e *Entry) keyWithRespectVary() string {
+// isStaleIfError indicates this entry can be served in place of the upstream's
+// error response. It's allowed within the stale_max_age or the stale-if-error
+// window of either the response or the request.
+func (e *Entry) isStaleIfError(r *http.Request, config *Config) bool {
+	e.lock.RLock()
+	staleness, window := time.Since(e.expiration), e.staleIfError
+	e.lock.RUnlock()
+
+	if staleness <= config.StaleMaxAge {
+		return true
+	}
+	if reqWindow := getRequestStaleIfError(r, config); reqWindow > window {
+		window = reqWindow
+	}
+
+	return staleness <= window
+}
+
+// staleMaxAge returns how long the entry is kept after it's expired. The
+// entry carrying a validator is kept for the revalidation as well.
+func (e *Entry) staleMaxAge(config *Config) time.Duration {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.staleMaxAgeLocked(config)
+}
+
+func (e *Entry) staleMaxAgeLocked(config *Config) time.Duration {
+	staleMaxAge := config.StaleMaxAge
+
+	if e.staleWhileRevalidate > staleMaxAge {
+		staleMaxAge = e.staleWhileRevalidate
+	}
+
+	if e.staleIfError > staleMaxAge {
+		staleMaxAge = e.staleIfError
+	}
+
+	if config.RevalidateMaxAge > staleMaxAge && e.Response != nil {
+		header := e.Response.snapHeader
+		if header.Get("ETag") != "" || header.Get("Last-Modified") != "" {
+			staleMaxAge = config.RevalidateMaxAge
+		}
+	}
+
+	return staleMaxAge
+}
+
+func (e *Entry) keyWithRespectVary(config *Config) string {
 	// https://cloud.google.com/cdn/docs/caching#vary-headers
 	buf := keyBufPool.Get().(*bytes.Buffer)
 	buf.Reset()
@@ -361,29 +738,28 @@ func (e *Entry) keyWithRespectVary() string {
 
 	defer keyBufPool.Put(buf)
 
-	vary := e.Response.snapHeader.Get("Vary")
+	vary := e.header().Get("Vary")
 	for _, header := range strings.Split(vary, ",") {
-		buf.WriteString(e.Request.Header.Get(header))
+		buf.WriteString(varyValue(e.Request, header, config.NormalizeVary))
 	}
 
 	return url.PathEscape(buf.String())
 }
 
 func (e *Entry) setBackend(ctx context.Context, config *Config) error {
-	var backend backends.Backend
-	var err error
+	backend, err := e.newBackend(ctx, config)
+	e.Response.SetBody(backend)
+	return err
+}
 
-	switch config.Type {
-	case file:
-		backend, err = backends.NewFileBackend(config.Path)
-	case inMemory:
-		backend, err = backends.NewInMemoryBackend(ctx, e.keyWithRespectVary(), e.expiration)
-	case redis:
-		backend, err = backends.NewRedisBackend(ctx, e.keyWithRespectVary(), e.expiration)
+// newBackend creates the backend storage for the entry's body
+func (e *Entry) newBackend(ctx context.Context, config *Config) (backends.Backend, error) {
+	storage, err := configStorage(config)
+	if err != nil {
+		return nil, err
 	}
 
-	e.Response.SetBody(backend)
-	return err
+	return storage.NewBackend(ctx, e.keyWithRespectVary(config), e.cleanAt(config))
 }
 
 // HTTPCache is a http cache for http request which is focus on static files
@@ -393,6 +769,10 @@ type HTTPCache struct {
 	entries          []map[string][]*Entry
 	entriesLock      []*sync.RWMutex
 	isDistributed    bool
+	normalizeVary    map[string][]string
+	tags             *tagIndex
+	disk             *diskUsage
+	expiry           *expiryScheduler
 }
 
 // NewHTTPCache new a HTTPCache to handle cache entries
@@ -415,12 +795,28 @@ func NewHTTPCache(config *Config, distributedOn bool) *HTTPCache {
 		}
 	}
 
+	if tags == nil {
+		tags = newTagIndex()
+	}
+
+	if disk == nil {
+		disk = newDiskUsage()
+	}
+
+	if expiry == nil {
+		expiry = newExpiryScheduler()
+	}
+
 	return &HTTPCache{
 		cacheKeyTemplate: config.CacheKeyTemplate,
 		cacheBucketsNum:  config.CacheBucketsNum,
 		entries:          entries,
 		entriesLock:      entriesLock,
 		isDistributed:    distributedOn,
+		normalizeVary:    config.NormalizeVary,
+		tags:             tags,
+		disk:             disk,
+		expiry:           expiry,
 	}
 
 }
@@ -477,7 +873,8 @@ func (h *HTTPCache) Get(key string, request *http.Request, includeStale bool) (*
 	}
 
 	for _, entry := range previousEntries {
-		if (entry.IsFresh() || includeStale) && matchVary(request, entry) {
+		if (entry.IsFresh() || includeStale) && matchVary(request, entry, h.normalizeVary) {
+			h.disk.touch(entry)
 			return entry, true
 		}
 	}
@@ -506,46 +903,141 @@ func (h *HTTPCache) Keys() []string {
 func (h *HTTPCache) Del(key string) error {
 	b := h.getBucketIndexForKey(key)
 	h.entriesLock[b].RLock()
-	previousEntries, exists := h.entries[b][key]
+	// copy the entries because cleanEntry removes them from the slice in place
+	previousEntries := append([]*Entry(nil), h.entries[b][key]...)
 	h.entriesLock[b].RUnlock()
 
-	if !exists {
+	if len(previousEntries) == 0 {
 		return nil
 	}
 
-	// the schedule will clean the entry automatically
+	// the stale entries are cleaned as well because they may still be served,
+	// ex. in the stale-while-revalidate window. The scheduled clean of
+	// a cleaned entry does nothing.
 	for _, entry := range previousEntries {
-		if entry.IsFresh() {
-			err := h.cleanEntry(entry)
-			if err != nil {
-				caddy.Log().Named("http.handlers.http_cache").Error(fmt.Sprintf("clean entry error: %s", err.Error()))
-				return err
-			}
+		err := h.cleanEntry(entry)
+		if err != nil {
+			caddy.Log().Named("http.handlers.http_cache").Error(fmt.Sprintf("clean entry error: %s", err.Error()))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// KeysByTag lists the keys of the entries carrying the tag
+func (h *HTTPCache) KeysByTag(tag string) []string {
+	return h.tags.keysOf(tag)
+}
+
+// DelByTag purges the entries carrying the tag immediately
+func (h *HTTPCache) DelByTag(tag string) error {
+	for _, key := range h.KeysByTag(tag) {
+		if err := h.Del(key); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// Put adds the entry in the cache
+// Put adds the entry in the cache. Its metadata is kept next to the body
+// once the body is completely written.
 func (h *HTTPCache) Put(request *http.Request, entry *Entry, config *Config) {
+	h.insert(entry, config)
+
+	go func() {
+		<-entry.Response.bodyCompleteChan
+		h.persist(entry)
+		h.recordDiskSize(entry, config)
+	}()
+}
+
+// contains tells whether the entry is in the cache
+func (h *HTTPCache) contains(entry *Entry) bool {
+	key := entry.Key()
+	bucket := h.getBucketIndexForKey(key)
+
+	h.entriesLock[bucket].RLock()
+	defer h.entriesLock[bucket].RUnlock()
+
+	for _, otherEntry := range h.entries[bucket][key] {
+		if entry == otherEntry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// insert adds the entry in the index and schedules its clean
+func (h *HTTPCache) insert(entry *Entry, config *Config) {
+	h.insertEntry(entry, config, true)
+}
+
+// insertIfAbsent adds the entry in the index unless the entry of the same
+// variant exists. It returns false when the entry is not added.
+func (h *HTTPCache) insertIfAbsent(entry *Entry, config *Config) bool {
+	return h.insertEntry(entry, config, false)
+}
+
+// insertEntry adds the entry in the index and schedules its clean. The entry
+// of the same variant is replaced when replace is true.
+func (h *HTTPCache) insertEntry(entry *Entry, config *Config, replace bool) bool {
 	key := entry.Key()
 	bucket := h.getBucketIndexForKey(key)
 
+	// evict after the lock is released because the evicted entries may be
+	// in the same bucket
+	inserted := false
+	defer func() {
+		if inserted {
+			h.trackDiskUsage(entry, config)
+		}
+	}()
+
 	h.entriesLock[bucket].Lock()
 	defer h.entriesLock[bucket].Unlock()
 
-	h.scheduleCleanEntry(entry, config.StaleMaxAge)
-
+	index := -1
 	for i, previousEntry := range h.entries[bucket][key] {
-		if matchVary(entry.Request, previousEntry) {
-			go previousEntry.Clean()
-			h.entries[bucket][key][i] = entry
-			return
+		if matchVary(entry.Request, previousEntry, h.normalizeVary) {
+			index = i
+			break
 		}
 	}
 
-	h.entries[bucket][key] = append(h.entries[bucket][key], entry)
+	if index != -1 && !replace {
+		return false
+	}
+
+	inserted = true
+	h.scheduleCleanEntry(entry, config)
+	defer h.indexTags(bucket, key)
+
+	if index == -1 {
+		h.entries[bucket][key] = append(h.entries[bucket][key], entry)
+		return true
+	}
+
+	previousEntry := h.entries[bucket][key][index]
+	h.disk.remove(previousEntry)
+	h.expiry.cancel(previousEntry)
+	go previousEntry.Clean()
+	h.entries[bucket][key][index] = entry
+	return true
+}
+
+// indexTags replaces the tags of the key with the ones of its entries so the
+// tags of the replaced or removed entries don't purge the others. It should
+// be called with the bucket's lock held.
+func (h *HTTPCache) indexTags(bucket uint32, key string) {
+	tags := []string{}
+	for _, entry := range h.entries[bucket][key] {
+		tags = append(tags, entry.tags...)
+	}
+
+	h.tags.set(key, tags)
 }
 
 func (h *HTTPCache) distributedClean(key string, entry *Entry) error {
@@ -582,6 +1074,20 @@ func (h *HTTPCache) distributedClean(key string, entry *Entry) error {
 }
 
 func (h *HTTPCache) cleanEntry(entry *Entry) error {
+	if !h.removeEntry(entry) {
+		return nil
+	}
+
+	h.disk.remove(entry)
+	if !h.isDistributed {
+		return entry.Clean()
+	}
+	return h.distributedClean(entry.Key(), entry)
+}
+
+// removeEntry removes the entry from the cache without cleaning its storage.
+// It returns false when the entry is already removed.
+func (h *HTTPCache) removeEntry(entry *Entry) bool {
 	key := entry.Key()
 	bucket := h.getBucketIndexForKey(key)
 
@@ -591,21 +1097,64 @@ func (h *HTTPCache) cleanEntry(entry *Entry) error {
 	for i, otherEntry := range h.entries[bucket][key] {
 		if entry == otherEntry {
 			h.entries[bucket][key] = append(h.entries[bucket][key][:i], h.entries[bucket][key][i+1:]...)
-			if !h.isDistributed {
-				return entry.Clean()
-			}
-			return h.distributedClean(key, entry)
+			h.indexTags(bucket, key)
+			h.expiry.cancel(entry)
+			return true
 		}
 	}
 
-	return nil
+	return false
 }
 
-func (h *HTTPCache) scheduleCleanEntry(entry *Entry, staleMaxAge time.Duration) {
-	go func(entry *Entry) {
-		expiration := entry.expiration
-		expiration = expiration.Add(staleMaxAge)
-		time.Sleep(expiration.Sub(time.Now()))
+// scheduleCleanEntry cleans the entry when it expires. The entry scheduled
+// before is rescheduled.
+func (h *HTTPCache) scheduleCleanEntry(entry *Entry, config *Config) {
+	h.expiry.schedule(entry, entry.cleanAt(config), func() {
+		// the expiration may be extended by a revalidation without rescheduling
+		if time.Now().Before(entry.cleanAt(config)) {
+			h.scheduleCleanEntry(entry, config)
+			return
+		}
 		h.cleanEntry(entry)
-	}(entry)
+	})
+}
+
+// refresh refreshes the entry with the upstream's 304 response and
+// reschedules its clean. It returns false when the entry is not cacheable
+// anymore.
+func (h *HTTPCache) refresh(entry *Entry, notModified *Response, config *Config) bool {
+	if !entry.refresh(notModified, config) {
+		return false
+	}
+
+	// the entry may be purged or replaced while it's being revalidated
+	if h.rescheduleCleanEntry(entry, config) {
+		h.persist(entry)
+	}
+	return true
+}
+
+// rescheduleCleanEntry reschedules the clean of the entry if it's still in
+// the cache. It returns false when the entry is already removed.
+func (h *HTTPCache) rescheduleCleanEntry(entry *Entry, config *Config) bool {
+	key := entry.Key()
+	bucket := h.getBucketIndexForKey(key)
+
+	// hold the lock so the entry isn't removed before it's rescheduled
+	h.entriesLock[bucket].Lock()
+	defer h.entriesLock[bucket].Unlock()
+
+	for _, otherEntry := range h.entries[bucket][key] {
+		if entry == otherEntry {
+			h.scheduleCleanEntry(entry, config)
+			return true
+		}
+	}
+
+	return false
+}
+
+// PendingExpiry returns the number of the entries waiting to be expired
+func (h *HTTPCache) PendingExpiry() int {
+	return h.expiry.pending()
 }
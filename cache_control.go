@@ -0,0 +1,87 @@
+package httpcache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// the targeted cache control headers which are for the CDNs only
+// https://www.rfc-editor.org/rfc/rfc9213.html
+// https://www.w3.org/TR/edge-arch/
+const (
+	cdnCacheControl  = "CDN-Cache-Control"
+	surrogateControl = "Surrogate-Control"
+)
+
+// targetedHeaders returns the targeted cache control headers in the order of
+// precedence. The configured one comes first.
+func targetedHeaders(config *Config) []string {
+	headers := []string{cdnCacheControl, surrogateControl}
+	if config.TargetedCacheControl != "" {
+		headers = append([]string{config.TargetedCacheControl}, headers...)
+	}
+	return headers
+}
+
+// cacheControlHeaders returns the response headers to decide the caching
+// policy. When a targeted header has a non-empty value, it takes the place
+// of Cache-Control and Expires is ignored. The Surrogate-Control without any
+// caching directive, ex. content="ESI/1.0" only, doesn't.
+func cacheControlHeaders(respHeaders http.Header, config *Config) http.Header {
+	for _, name := range targetedHeaders(config) {
+		value := strings.TrimSpace(respHeaders.Get(name))
+		if value == "" {
+			continue
+		}
+
+		if http.CanonicalHeaderKey(name) == surrogateControl {
+			value = convertSurrogateControl(value)
+			if value == "" {
+				continue
+			}
+		}
+
+		header := respHeaders.Clone()
+		header.Set("Cache-Control", value)
+		header.Del("Expires")
+		return header
+	}
+
+	return respHeaders
+}
+
+// convertSurrogateControl keeps the directives of Surrogate-Control which
+// are also Cache-Control's. The targeting of a directive (ex. max-age=60;edge)
+// and the extension of max-age (ex. max-age=60+30) are dropped. The content
+// directive (ex. content="ESI/1.0") describes the processing of the body
+// so it's not related to the caching.
+func convertSurrogateControl(value string) string {
+	directives := []string{}
+
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if i := strings.Index(directive, ";"); i != -1 {
+			directive = directive[:i]
+		}
+
+		switch {
+		case directive == "no-store":
+			directives = append(directives, directive)
+		case strings.HasPrefix(directive, "max-age="):
+			if i := strings.Index(directive, "+"); i != -1 {
+				directive = directive[:i]
+			}
+			directives = append(directives, directive)
+		}
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// stripTargetedHeaders removes the targeted cache control headers from the
+// response to the client because they are only for this cache.
+func stripTargetedHeaders(header http.Header, config *Config) {
+	for _, name := range targetedHeaders(config) {
+		header.Del(name)
+	}
+}
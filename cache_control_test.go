@@ -0,0 +1,94 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TargetedCacheControlTestSuite struct {
+	suite.Suite
+	config *Config
+}
+
+func (suite *TargetedCacheControlTestSuite) SetupSuite() {
+	suite.config = &Config{
+		DefaultMaxAge:        time.Second,
+		LockTimeout:          time.Minute,
+		TargetedCacheControl: "Cdp-Cache-Control",
+	}
+
+	testTime := time.Now().UTC()
+	now = func() time.Time {
+		return testTime
+	}
+}
+
+func (suite *TargetedCacheControlTestSuite) TearDownSuite() {
+	now = func() time.Time { return time.Now().UTC() }
+}
+
+func (suite *TargetedCacheControlTestSuite) TestCDNCacheControlPrecedence() {
+	header := makeHeader("Cache-Control", "max-age=10")
+	header.Set("CDN-Cache-Control", "max-age=600")
+
+	isPublic, expiration := getCacheStatus(makeRequest("/", http.Header{}), makeResponse(200, header), suite.config)
+	suite.True(isPublic)
+	suite.Equal(now().Add(600*time.Second).Round(time.Second), expiration.Round(time.Second))
+
+	header.Set("Cdp-Cache-Control", "no-store")
+	isPublic, _ = getCacheStatus(makeRequest("/", http.Header{}), makeResponse(200, header), suite.config)
+	suite.False(isPublic, "the configured targeted header should come first")
+}
+
+func (suite *TargetedCacheControlTestSuite) TestCDNCacheControlIgnoresExpires() {
+	header := makeHeader("Expires", now().Add(time.Hour).Format(http.TimeFormat))
+	header.Set("CDN-Cache-Control", "max-age=60")
+
+	cacheHeaders := cacheControlHeaders(header, suite.config)
+	suite.Equal("max-age=60", cacheHeaders.Get("Cache-Control"))
+	suite.Equal("", cacheHeaders.Get("Expires"))
+	suite.NotEqual("", header.Get("Expires"), "the stored headers should not be changed")
+}
+
+func (suite *TargetedCacheControlTestSuite) TestSurrogateControl() {
+	suite.Equal("max-age=300", convertSurrogateControl(`max-age=300+60, content="ESI/1.0"`))
+	suite.Equal("no-store", convertSurrogateControl("no-store;edge1"))
+
+	header := makeHeader("Cache-Control", "private")
+	header.Set("Surrogate-Control", `max-age=120, content="ESI/1.0"`)
+	isPublic, expiration := getCacheStatus(makeRequest("/", http.Header{}), makeResponse(200, header), suite.config)
+	suite.True(isPublic)
+	suite.Equal(now().Add(120*time.Second).Round(time.Second), expiration.Round(time.Second))
+}
+
+func (suite *TargetedCacheControlTestSuite) TestSurrogateControlWithoutCaching() {
+	header := makeHeader("Cache-Control", "no-store")
+	header.Set("Expires", now().Add(time.Hour).Format(http.TimeFormat))
+	header.Set("Surrogate-Control", `content="ESI/1.0"`)
+	suite.Equal(header, cacheControlHeaders(header, suite.config), "the origin's Cache-Control and Expires should be kept")
+
+	isPublic, _ := getCacheStatus(makeRequest("/", http.Header{}), makeResponse(200, header), suite.config)
+	suite.False(isPublic)
+}
+
+func (suite *TargetedCacheControlTestSuite) TestWithoutTargetedHeaders() {
+	header := makeHeader("Cache-Control", "max-age=10")
+	suite.Equal(header, cacheControlHeaders(header, suite.config))
+}
+
+func (suite *TargetedCacheControlTestSuite) TestStripTargetedHeaders() {
+	header := makeHeader("Cache-Control", "max-age=10")
+	header.Set("CDN-Cache-Control", "max-age=600")
+	header.Set("Surrogate-Control", "max-age=600")
+	header.Set("Cdp-Cache-Control", "max-age=600")
+
+	stripTargetedHeaders(header, suite.config)
+	suite.Equal(makeHeader("Cache-Control", "max-age=10"), header)
+}
+
+func TestTargetedCacheControlTestSuite(t *testing.T) {
+	suite.Run(t, new(TargetedCacheControlTestSuite))
+}
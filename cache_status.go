@@ -0,0 +1,108 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cacheStatusHeader is the structured header to tell how the cache handled
+// the request.
+// https://www.rfc-editor.org/rfc/rfc9211.html
+const cacheStatusHeader = "Cache-Status"
+
+// cacheStatusDetails explains why the response isn't served from the cache.
+// The bypassed ones are explained by their own reasons.
+var cacheStatusDetails = map[string]string{
+	cacheSkip: "not-storable",
+}
+
+// The details of the bypassed requests
+const (
+	bypassMethod          = "method"
+	bypassWebSocket       = "websocket"
+	bypassBodyTooLarge    = "body-too-large"
+	bypassGraphQLMutation = "graphql-mutation"
+)
+
+// The details of the responses which aren't served from the cache for the
+// other reasons
+const (
+	detailLockTimeout  = "lock-timeout"
+	detailOnlyIfCached = "only-if-cached"
+)
+
+// bypassDetail returns the detail of the request bypassed by shouldUseCache
+func bypassDetail(req *http.Request) string {
+	if isWebSocket(req.Header) {
+		return bypassWebSocket
+	}
+	return bypassMethod
+}
+
+// postBypassDetail returns the detail of the POST request bypassed by the error
+// of preparePostRequest
+func postBypassDetail(err error) string {
+	if err == errGraphQLMutation {
+		return bypassGraphQLMutation
+	}
+	return bypassBodyTooLarge
+}
+
+// cacheStatusValue returns the member of the Cache-Status list for the
+// response served with the given cache status. The entry can be nil when
+// the response doesn't come from an entry, ex. the bypassed ones. The detail
+// is omitted when it's empty.
+func cacheStatusValue(name string, status string, entry *Entry, detail string) string {
+	params := []string{name}
+
+	switch status {
+	case cacheHit, cacheStale:
+		params = append(params, "hit")
+	case cacheMiss:
+		// nothing is forwarded for the only-if-cached request
+		if detail != detailOnlyIfCached {
+			params = append(params, "fwd=uri-miss")
+		}
+	case cacheRevalidated:
+		params = append(params, "fwd=stale", fmt.Sprintf("fwd-status=%d", http.StatusNotModified))
+	case cacheSkip:
+		params = append(params, "fwd=uri-miss")
+	case cacheBypass:
+		params = append(params, "fwd=bypass")
+	}
+
+	if entry != nil && entry.isPublic {
+		if status == cacheMiss {
+			params = append(params, "stored")
+		}
+
+		// the ttl is negative when the stale entry is served
+		ttl := entry.freshUntil().Sub(now()).Round(time.Second) / time.Second
+		params = append(params, fmt.Sprintf("ttl=%d", ttl), fmt.Sprintf("key=%s", quoteString(entry.Key())))
+	}
+
+	if detail != "" {
+		params = append(params, "detail="+detail)
+	}
+
+	return strings.Join(params, "; ")
+}
+
+// quoteString serializes the string as the structured field's string
+// https://www.rfc-editor.org/rfc/rfc8941.html#name-strings
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// addCacheStatus appends the member of this cache to the Cache-Status list
+// so the ones from the upstream caches are kept in front of it.
+func addCacheStatus(header http.Header, value string) {
+	if previous := header.Get(cacheStatusHeader); previous != "" {
+		value = previous + ", " + value
+	}
+	header.Set(cacheStatusHeader, value)
+}
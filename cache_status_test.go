@@ -0,0 +1,72 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheStatusHeaderTestSuite struct {
+	suite.Suite
+}
+
+func (suite *CacheStatusHeaderTestSuite) SetupSuite() {
+	testTime := time.Now().UTC()
+	now = func() time.Time {
+		return testTime
+	}
+}
+
+func (suite *CacheStatusHeaderTestSuite) TearDownSuite() {
+	now = func() time.Time { return time.Now().UTC() }
+}
+
+func (suite *CacheStatusHeaderTestSuite) TestHit() {
+	entry := &Entry{isPublic: true, key: "GET localhost/a?", expiration: now().Add(123 * time.Second)}
+	suite.Equal(`cdp-cache; hit; ttl=123; key="GET localhost/a?"`, cacheStatusValue("cdp-cache", cacheHit, entry, ""))
+}
+
+func (suite *CacheStatusHeaderTestSuite) TestStale() {
+	entry := &Entry{isPublic: true, key: "k", expiration: now().Add(-5 * time.Second)}
+	suite.Equal(`cdp-cache; hit; ttl=-5; key="k"`, cacheStatusValue("cdp-cache", cacheStale, entry, ""))
+	suite.Equal(`cdp-cache; fwd=stale; fwd-status=304; ttl=-5; key="k"`, cacheStatusValue("cdp-cache", cacheRevalidated, entry, ""))
+}
+
+func (suite *CacheStatusHeaderTestSuite) TestMiss() {
+	entry := &Entry{isPublic: true, key: `say "hi"`, expiration: now().Add(time.Minute)}
+	suite.Equal(`cdp-cache; fwd=uri-miss; stored; ttl=60; key="say \"hi\""`, cacheStatusValue("cdp-cache", cacheMiss, entry, ""))
+}
+
+func (suite *CacheStatusHeaderTestSuite) TestSkipAndBypass() {
+	entry := &Entry{isPublic: false, key: "k"}
+	suite.Equal("cdp-cache; fwd=uri-miss; detail=not-storable", cacheStatusValue("cdp-cache", cacheSkip, entry, cacheStatusDetails[cacheSkip]))
+	suite.Equal("cdp-cache; fwd=bypass; detail=method", cacheStatusValue("cdp-cache", cacheBypass, nil, bypassMethod))
+	suite.Equal("cdp-cache; fwd=uri-miss; detail=lock-timeout", cacheStatusValue("cdp-cache", cacheSkip, nil, detailLockTimeout))
+}
+
+func (suite *CacheStatusHeaderTestSuite) TestOnlyIfCached() {
+	suite.Equal("cdp-cache; detail=only-if-cached", cacheStatusValue("cdp-cache", cacheMiss, nil, detailOnlyIfCached))
+}
+
+func (suite *CacheStatusHeaderTestSuite) TestBypassDetail() {
+	suite.Equal(bypassMethod, bypassDetail(makeRequest("/", http.Header{})))
+	suite.Equal(bypassWebSocket, bypassDetail(makeRequest("/", http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}})))
+	suite.Equal(bypassBodyTooLarge, postBypassDetail(errBodyTooLarge))
+	suite.Equal(bypassGraphQLMutation, postBypassDetail(errGraphQLMutation))
+}
+
+func (suite *CacheStatusHeaderTestSuite) TestAppendToUpstream() {
+	header := makeHeader(cacheStatusHeader, "OriginCache; hit")
+	addCacheStatus(header, "cdp-cache; hit")
+	suite.Equal("OriginCache; hit, cdp-cache; hit", header.Get(cacheStatusHeader))
+
+	header = http.Header{}
+	addCacheStatus(header, "cdp-cache; hit")
+	suite.Equal("cdp-cache; hit", header.Get(cacheStatusHeader))
+}
+
+func TestCacheStatusHeaderTestSuite(t *testing.T) {
+	suite.Run(t, new(CacheStatusHeaderTestSuite))
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,6 +27,9 @@ func makeResponse(code int, headers http.Header) *Response {
 	response := NewResponse()
 	response.Code = code
 	response.snapHeader = headers
+	// the headers are written as the upstream's response is before its entry
+	// is created
+	response.wroteHeader = true
 	return response
 }
 
@@ -35,6 +39,18 @@ func makeHeader(key string, value string) http.Header {
 	return h
 }
 
+// useTypedStorage sets the storage of the config's cache type as the handler
+// does when no storage module is configured
+func useTypedStorage(config *Config) *Config {
+	storage, err := typedStorage(config)
+	if err != nil {
+		panic(err)
+	}
+
+	config.Storage = storage
+	return config
+}
+
 type CacheStatusTestSuite struct {
 	suite.Suite
 	c *Config
@@ -115,6 +131,91 @@ func (suite *CacheStatusTestSuite) TestPathMatchedWithoutExpirationSpecified() {
 	suite.Equal(now().Add(suite.c.DefaultMaxAge).Round(time.Second), expiration.Round(time.Second))
 }
 
+func (suite *CacheStatusTestSuite) TestStaleWhileRevalidate() {
+	config := &Config{StaleWhileRevalidate: 10 * time.Second}
+
+	header := makeHeader("Cache-Control", "max-age=60, stale-while-revalidate=30")
+	suite.Equal(30*time.Second, getStaleWhileRevalidate(header, config))
+
+	header = makeHeader("Cache-Control", "max-age=60")
+	suite.Equal(10*time.Second, getStaleWhileRevalidate(header, config), "the config's window should be used")
+}
+
+func (suite *CacheStatusTestSuite) TestStaleIfError() {
+	config := &Config{StaleIfError: time.Minute}
+
+	header := makeHeader("Cache-Control", "max-age=60, stale-if-error=30")
+	suite.Equal(30*time.Second, getStaleIfError(header, config))
+
+	header = makeHeader("Cache-Control", "max-age=60, stale-if-error=3600")
+	suite.Equal(time.Minute, getStaleIfError(header, config), "it should be limited by the config")
+
+	suite.Equal(time.Duration(0), getStaleIfError(header, &Config{}), "it should be disabled without the config")
+
+	req := makeRequest("/", makeHeader("Cache-Control", "stale-if-error=45"))
+	suite.Equal(45*time.Second, getRequestStaleIfError(req, config))
+}
+
+func (suite *CacheStatusTestSuite) TestHeuristicFreshness() {
+	config := &Config{
+		DefaultMaxAge:      time.Second,
+		HeuristicFreshness: true,
+		HeuristicFraction:  0.1,
+		HeuristicMaxAge:    time.Hour,
+	}
+
+	header := makeHeader("Date", now().Format(http.TimeFormat))
+	header.Set("Last-Modified", now().Add(-5*time.Hour).Format(http.TimeFormat))
+
+	isPublic, expiration := getCacheStatus(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+	suite.True(isPublic)
+	suite.Equal(now().Add(30*time.Minute).Round(time.Second), expiration.Round(time.Second))
+
+	header.Set("Last-Modified", now().Add(-100*time.Hour).Format(http.TimeFormat))
+	_, expiration = getCacheStatus(makeRequest("/", http.Header{}), makeResponse(200, header), config)
+	suite.Equal(now().Add(time.Hour).Round(time.Second), expiration.Round(time.Second), "it should be capped by the max age")
+
+	header.Set("Cache-Control", "max-age=5")
+	_, ok := heuristicFreshness(header, config)
+	suite.False(ok, "the explicit expiration should be used")
+
+	header.Del("Cache-Control")
+	_, ok = heuristicFreshness(header, &Config{})
+	suite.False(ok, "it should be disabled without the config")
+}
+
+func (suite *CacheStatusTestSuite) TestStatusTTL() {
+	config := &Config{
+		DefaultMaxAge: time.Hour,
+		StatusTTL: map[string]time.Duration{
+			"404": 30 * time.Second,
+			"503": 5 * time.Second,
+			"5xx": 10 * time.Second,
+		},
+	}
+	req := makeRequest("/", http.Header{})
+
+	isPublic, expiration := getCacheStatus(req, makeResponse(404, http.Header{}), config)
+	suite.True(isPublic)
+	suite.Equal(now().Add(30*time.Second).Round(time.Second), expiration.Round(time.Second))
+
+	isPublic, expiration = getCacheStatus(req, makeResponse(503, http.Header{}), config)
+	suite.True(isPublic, "the status which isn't cacheable by default should be cached")
+	suite.Equal(now().Add(5*time.Second).Round(time.Second), expiration.Round(time.Second), "the exact code should come first")
+
+	_, expiration = getCacheStatus(req, makeResponse(502, http.Header{}), config)
+	suite.Equal(now().Add(10*time.Second).Round(time.Second), expiration.Round(time.Second))
+
+	_, expiration = getCacheStatus(req, makeResponse(404, makeHeader("Cache-Control", "max-age=60")), config)
+	suite.Equal(now().Add(60*time.Second).Round(time.Second), expiration.Round(time.Second), "the explicit expiration should be used")
+
+	isPublic, _ = getCacheStatus(req, makeResponse(503, makeHeader("Cache-Control", "no-store")), config)
+	suite.False(isPublic)
+
+	isPublic, _ = getCacheStatus(req, makeResponse(302, http.Header{}), config)
+	suite.False(isPublic)
+}
+
 type RuleMatcherTestSuite struct {
 	suite.Suite
 }
@@ -170,6 +271,7 @@ func (suite *EntryTestSuite) TestEntryWritePublicResponse() {
 	rw := httptest.NewRecorder()
 
 	suite.config.Type = inMemory
+	useTypedStorage(suite.config)
 	input := []byte(`rain cats and dogs`)
 
 	go func() {
@@ -185,6 +287,39 @@ func (suite *EntryTestSuite) TestEntryWritePublicResponse() {
 	suite.Equal(input, result)
 }
 
+func (suite *EntryTestSuite) TestEntryWriteRange() {
+	config := getDefaultConfig()
+	config.Path = "/tmp/caddy-cache-range"
+	useTypedStorage(config)
+
+	req := makeRequest("/", http.Header{})
+	res := makeResponse(200, makeHeader("Cache-Control", "max-age=43200"))
+	entry := NewEntry("range_key", req, res, config)
+
+	go func() {
+		entry.Response.Write([]byte(`rain cats and dogs`))
+		entry.Response.Close()
+	}()
+
+	suite.Nil(entry.setBackend(req.Context(), config))
+	defer entry.Clean()
+
+	rw := httptest.NewRecorder()
+	suite.Nil(entry.WriteRangeTo(rw, makeRequest("/", makeHeader("Range", "bytes=5-8"))))
+	suite.Equal(http.StatusPartialContent, rw.Code)
+	suite.Equal("bytes 5-8/18", rw.Header().Get("Content-Range"))
+	suite.Equal("cats", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	suite.Nil(entry.WriteRangeTo(rw, makeRequest("/", makeHeader("Range", "bytes=100-"))))
+	suite.Equal(http.StatusRequestedRangeNotSatisfiable, rw.Code)
+
+	rw = httptest.NewRecorder()
+	suite.Nil(entry.WriteRangeTo(rw, makeRequest("/", makeHeader("Range", "bytes=0-3,5-8"))))
+	suite.Equal(http.StatusPartialContent, rw.Code)
+	suite.Contains(rw.Header().Get("Content-Type"), "multipart/byteranges")
+}
+
 func (suite *EntryTestSuite) TestEntryWritePrivateResponse() {
 	req := makeRequest("/", http.Header{})
 	res := makeResponse(502, http.Header{})
@@ -200,6 +335,134 @@ func (suite *EntryTestSuite) TestEntryWritePrivateResponse() {
 	suite.Equal(502, rw.Code)
 }
 
+func (suite *EntryTestSuite) TestEntryRefreshedByNotModified() {
+	req := makeRequest("/", http.Header{})
+	res := makeResponse(200, http.Header{
+		"Cache-Control":  []string{"max-age=0"},
+		"Etag":           []string{`"v1"`},
+		"Content-Length": []string{"18"},
+	})
+	entry := NewEntry("refreshed_key", req, res, suite.config)
+	suite.True(entry.hasValidators())
+
+	notModified := makeResponse(304, http.Header{
+		"Cache-Control":  []string{"max-age=3600"},
+		"Content-Length": []string{"0"},
+	})
+
+	suite.True(entry.refresh(notModified, suite.config))
+	suite.True(entry.IsFresh())
+	suite.Equal("max-age=3600", entry.Response.snapHeader.Get("Cache-Control"))
+	suite.Equal("18", entry.Response.snapHeader.Get("Content-Length"), "the body's headers should be kept")
+	suite.Equal(`"v1"`, entry.Response.snapHeader.Get("Etag"))
+
+	noStore := makeResponse(304, makeHeader("Cache-Control", "no-store"))
+	suite.False(entry.refresh(noStore, suite.config))
+}
+
+func (suite *EntryTestSuite) TestEntryRefreshedWhileRead() {
+	req := makeRequest("/", http.Header{})
+	res := makeResponse(200, makeHeader("Cache-Control", "max-age=0"))
+	entry := NewEntry("refreshed_while_read_key", req, res, suite.config)
+	notModified := makeResponse(304, makeHeader("Cache-Control", "max-age=3600"))
+
+	// run with -race to detect the unsynchronized metadata
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			entry.refresh(notModified, suite.config)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		entry.IsFresh()
+		entry.currentAge()
+		entry.isStaleWhileRevalidate()
+		entry.header().Get("Cache-Control")
+	}
+	wg.Wait()
+
+	suite.True(entry.IsFresh())
+}
+
+func (suite *EntryTestSuite) TestEntryInStaleWhileRevalidateWindow() {
+	config := getDefaultConfig()
+	config.StaleMaxAge = time.Minute
+
+	entry := &Entry{expiration: time.Now().Add(-1 * time.Second), staleWhileRevalidate: 10 * time.Second}
+	suite.True(entry.isStaleWhileRevalidate())
+	suite.Equal(time.Minute, entry.staleMaxAge(config))
+
+	entry = &Entry{expiration: time.Now().Add(-1 * time.Minute), staleWhileRevalidate: 10 * time.Second}
+	suite.False(entry.isStaleWhileRevalidate())
+
+	entry = &Entry{expiration: time.Now().Add(time.Minute), staleWhileRevalidate: 2 * time.Minute}
+	suite.False(entry.isStaleWhileRevalidate(), "a fresh entry is not stale")
+	suite.Equal(2*time.Minute, entry.staleMaxAge(config), "the entry should be kept during the window")
+}
+
+func (suite *EntryTestSuite) TestEntryKeptForRevalidation() {
+	config := getDefaultConfig()
+
+	entry := &Entry{expiration: time.Now().Add(-time.Minute), Response: makeResponse(200, makeHeader("ETag", `"v1"`))}
+	suite.Equal(defaultRevalidateMaxAge, entry.staleMaxAge(config), "the entry with a validator should be kept without the stale options")
+
+	entry = &Entry{expiration: time.Now().Add(-time.Minute), Response: makeResponse(200, http.Header{})}
+	suite.Equal(time.Duration(0), entry.staleMaxAge(config))
+
+	config.RevalidateMaxAge = 0
+	entry = &Entry{expiration: time.Now().Add(-time.Minute), Response: makeResponse(200, makeHeader("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"))}
+	suite.Equal(time.Duration(0), entry.staleMaxAge(config))
+}
+
+func (suite *EntryTestSuite) TestEntryInStaleIfErrorWindow() {
+	config := getDefaultConfig()
+	config.StaleIfError = time.Hour
+
+	req := makeRequest("/", http.Header{})
+	entry := &Entry{expiration: time.Now().Add(-1 * time.Minute), staleIfError: 2 * time.Minute}
+	suite.True(entry.isStaleIfError(req, config))
+	suite.Equal(2*time.Minute, entry.staleMaxAge(config))
+
+	entry = &Entry{expiration: time.Now().Add(-10 * time.Minute), staleIfError: 2 * time.Minute}
+	suite.False(entry.isStaleIfError(req, config))
+
+	req = makeRequest("/", makeHeader("Cache-Control", "stale-if-error=900"))
+	suite.True(entry.isStaleIfError(req, config), "the client accepts a staler response")
+}
+
+func (suite *EntryTestSuite) TestEntryHeuristicWarning() {
+	config := &Config{HeuristicFreshness: true, HeuristicFraction: 0.1}
+
+	header := makeHeader("Date", now().Add(-25*time.Hour).Format(http.TimeFormat))
+	header.Set("Last-Modified", now().Add(-1000*time.Hour).Format(http.TimeFormat))
+	entry := &Entry{heuristic: isHeuristic(header, config), Response: makeResponse(200, header)}
+
+	warning, ok := entry.heuristicWarning()
+	suite.True(ok)
+	suite.Equal(`113 - "Heuristic Expiration"`, warning)
+
+	header.Set("Date", now().Format(http.TimeFormat))
+	_, ok = entry.heuristicWarning()
+	suite.False(ok, "the warning is only for the response older than 24 hours")
+}
+
+func (suite *EntryTestSuite) TestEntryCurrentAge() {
+	testTime := time.Now().UTC().Truncate(time.Second)
+	now = func() time.Time { return testTime }
+	defer func() { now = func() time.Time { return time.Now().UTC() } }()
+
+	header := makeHeader("Date", now().Add(-10*time.Second).Format(http.TimeFormat))
+	entry := &Entry{Response: makeResponse(200, header), responseTime: now().Add(-5 * time.Second)}
+	suite.Equal(10*time.Second, entry.currentAge())
+
+	header.Set("Age", "60")
+	suite.Equal(65*time.Second, entry.currentAge(), "the upstream's age should be counted")
+	suite.Equal("65", formatAge(65*time.Second))
+}
+
 func (suite *EntryTestSuite) TearDownSuite() {
 	err := backends.ReleaseGroupCacheRes()
 	suite.Nil(err)
@@ -233,9 +496,70 @@ func (suite *HTTPCacheTestSuite) TestKeyWithrespectVary() {
 		"Vary": []string{"Accept-Encoding"},
 	})
 	e := NewEntry("hello", req, res, suite.config)
-	key := e.keyWithRespectVary()
+	key := e.keyWithRespectVary(suite.config)
 	expected := "hello" + url.PathEscape("gzip, deflate, br")
 	suite.Equal(expected, key)
+
+	config := &Config{NormalizeVary: map[string][]string{"Accept-Encoding": {}}}
+	suite.Equal("hellobr", e.keyWithRespectVary(config), "the normalized value should be used")
+}
+
+func (suite *HTTPCacheTestSuite) TestGetNormalizedVariant() {
+	cache := &HTTPCache{
+		cacheBucketsNum: suite.cache.cacheBucketsNum,
+		entries:         suite.cache.entries,
+		entriesLock:     suite.cache.entriesLock,
+		normalizeVary:   map[string][]string{"User-Agent": {}},
+		tags:            suite.cache.tags,
+		disk:            suite.cache.disk,
+		expiry:          suite.cache.expiry,
+	}
+
+	req := makeRequest("/", makeHeader("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0) Mobile/15E148"))
+	res := makeResponse(200, makeHeader("Vary", "User-Agent"))
+	entry := NewEntry("normalized", req, res, suite.config)
+	cache.Put(req, entry, suite.config)
+
+	other := makeRequest("/", makeHeader("User-Agent", "Mozilla/5.0 (Linux; Android 13; Pixel 7) Mobile Safari/537.36"))
+	prevEntry, exists := cache.Get("normalized", other, false)
+	suite.True(exists)
+	suite.Equal(entry, prevEntry)
+
+	desktop := makeRequest("/", makeHeader("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/118.0"))
+	_, exists = cache.Get("normalized", desktop, false)
+	suite.False(exists)
+}
+
+func (suite *HTTPCacheTestSuite) TestDelByTag() {
+	config := &Config{CacheTagHeader: "Surrogate-Key", DefaultMaxAge: time.Minute}
+	req := makeRequest("/", http.Header{})
+	res := makeResponse(200, makeHeader("Surrogate-Key", "article-42 home"))
+	entry := NewEntry("tagged", req, res, config)
+	suite.Equal([]string{"article-42", "home"}, entry.tags)
+
+	suite.cache.Put(req, entry, config)
+	suite.Equal([]string{"tagged"}, suite.cache.KeysByTag("home"))
+
+	suite.Nil(suite.cache.DelByTag("article-42"))
+	_, exists := suite.cache.Get("tagged", req, false)
+	suite.False(exists)
+	suite.Empty(suite.cache.KeysByTag("home"), "the key should be removed from all of its tags")
+}
+
+func (suite *HTTPCacheTestSuite) TestReplacedEntryTags() {
+	config := &Config{CacheTagHeader: "Surrogate-Key", DefaultMaxAge: time.Minute}
+	req := makeRequest("/", http.Header{})
+	suite.cache.Put(req, NewEntry("retagged", req, makeResponse(200, makeHeader("Surrogate-Key", "article-42")), config), config)
+
+	fresh := NewEntry("retagged", req, makeResponse(200, makeHeader("Surrogate-Key", "home")), config)
+	suite.cache.Put(req, fresh, config)
+	suite.Empty(suite.cache.KeysByTag("article-42"), "the replaced entry's tags should be dropped")
+
+	suite.Nil(suite.cache.DelByTag("article-42"))
+	entry, exists := suite.cache.Get("retagged", req, false)
+	suite.True(exists)
+	suite.Equal(fresh, entry)
+	suite.Equal([]string{"retagged"}, suite.cache.KeysByTag("home"))
 }
 
 func (suite *HTTPCacheTestSuite) TestGetExistEntry() {
@@ -3,6 +3,7 @@ package httpcache
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sillygod/cdp-cache/backends"
 )
 
 // CacheType is the type of cache which means the backend for storing
@@ -22,6 +24,7 @@ const (
 	file     CacheType = "file"
 	redis    CacheType = "redis"
 	inMemory CacheType = "in_memory"
+	bolt     CacheType = "bolt"
 )
 
 // BYTE represents the num of byte
@@ -45,6 +48,14 @@ var (
 	defaultCacheMaxMemorySize     = GB // default is 1 GB
 	defaultRedisConnectionSetting = "localhost:6379 0"
 	defaultStaleMaxAge            = time.Duration(0)
+	defaultStaleWhileRevalidate   = time.Duration(0)
+	defaultStaleIfError           = time.Duration(0)
+	defaultRevalidateMaxAge       = time.Duration(1) * time.Hour
+	defaultSliceSize              = 0
+	defaultHeuristicFraction      = 0.1
+	defaultHeuristicMaxAge        = time.Duration(24) * time.Hour
+	defaultCacheStatusName        = "cdp-cache"
+	defaultPostCacheMaxBodySize   = int64(64 * KB)
 	defaultCacheKeyTemplate       = "{http.request.method} {http.request.host}{http.request.uri.path}?{http.request.uri.query}"
 	// Note: prevent character space in the key
 	// the key is refereced from github.com/caddyserver/caddy/v2/modules/caddyhttp.addHTTPVarsToReplacer
@@ -67,9 +78,27 @@ const (
 	// ex.
 	// localhost:6789 0 => connect without password. only index and host:port provided
 	// the following are keys for extensions
-	keyDistributed = "distributed"
-	keyInfluxLog   = "influxlog"
-	keyStaleMaxAge = "stale_max_age"
+	keyDistributed          = "distributed"
+	keyStorage              = "storage"
+	keyInfluxLog            = "influxlog"
+	keyStaleMaxAge          = "stale_max_age"
+	keyStaleWhileRevalidate = "stale_while_revalidate"
+	keyStaleIfError         = "stale_if_error"
+	keyRevalidateMaxAge     = "revalidate_max_age"
+	keySliceSize            = "slice_size"
+	keyHeuristicFreshness   = "heuristic_freshness"
+	keyCacheStatus          = "cache_status"
+	keyIgnoreRequestCC      = "ignore_request_cache_control"
+	keyNormalizeVary        = "normalize_vary"
+	keyTargetedCacheControl = "targeted_cache_control"
+	keyCacheTagHeader       = "cache_tag_header"
+	keyStatusTTL            = "status_ttl"
+	keyPostCache            = "post_cache"
+	keyMinObjectSize        = "min_object_size"
+	keyMaxObjectSize        = "max_object_size"
+	keyMaxDiskSize          = "max_disk_size"
+	keyMaxDiskEntries       = "max_disk_entries"
+	keyEvictionPolicy       = "eviction_policy"
 )
 
 func init() {
@@ -78,19 +107,39 @@ func init() {
 
 // Config is the configuration for cache process
 type Config struct {
-	Type                   CacheType                `json:"type,omitempty"`
-	StatusHeader           string                   `json:"status_header,omitempty"`
-	DefaultMaxAge          time.Duration            `json:"default_max_age,omitempty"`
-	LockTimeout            time.Duration            `json:"lock_timeout,omitempty"`
-	RuleMatchersRaws       []RuleMatcherRawWithType `json:"rule_matcher_raws,omitempty"`
-	RuleMatchers           []RuleMatcher            `json:"-"`
-	MatchMethods           []string                 `json:"match_methods,omitempty"`
-	CacheBucketsNum        int                      `json:"cache_buckets_num,omitempty"`
-	CacheMaxMemorySize     int                      `json:"cache_max_memory_size,omitempty"`
-	Path                   string                   `json:"path,omitempty"`
-	CacheKeyTemplate       string                   `json:"cache_key_template,omitempty"`
-	RedisConnectionSetting string                   `json:"redis_connection_setting,omitempty"`
-	StaleMaxAge            time.Duration            `json:"stale_max_age,omitempty"`
+	Type                      CacheType                `json:"type,omitempty"`
+	StatusHeader              string                   `json:"status_header,omitempty"`
+	DefaultMaxAge             time.Duration            `json:"default_max_age,omitempty"`
+	LockTimeout               time.Duration            `json:"lock_timeout,omitempty"`
+	RuleMatchersRaws          []RuleMatcherRawWithType `json:"rule_matcher_raws,omitempty"`
+	RuleMatchers              []RuleMatcher            `json:"-"`
+	MatchMethods              []string                 `json:"match_methods,omitempty"`
+	CacheBucketsNum           int                      `json:"cache_buckets_num,omitempty"`
+	CacheMaxMemorySize        int                      `json:"cache_max_memory_size,omitempty"`
+	Path                      string                   `json:"path,omitempty"`
+	CacheKeyTemplate          string                   `json:"cache_key_template,omitempty"`
+	RedisConnectionSetting    string                   `json:"redis_connection_setting,omitempty"`
+	StaleMaxAge               time.Duration            `json:"stale_max_age,omitempty"`
+	StaleWhileRevalidate      time.Duration            `json:"stale_while_revalidate,omitempty"`
+	StaleIfError              time.Duration            `json:"stale_if_error,omitempty"`
+	RevalidateMaxAge          time.Duration            `json:"revalidate_max_age,omitempty"`
+	SliceSize                 int                      `json:"slice_size,omitempty"`
+	HeuristicFreshness        bool                     `json:"heuristic_freshness,omitempty"`
+	HeuristicFraction         float64                  `json:"heuristic_fraction,omitempty"`
+	HeuristicMaxAge           time.Duration            `json:"heuristic_max_age,omitempty"`
+	CacheStatus               string                   `json:"cache_status,omitempty"`
+	IgnoreRequestCacheControl []string                 `json:"ignore_request_cache_control,omitempty"`
+	NormalizeVary             map[string][]string      `json:"normalize_vary,omitempty"`
+	TargetedCacheControl      string                   `json:"targeted_cache_control,omitempty"`
+	CacheTagHeader            string                   `json:"cache_tag_header,omitempty"`
+	StatusTTL                 map[string]time.Duration `json:"status_ttl,omitempty"`
+	PostCache                 *PostCacheConfig         `json:"post_cache,omitempty"`
+	MinObjectSize             int                      `json:"min_object_size,omitempty"`
+	MaxObjectSize             int                      `json:"max_object_size,omitempty"`
+	MaxDiskSize               int                      `json:"max_disk_size,omitempty"`
+	MaxDiskEntries            int                      `json:"max_disk_entries,omitempty"`
+	EvictionPolicy            string                   `json:"eviction_policy,omitempty"`
+	Storage                   backends.Storage         `json:"-"`
 }
 
 func getDefaultConfig() *Config {
@@ -108,6 +157,12 @@ func getDefaultConfig() *Config {
 		CacheKeyTemplate:       defaultCacheKeyTemplate,
 		RedisConnectionSetting: defaultRedisConnectionSetting,
 		StaleMaxAge:            defaultStaleMaxAge,
+		StaleWhileRevalidate:   defaultStaleWhileRevalidate,
+		StaleIfError:           defaultStaleIfError,
+		RevalidateMaxAge:       defaultRevalidateMaxAge,
+		SliceSize:              defaultSliceSize,
+		HeuristicFraction:      defaultHeuristicFraction,
+		HeuristicMaxAge:        defaultHeuristicMaxAge,
 	}
 }
 
@@ -272,6 +327,30 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 				h.DistributedRaw = caddyconfig.JSONModuleObject(unm, "distributed", "consul", nil)
 
+			case keyStorage:
+				if len(args) != 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyStorage))
+				}
+				name := args[0]
+
+				mod, err := caddy.GetModule(backends.StorageNamespace + "." + name)
+				if err != nil {
+					return d.Errf("getting storage module '%s': '%v'", name, err)
+				}
+
+				unm, ok := mod.New().(caddyfile.Unmarshaler)
+				if !ok {
+					return d.Errf("storage module '%s' is not a Caddyfile unmarshaler", name)
+				}
+
+				err = unm.UnmarshalCaddyfile(d.NewFromNextSegment())
+				if err != nil {
+					return err
+				}
+
+				config.Type = CacheType(name)
+				h.StorageRaw = caddyconfig.JSONModuleObject(unm, "backend", name, nil)
+
 			case keyStaleMaxAge:
 				if len(args) != 1 {
 					return d.Err("Invalid usage of stale_max_age in cache config.")
@@ -283,6 +362,221 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				config.StaleMaxAge = duration
 
+			case keyStaleWhileRevalidate:
+				if len(args) != 1 {
+					return d.Err("Invalid usage of stale_while_revalidate in cache config.")
+				}
+
+				duration, err := time.ParseDuration(args[0])
+				if err != nil {
+					return d.Err(fmt.Sprintf("%s:%s, %s", keyStaleWhileRevalidate, "Invalid duration ", parameter))
+				}
+				config.StaleWhileRevalidate = duration
+
+			case keyStaleIfError:
+				if len(args) != 1 {
+					return d.Err("Invalid usage of stale_if_error in cache config.")
+				}
+
+				duration, err := time.ParseDuration(args[0])
+				if err != nil {
+					return d.Err(fmt.Sprintf("%s:%s, %s", keyStaleIfError, "Invalid duration ", parameter))
+				}
+				config.StaleIfError = duration
+
+			case keyRevalidateMaxAge:
+				if len(args) != 1 {
+					return d.Err("Invalid usage of revalidate_max_age in cache config.")
+				}
+
+				duration, err := time.ParseDuration(args[0])
+				if err != nil {
+					return d.Err(fmt.Sprintf("%s:%s, %s", keyRevalidateMaxAge, "Invalid duration ", parameter))
+				}
+				config.RevalidateMaxAge = duration
+
+			case keySliceSize:
+				if len(args) != 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keySliceSize))
+				}
+				num, err := strconv.Atoi(args[0])
+				if err != nil || num < 0 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s, it should be a non-negative number of bytes", keySliceSize))
+				}
+				config.SliceSize = num
+
+			case keyHeuristicFreshness:
+				// format: heuristic_freshness [fraction] [max_age]
+				if len(args) > 2 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyHeuristicFreshness))
+				}
+				config.HeuristicFreshness = true
+
+				if len(args) > 0 {
+					fraction, err := strconv.ParseFloat(args[0], 64)
+					if err != nil || fraction <= 0 {
+						return d.Err(fmt.Sprintf("Invalid usage of %s, the fraction should be a positive number", keyHeuristicFreshness))
+					}
+					config.HeuristicFraction = fraction
+				}
+
+				if len(args) > 1 {
+					duration, err := time.ParseDuration(args[1])
+					if err != nil {
+						return d.Err(fmt.Sprintf("%s:%s, %s", keyHeuristicFreshness, "Invalid duration ", args[1]))
+					}
+					config.HeuristicMaxAge = duration
+				}
+
+			case keyCacheStatus:
+				// format: cache_status [name]
+				if len(args) > 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyCacheStatus))
+				}
+				config.CacheStatus = defaultCacheStatusName
+				if len(args) == 1 {
+					config.CacheStatus = args[0]
+				}
+
+			case keyIgnoreRequestCC:
+				// all the directives are ignored when none is specified
+				if len(args) == 0 {
+					args = requestDirectiveNames
+				}
+
+				for _, directive := range args {
+					if !isRequestDirectiveName(directive) {
+						return d.Err(fmt.Sprintf("Invalid usage of %s, unsupported directive %s", keyIgnoreRequestCC, directive))
+					}
+				}
+				config.IgnoreRequestCacheControl = append(config.IgnoreRequestCacheControl, args...)
+
+			case keyNormalizeVary:
+				// format: normalize_vary header [args...]
+				// ex. normalize_vary Accept-Language en fr de
+				if len(args) < 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyNormalizeVary))
+				}
+
+				header := http.CanonicalHeaderKey(args[0])
+				if _, ok := varyNormalizers[header]; !ok {
+					return d.Err(fmt.Sprintf("Invalid usage of %s, unsupported header %s", keyNormalizeVary, args[0]))
+				}
+
+				if header == "Accept-Language" && len(args) < 2 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s, the languages should be specified for Accept-Language", keyNormalizeVary))
+				}
+
+				if config.NormalizeVary == nil {
+					config.NormalizeVary = map[string][]string{}
+				}
+				config.NormalizeVary[header] = args[1:]
+
+			case keyTargetedCacheControl:
+				if len(args) != 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyTargetedCacheControl))
+				}
+				config.TargetedCacheControl = args[0]
+
+			case keyCacheTagHeader:
+				if len(args) != 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyCacheTagHeader))
+				}
+				config.CacheTagHeader = args[0]
+
+			case keyStatusTTL:
+				// format: status_ttl code ttl
+				// ex. status_ttl 404 30s or status_ttl 5xx 5s
+				if len(args) != 2 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyStatusTTL))
+				}
+
+				if !isStatusCodeOrClass(args[0]) {
+					return d.Err(fmt.Sprintf("Invalid usage of %s, invalid status %s", keyStatusTTL, args[0]))
+				}
+
+				duration, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Err(fmt.Sprintf("%s:%s, %s", keyStatusTTL, "Invalid duration ", args[1]))
+				}
+
+				if config.StatusTTL == nil {
+					config.StatusTTL = map[string]time.Duration{}
+				}
+				config.StatusTTL[args[0]] = duration
+
+			case keyPostCache:
+				// format:
+				// post_cache {
+				//     max_body_size 65536
+				//     canonical_json
+				//     graphql
+				// }
+				if len(args) != 0 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", keyPostCache))
+				}
+
+				postCache := &PostCacheConfig{MaxBodySize: defaultPostCacheMaxBodySize}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					subParameter := d.Val()
+					subArgs := d.RemainingArgs()
+
+					switch subParameter {
+					case "max_body_size":
+						if len(subArgs) != 1 {
+							return d.Err(fmt.Sprintf("Invalid usage of %s max_body_size in cache config.", keyPostCache))
+						}
+						size, err := strconv.ParseInt(subArgs[0], 10, 64)
+						if err != nil || size <= 0 {
+							return d.Err(fmt.Sprintf("Invalid usage of %s, max_body_size should be a positive number of bytes", keyPostCache))
+						}
+						postCache.MaxBodySize = size
+					case "canonical_json":
+						postCache.CanonicalJSON = true
+					case "graphql":
+						postCache.GraphQL = true
+					default:
+						return d.Err(fmt.Sprintf("Unknown %s parameter: %s", keyPostCache, subParameter))
+					}
+				}
+				config.PostCache = postCache
+
+			case keyMinObjectSize, keyMaxObjectSize:
+				if len(args) != 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", parameter))
+				}
+				num, err := strconv.Atoi(args[0])
+				if err != nil || num < 0 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s, it should be a non-negative number of bytes", parameter))
+				}
+
+				if parameter == keyMinObjectSize {
+					config.MinObjectSize = num
+				} else {
+					config.MaxObjectSize = num
+				}
+
+			case keyMaxDiskSize, keyMaxDiskEntries:
+				if len(args) != 1 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s in cache config.", parameter))
+				}
+				num, err := strconv.Atoi(args[0])
+				if err != nil || num < 0 {
+					return d.Err(fmt.Sprintf("Invalid usage of %s, it should be a non-negative number", parameter))
+				}
+
+				if parameter == keyMaxDiskSize {
+					config.MaxDiskSize = num
+				} else {
+					config.MaxDiskEntries = num
+				}
+
+			case keyEvictionPolicy:
+				if len(args) != 1 || (args[0] != evictLRU && args[0] != evictLFU) {
+					return d.Err(fmt.Sprintf("Invalid usage of %s, it should be %s or %s", keyEvictionPolicy, evictLRU, evictLFU))
+				}
+				config.EvictionPolicy = args[0]
+
 			default:
 				return d.Err("Unknown cache parameter: " + parameter)
 			}
@@ -294,6 +588,21 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// isStatusCodeOrClass checks the status is a code (ex. 404) or a class
+// (ex. 5xx)
+func isStatusCodeOrClass(status string) bool {
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return false
+	}
+
+	if status[1:] == "xx" {
+		return true
+	}
+
+	_, err := strconv.Atoi(status)
+	return err == nil
+}
+
 // Interface guards
 var (
 	_ caddyfile.Unmarshaler = (*Handler)(nil)
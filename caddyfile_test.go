@@ -2,6 +2,7 @@ package httpcache
 
 import (
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
@@ -114,6 +115,408 @@ func (suite *CaddyfileTestSuite) TestDistributedCacheConfig() {
 	suite.Nil(err)
 }
 
+func (suite *CaddyfileTestSuite) TestStorage() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			storage redis {
+				addr redis:6379
+				db 1
+			}
+			status_header X-Status
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	mh := handler.(*Handler)
+	suite.Equal(redis, mh.Config.Type)
+	suite.Equal("X-Status", mh.Config.StatusHeader)
+	suite.JSONEq(`{"backend": "redis", "addr": "redis:6379", "db": 1}`, string(mh.StorageRaw))
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			storage rocks
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "unknown storage module")
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			storage file {
+				size 1
+			}
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "unrecognized subdirective")
+}
+
+func (suite *CaddyfileTestSuite) TestStaleWhileRevalidate() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			stale_while_revalidate 30s
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(30*time.Second, handler.(*Handler).Config.StaleWhileRevalidate)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			stale_while_revalidate soon
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "invalid duration")
+}
+
+func (suite *CaddyfileTestSuite) TestRevalidateMaxAge() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			revalidate_max_age 10m
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(10*time.Minute, handler.(*Handler).Config.RevalidateMaxAge)
+	suite.Equal(defaultRevalidateMaxAge, getDefaultConfig().RevalidateMaxAge)
+}
+
+func (suite *CaddyfileTestSuite) TestSliceSize() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			slice_size 1048576
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(MB, handler.(*Handler).Config.SliceSize)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			slice_size -1
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "it should be a non-negative number")
+}
+
+func (suite *CaddyfileTestSuite) TestObjectSize() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			min_object_size 1024
+			max_object_size 1048576
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(KB, handler.(*Handler).Config.MinObjectSize)
+	suite.Equal(MB, handler.(*Handler).Config.MaxObjectSize)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			max_object_size 1MB
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "it should be a number of bytes")
+}
+
+func (suite *CaddyfileTestSuite) TestDiskLimits() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			max_disk_size 1048576
+			max_disk_entries 100
+			eviction_policy lfu
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	config := handler.(*Handler).Config
+	suite.Equal(MB, config.MaxDiskSize)
+	suite.Equal(100, config.MaxDiskEntries)
+	suite.Equal(evictLFU, config.EvictionPolicy)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			eviction_policy fifo
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "it should be lru or lfu")
+}
+
+func (suite *CaddyfileTestSuite) TestHeuristicFreshness() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			heuristic_freshness 0.2 1h
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	config := handler.(*Handler).Config
+	suite.True(config.HeuristicFreshness)
+	suite.Equal(0.2, config.HeuristicFraction)
+	suite.Equal(time.Hour, config.HeuristicMaxAge)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			heuristic_freshness
+		}
+		`),
+	}
+
+	handler, err = parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(defaultHeuristicFraction, handler.(*Handler).Config.HeuristicFraction)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			heuristic_freshness -1
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "the fraction should be a positive number")
+}
+
+func (suite *CaddyfileTestSuite) TestCacheStatus() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			cache_status
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(defaultCacheStatusName, handler.(*Handler).Config.CacheStatus)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			cache_status edge-1
+		}
+		`),
+	}
+
+	handler, err = parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal("edge-1", handler.(*Handler).Config.CacheStatus)
+}
+
+func (suite *CaddyfileTestSuite) TestIgnoreRequestCacheControl() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			ignore_request_cache_control no-cache max-age
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal([]string{"no-cache", "max-age"}, handler.(*Handler).Config.IgnoreRequestCacheControl)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			ignore_request_cache_control
+		}
+		`),
+	}
+
+	handler, err = parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(requestDirectiveNames, handler.(*Handler).Config.IgnoreRequestCacheControl)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			ignore_request_cache_control no-store
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "unsupported directive")
+}
+
+func (suite *CaddyfileTestSuite) TestNormalizeVary() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			normalize_vary accept-encoding
+			normalize_vary Accept-Language en fr
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(map[string][]string{
+		"Accept-Encoding": {},
+		"Accept-Language": {"en", "fr"},
+	}, handler.(*Handler).Config.NormalizeVary)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			normalize_vary Cookie
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "unsupported header")
+}
+
+func (suite *CaddyfileTestSuite) TestTargetedCacheControl() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			targeted_cache_control Cdp-Cache-Control
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal("Cdp-Cache-Control", handler.(*Handler).Config.TargetedCacheControl)
+}
+
+func (suite *CaddyfileTestSuite) TestCacheTagHeader() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			cache_tag_header Cache-Tag
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal("Cache-Tag", handler.(*Handler).Config.CacheTagHeader)
+}
+
+func (suite *CaddyfileTestSuite) TestStatusTTL() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			status_ttl 404 30s
+			status_ttl 5xx 5s
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(map[string]time.Duration{
+		"404": 30 * time.Second,
+		"5xx": 5 * time.Second,
+	}, handler.(*Handler).Config.StatusTTL)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			status_ttl 4x4 30s
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "invalid status")
+}
+
+func (suite *CaddyfileTestSuite) TestPostCache() {
+	h := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			post_cache {
+				max_body_size 1024
+				canonical_json
+				graphql
+			}
+			status_header X-Status
+		}
+		`),
+	}
+
+	handler, err := parseCaddyfile(h)
+	suite.Nil(err)
+	config := handler.(*Handler).Config
+	suite.Equal(&PostCacheConfig{MaxBodySize: 1024, CanonicalJSON: true, GraphQL: true}, config.PostCache)
+	suite.Equal("X-Status", config.StatusHeader)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			post_cache
+		}
+		`),
+	}
+
+	handler, err = parseCaddyfile(h)
+	suite.Nil(err)
+	suite.Equal(defaultPostCacheMaxBodySize, handler.(*Handler).Config.PostCache.MaxBodySize)
+
+	h = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+		http_cache {
+			post_cache {
+				ttl 1s
+			}
+		}
+		`),
+	}
+
+	_, err = parseCaddyfile(h)
+	suite.Error(err, "unknown parameter")
+}
+
 func TestCaddyfileTestSuite(t *testing.T) {
 	suite.Run(t, new(CaddyfileTestSuite))
 }
@@ -0,0 +1,78 @@
+package httpcache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isNotModified evaluates the client's conditional headers against the
+// validators of the cached response.
+// https://httpwg.org/specs/rfc7232.html#precedence
+func isNotModified(r *http.Request, header http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-Modified-Since is ignored when If-None-Match is present
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagWeakMatchAny(inm, header.Get("ETag"))
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	// the precision of the http date is second
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// etagWeakMatchAny reports whether the etag matches one of the entity tags
+// listed in the If-None-Match header with the weak comparison.
+func etagWeakMatchAny(ifNoneMatch string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if trimWeakPrefix(strings.TrimSpace(candidate)) == trimWeakPrefix(etag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func trimWeakPrefix(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+// writeNotModified writes the 304 response without the representation
+// metadata which only describes the body.
+// https://httpwg.org/specs/rfc7232.html#status.304
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	if h.Get("ETag") != "" {
+		h.Del("Last-Modified")
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+}
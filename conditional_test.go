@@ -0,0 +1,83 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ConditionalTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ConditionalTestSuite) TestIfNoneMatch() {
+	header := makeHeader("ETag", `"v1"`)
+
+	tests := []struct {
+		ifNoneMatch string
+		notModified bool
+	}{
+		{`"v1"`, true},
+		{`W/"v1"`, true},
+		{`"v0", "v1"`, true},
+		{`*`, true},
+		{`"v2"`, false},
+	}
+
+	for _, test := range tests {
+		req := makeRequest("/", makeHeader("If-None-Match", test.ifNoneMatch))
+		suite.Equal(test.notModified, isNotModified(req, header), test.ifNoneMatch)
+	}
+}
+
+func (suite *ConditionalTestSuite) TestIfModifiedSince() {
+	header := makeHeader("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+
+	tests := []struct {
+		ifModifiedSince string
+		notModified     bool
+	}{
+		{"Wed, 21 Oct 2015 07:28:00 GMT", true},
+		{"Thu, 22 Oct 2015 07:28:00 GMT", true},
+		{"Tue, 20 Oct 2015 07:28:00 GMT", false},
+		{"invalid date", false},
+	}
+
+	for _, test := range tests {
+		req := makeRequest("/", makeHeader("If-Modified-Since", test.ifModifiedSince))
+		suite.Equal(test.notModified, isNotModified(req, header), test.ifModifiedSince)
+	}
+}
+
+func (suite *ConditionalTestSuite) TestIfNoneMatchTakesPrecedence() {
+	header := http.Header{
+		"Etag":          []string{`"v1"`},
+		"Last-Modified": []string{"Wed, 21 Oct 2015 07:28:00 GMT"},
+	}
+	req := makeRequest("/", http.Header{
+		"If-None-Match":     []string{`"v2"`},
+		"If-Modified-Since": []string{"Wed, 21 Oct 2015 07:28:00 GMT"},
+	})
+	suite.False(isNotModified(req, header))
+}
+
+func (suite *ConditionalTestSuite) TestWriteNotModified() {
+	rw := httptest.NewRecorder()
+	rw.Header().Set("Content-Length", "18")
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Header().Set("ETag", `"v1"`)
+	rw.Header().Set("Cache-Control", "max-age=60")
+
+	writeNotModified(rw)
+	suite.Equal(http.StatusNotModified, rw.Code)
+	suite.Equal("", rw.Header().Get("Content-Length"))
+	suite.Equal("", rw.Header().Get("Content-Type"))
+	suite.Equal(`"v1"`, rw.Header().Get("ETag"))
+	suite.Equal("max-age=60", rw.Header().Get("Cache-Control"))
+}
+
+func TestConditionalTestSuite(t *testing.T) {
+	suite.Run(t, new(ConditionalTestSuite))
+}
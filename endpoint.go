@@ -42,10 +42,17 @@ type cachePurge struct{}
 //	   "hots": "example.com",
 //	   "uri": "/static?ext=txt",
 //	}
+//
+// The entries can be purged by their cache tags instead.
+//
+//	{
+//	   "tags": ["article-42", "home"]
+//	}
 type PurgePayload struct {
-	Method string `json:"method"`
-	Host   string `json:"host"`
-	URI    string `json:"uri"`
+	Method string   `json:"method"`
+	Host   string   `json:"host"`
+	URI    string   `json:"uri"`
+	Tags   []string `json:"tags"`
 	path   string
 	query  string
 }
@@ -109,6 +116,17 @@ func (cachePurge) Purge(cacheHandler *HTTPCache, conds string) error {
 	return nil
 }
 
+// PurgeTags deletes the cache carrying any of the tags
+func (cachePurge) PurgeTags(cacheHandler *HTTPCache, tags []string) error {
+	for _, tag := range tags {
+		if err := cacheHandler.DelByTag(tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Routes return a route for the /purge endpoint
 func (c cachePurge) Routes() []caddy.AdminRoute {
 	return []caddy.AdminRoute{
@@ -163,6 +181,8 @@ func (c cachePurge) handleCacheEndpoints(w http.ResponseWriter, r *http.Request)
 	switch path {
 	case "/caches/":
 		return c.handleListCacheKeys(w, r)
+	case "/caches/expiry":
+		return c.handleExpiry(w, r)
 	default:
 		return c.handleShowCache(w, r)
 	}
@@ -192,6 +212,27 @@ func (c cachePurge) handleListCacheKeys(w http.ResponseWriter, r *http.Request)
 	return nil
 }
 
+// ExpiryPayload holds the state of the expiry scheduler
+type ExpiryPayload struct {
+	Pending int `json:"pending"`
+}
+
+func (c cachePurge) handleExpiry(w http.ResponseWriter, r *http.Request) error {
+
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	cache := getHandlerCache()
+	payload := ExpiryPayload{Pending: cache.PendingExpiry()}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(payload)
+}
+
 // handlePurge purges the cache matched the provided conditions
 func (c cachePurge) handlePurge(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodDelete {
@@ -222,6 +263,10 @@ func (c cachePurge) handlePurge(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if len(payload.Tags) > 0 {
+		return c.PurgeTags(getHandlerCache(), payload.Tags)
+	}
+
 	payload.transform()
 
 	purgeRepl.Set("http.request.method", payload.Method)
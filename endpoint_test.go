@@ -2,6 +2,7 @@ package httpcache
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -64,11 +65,16 @@ func (suite *CacheEndpointTestSuite) SetupSuite() {
 
 		http_cache {
 			cache_type in_memory
+			cache_tag_header Surrogate-Key
 		}
 
 	}
 
 	:9988 {
+		header /tagged Surrogate-Key "article-42 home"
+		respond /tagged 200 {
+			body "tagged"
+		}
 		respond /hello 200 {
 			body "hope anything will be good"
 		}
@@ -103,6 +109,27 @@ func (suite *CacheEndpointTestSuite) TestHealthCheck() {
 	suite.Assert().NoError(err)
 }
 
+func (suite *CacheEndpointTestSuite) TestPendingExpiry() {
+	r, err := http.NewRequest("GET", suite.url, nil)
+	suite.Assert().NoError(err)
+
+	_, err = suite.caddyTester.Client.Do(r)
+	suite.Assert().NoError(err)
+	// create the cache first
+
+	r, err = http.NewRequest("GET", suite.admin_url+"/caches/expiry", nil)
+	suite.Assert().NoError(err)
+
+	res, err := suite.caddyTester.Client.Do(r)
+	suite.Assert().NoError(err)
+
+	payload := ExpiryPayload{}
+	err = json.NewDecoder(res.Body).Decode(&payload)
+	res.Body.Close()
+	suite.Assert().NoError(err)
+	suite.Greater(payload.Pending, 0)
+}
+
 func (suite *CacheEndpointTestSuite) TestShowCache() {
 	r, err := http.NewRequest("GET", suite.url, nil)
 	suite.Assert().NoError(err)
@@ -182,6 +209,31 @@ func (suite *CacheEndpointTestSuite) TestPurgeCache() {
 
 }
 
+func (suite *CacheEndpointTestSuite) TestPurgeCacheByTags() {
+	r, err := http.NewRequest("GET", "http://localhost:9898/tagged", nil)
+	suite.Assert().NoError(err)
+
+	res, err := suite.caddyTester.Client.Do(r)
+	suite.Assert().NoError(err)
+	res.Body.Close()
+	suite.Equal("", res.Header.Get("Surrogate-Key"), "the tag header should be removed")
+
+	cache = getHandlerCache()
+	suite.assertKeyIn("GET localhost/tagged?", cache.Keys())
+
+	body := []byte(`{"tags": ["article-42"]}`)
+	r, err = http.NewRequest("DELETE", suite.admin_url+"/caches/purge", bytes.NewBuffer(body))
+	suite.Assert().NoError(err)
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err = suite.caddyTester.Client.Do(r)
+	suite.Assert().NoError(err)
+	suite.Equal(200, res.StatusCode)
+
+	suite.assertKeyNotIn("GET localhost/tagged?", cache.Keys())
+	suite.Empty(cache.KeysByTag("home"))
+}
+
 func TestCacheEndpotingTestSuite(t *testing.T) {
 	suite.Run(t, new(CacheEndpointTestSuite))
 }
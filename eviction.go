@@ -0,0 +1,226 @@
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/sillygod/cdp-cache/backends"
+)
+
+const (
+	evictLRU = "lru"
+	evictLFU = "lfu"
+)
+
+// diskUsage tracks the sizes and the accesses of the entries stored on the
+// disk so the entries can be evicted when the limits are exceeded.
+type diskUsage struct {
+	lock    sync.Mutex
+	size    int64
+	order   *list.List // the most recently used entry is at the front
+	freqs   *list.List // the frequencies in the ascending order of the hits
+	records map[*Entry]*usageRecord
+}
+
+// frequency holds the entries of the same hits. The most recently used
+// entry is at the front.
+type frequency struct {
+	hits    int
+	entries *list.List
+}
+
+type usageRecord struct {
+	size    int64
+	hits    int
+	element *list.Element // in the order
+	freq    *list.Element // in the frequencies
+	freqAt  *list.Element // in the frequency's entries
+}
+
+func newDiskUsage() *diskUsage {
+	return &diskUsage{
+		order:   list.New(),
+		freqs:   list.New(),
+		records: make(map[*Entry]*usageRecord),
+	}
+}
+
+// add starts tracking the entry. Its size is unknown until the body is
+// completely written.
+func (d *diskUsage) add(entry *Entry) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.records[entry]; ok {
+		return
+	}
+
+	freq := d.freqs.Front()
+	if freq == nil || freq.Value.(*frequency).hits != 0 {
+		freq = d.freqs.PushFront(&frequency{entries: list.New()})
+	}
+
+	d.records[entry] = &usageRecord{
+		element: d.order.PushFront(entry),
+		freq:    freq,
+		freqAt:  freq.Value.(*frequency).entries.PushFront(entry),
+	}
+}
+
+// setSize records the size of the entry's body
+func (d *diskUsage) setSize(entry *Entry, size int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	record, ok := d.records[entry]
+	if !ok {
+		return
+	}
+
+	d.size += size - record.size
+	record.size = size
+}
+
+// touch records an access of the entry
+func (d *diskUsage) touch(entry *Entry) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	record, ok := d.records[entry]
+	if !ok {
+		return
+	}
+
+	record.hits++
+	d.order.MoveToFront(record.element)
+
+	// move the entry to the frequency of its new hits
+	next := record.freq.Next()
+	if next == nil || next.Value.(*frequency).hits != record.hits {
+		next = d.freqs.InsertAfter(&frequency{hits: record.hits, entries: list.New()}, record.freq)
+	}
+
+	d.leaveFrequency(record)
+	record.freq = next
+	record.freqAt = next.Value.(*frequency).entries.PushFront(entry)
+}
+
+// leaveFrequency removes the entry from its frequency which is dropped when
+// it's empty
+func (d *diskUsage) leaveFrequency(record *usageRecord) {
+	entries := record.freq.Value.(*frequency).entries
+	entries.Remove(record.freqAt)
+	if entries.Len() == 0 {
+		d.freqs.Remove(record.freq)
+	}
+}
+
+// remove stops tracking the entry
+func (d *diskUsage) remove(entry *Entry) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	record, ok := d.records[entry]
+	if !ok {
+		return
+	}
+
+	d.size -= record.size
+	d.order.Remove(record.element)
+	d.leaveFrequency(record)
+	delete(d.records, entry)
+}
+
+// total returns the size and the number of the tracked entries
+func (d *diskUsage) total() (int64, int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.size, len(d.records)
+}
+
+// victim returns the entry to evict when the limits are exceeded. The least
+// recently used one is chosen by lru and the least frequently used one by lfu
+// with the ties broken by the recency. The newly stored entry is spared unless
+// it's the only one so that it isn't evicted before being used.
+func (d *diskUsage) victim(config *Config, newEntry *Entry) (*Entry, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	overSize := config.MaxDiskSize > 0 && d.size > int64(config.MaxDiskSize)
+	overCount := config.MaxDiskEntries > 0 && len(d.records) > config.MaxDiskEntries
+	if !overSize && !overCount {
+		return nil, false
+	}
+
+	// only the new entry is skipped so it's found in a few steps
+	if config.EvictionPolicy == evictLFU {
+		for f := d.freqs.Front(); f != nil; f = f.Next() {
+			for e := f.Value.(*frequency).entries.Back(); e != nil; e = e.Prev() {
+				if entry := e.Value.(*Entry); entry != newEntry {
+					return entry, true
+				}
+			}
+		}
+	} else {
+		for e := d.order.Back(); e != nil; e = e.Prev() {
+			if entry := e.Value.(*Entry); entry != newEntry {
+				return entry, true
+			}
+		}
+	}
+
+	_, ok := d.records[newEntry]
+	return newEntry, ok
+}
+
+// hasDiskLimits tells whether the entries should be evicted by the limits
+func hasDiskLimits(config *Config) bool {
+	return (config.MaxDiskSize > 0 || config.MaxDiskEntries > 0) && isOnDisk(config)
+}
+
+// isOnDisk tells whether the storage keeps the contents on the local disk
+func isOnDisk(config *Config) bool {
+	if config.Storage != nil {
+		disk, ok := config.Storage.(backends.DiskStorage)
+		return ok && disk.OnDisk()
+	}
+
+	return config.Type == file || config.Type == bolt
+}
+
+// trackDiskUsage tracks the entry stored on the disk
+func (h *HTTPCache) trackDiskUsage(entry *Entry, config *Config) {
+	if !hasDiskLimits(config) {
+		return
+	}
+
+	h.disk.add(entry)
+	h.evict(config, entry)
+}
+
+// recordDiskSize records the size of the entry's body which is completely
+// written and evicts the other entries if needed.
+func (h *HTTPCache) recordDiskSize(entry *Entry, config *Config) {
+	if !hasDiskLimits(config) {
+		return
+	}
+
+	h.disk.setSize(entry, int64(entry.Response.body.Length()))
+	h.evict(config, entry)
+}
+
+// evict removes the entries until the usage is within the limits. The files
+// are removed once the readers still streaming them are finished.
+func (h *HTTPCache) evict(config *Config, newEntry *Entry) {
+	for {
+		entry, ok := h.disk.victim(config, newEntry)
+		if !ok {
+			return
+		}
+
+		h.disk.remove(entry)
+		if h.removeEntry(entry) {
+			go entry.Clean()
+		}
+	}
+}
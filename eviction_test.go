@@ -0,0 +1,185 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sillygod/cdp-cache/backends"
+	"github.com/stretchr/testify/suite"
+)
+
+type EvictionTestSuite struct {
+	suite.Suite
+	config *Config
+	cache  *HTTPCache
+}
+
+func (suite *EvictionTestSuite) SetupTest() {
+	suite.config = getDefaultConfig()
+	suite.config.Path = "/tmp/caddy-cache-eviction"
+	suite.config.MaxDiskSize = 10
+	useTypedStorage(suite.config)
+
+	suite.cache = NewHTTPCache(suite.config, false)
+	// track only the entries of this suite
+	suite.cache.disk = newDiskUsage()
+}
+
+// put stores an entry whose body is the content in the file backend
+func (suite *EvictionTestSuite) put(key string, content string) *Entry {
+	req := makeRequest("/", http.Header{})
+	res := makeResponse(200, makeHeader("Cache-Control", "max-age=60"))
+	entry := NewEntry(key, req, res, suite.config)
+	suite.Nil(entry.setBackend(req.Context(), suite.config))
+
+	suite.cache.Put(req, entry, suite.config)
+	res.Write([]byte(content))
+	res.Close()
+	return entry
+}
+
+func (suite *EvictionTestSuite) exists(key string) bool {
+	_, exists := suite.cache.Get(key, makeRequest("/", http.Header{}), false)
+	return exists
+}
+
+// settle waits the sizes of the entries to be recorded
+func (suite *EvictionTestSuite) settle(size int64, count int) {
+	suite.Eventually(func() bool {
+		total, n := suite.cache.disk.total()
+		return total == size && n == count
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *EvictionTestSuite) TestEvictLRUBySize() {
+	suite.put("evict-a", "aaaa")
+	suite.put("evict-b", "bbbb")
+	suite.settle(8, 2)
+
+	// a is used recently so b is the least recently used one
+	suite.True(suite.exists("evict-a"))
+
+	suite.put("evict-c", "cccc")
+	suite.settle(8, 2)
+	suite.True(suite.exists("evict-a"))
+	suite.False(suite.exists("evict-b"))
+	suite.True(suite.exists("evict-c"))
+}
+
+func (suite *EvictionTestSuite) TestEvictLFUByCount() {
+	suite.config.MaxDiskSize = 0
+	suite.config.MaxDiskEntries = 2
+	suite.config.EvictionPolicy = evictLFU
+
+	suite.put("lfu-a", "a")
+	suite.put("lfu-b", "b")
+	suite.settle(2, 2)
+
+	suite.True(suite.exists("lfu-a"))
+	suite.True(suite.exists("lfu-a"))
+	suite.True(suite.exists("lfu-b"))
+
+	// b is used most recently but less frequently than a
+	suite.put("lfu-c", "c")
+	suite.settle(2, 2)
+	suite.True(suite.exists("lfu-a"))
+	suite.False(suite.exists("lfu-b"))
+}
+
+func (suite *EvictionTestSuite) TestEvictOversizedEntry() {
+	suite.put("oversized", "rain cats and dogs")
+	suite.settle(0, 0)
+	suite.False(suite.exists("oversized"), "the entry larger than the limit should not be kept")
+}
+
+func (suite *EvictionTestSuite) TestEvictWhileReading() {
+	entry := suite.put("reading-a", "aaaa")
+	suite.settle(4, 1)
+
+	reader, err := entry.Response.GetReader()
+	suite.Nil(err)
+
+	suite.put("reading-b", "bbbbbbbb")
+	suite.settle(8, 1)
+	suite.False(suite.exists("reading-a"))
+
+	// the evicted content is still readable until the reader is closed
+	buf := make([]byte, 4)
+	n, err := reader.Read(buf)
+	suite.Nil(err)
+	suite.Equal("aaaa", string(buf[:n]))
+	suite.Nil(reader.Close())
+}
+
+func (suite *EvictionTestSuite) TestNoLimitsForOtherBackends() {
+	config := getDefaultConfig()
+	config.Type = inMemory
+	config.MaxDiskEntries = 1
+	suite.False(hasDiskLimits(config))
+
+	config.Type = file
+	suite.True(hasDiskLimits(config))
+	config.Type = bolt
+	suite.True(hasDiskLimits(config))
+	suite.False(hasDiskLimits(getDefaultConfig()))
+
+	// the provisioned storage decides it rather than the type
+	config.Storage = &backends.InMemoryStorage{}
+	suite.False(hasDiskLimits(config))
+	config.Storage = &backends.FileStorage{}
+	suite.True(hasDiskLimits(config))
+}
+
+func (suite *EvictionTestSuite) TestLFUVictim() {
+	config := getDefaultConfig()
+	config.MaxDiskEntries = 2
+	config.EvictionPolicy = evictLFU
+
+	usage := newDiskUsage()
+	a, b, c := &Entry{}, &Entry{}, &Entry{}
+	usage.add(a)
+	usage.add(b)
+	usage.touch(a)
+	usage.touch(b)
+	usage.touch(a)
+
+	victim, ok := usage.victim(config, nil)
+	suite.False(ok, "no entry should be evicted within the limits")
+	suite.Nil(victim)
+
+	// c is spared although it's the least frequently used one
+	usage.add(c)
+	victim, _ = usage.victim(config, c)
+	suite.Same(b, victim)
+
+	usage.touch(c)
+	usage.touch(c)
+	victim, _ = usage.victim(config, nil)
+	suite.Same(b, victim)
+
+	// the least recently used one is chosen among the same hits
+	usage.touch(b)
+	victim, _ = usage.victim(config, nil)
+	suite.Same(a, victim)
+
+	usage.remove(c)
+	usage.remove(b)
+	usage.add(c)
+	victim, ok = usage.victim(config, c)
+	suite.False(ok)
+
+	config.MaxDiskEntries = 1
+	victim, _ = usage.victim(config, c)
+	suite.Same(a, victim)
+	usage.remove(a)
+	victim, ok = usage.victim(config, c)
+	suite.False(ok)
+	usage.add(b)
+	victim, _ = usage.victim(config, c)
+	suite.Same(b, victim)
+}
+
+func TestEvictionTestSuite(t *testing.T) {
+	suite.Run(t, new(EvictionTestSuite))
+}
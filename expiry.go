@@ -0,0 +1,157 @@
+package httpcache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryItem is an entry waiting to be expired in the scheduler
+type expiryItem struct {
+	entry  *Entry
+	at     time.Time
+	expire func()
+	index  int
+}
+
+// expiryQueue is a min-heap of the items ordered by their expiration
+type expiryQueue []*expiryItem
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// expiryScheduler expires the entries at their expiration with a single
+// timer instead of a sleeping goroutine for each entry.
+type expiryScheduler struct {
+	lock  sync.Mutex
+	queue expiryQueue
+	items map[*Entry]*expiryItem
+	wake  chan struct{}
+}
+
+func newExpiryScheduler() *expiryScheduler {
+	s := &expiryScheduler{
+		items: make(map[*Entry]*expiryItem),
+		wake:  make(chan struct{}, 1),
+	}
+
+	go s.run()
+	return s
+}
+
+// schedule calls the expire func at the time. The entry already scheduled is
+// rescheduled.
+func (s *expiryScheduler) schedule(entry *Entry, at time.Time, expire func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if item, ok := s.items[entry]; ok {
+		item.at = at
+		item.expire = expire
+		heap.Fix(&s.queue, item.index)
+	} else {
+		item := &expiryItem{entry: entry, at: at, expire: expire}
+		heap.Push(&s.queue, item)
+		s.items[entry] = item
+	}
+
+	s.notify()
+}
+
+// cancel stops the entry from being expired
+func (s *expiryScheduler) cancel(entry *Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item, ok := s.items[entry]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&s.queue, item.index)
+	delete(s.items, entry)
+}
+
+// pending returns the number of the entries waiting to be expired
+func (s *expiryScheduler) pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.items)
+}
+
+func (s *expiryScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// popExpired removes the expired items and returns the duration until the
+// next expiration
+func (s *expiryScheduler) popExpired(now time.Time) ([]*expiryItem, time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var expired []*expiryItem
+	for len(s.queue) > 0 && !s.queue[0].at.After(now) {
+		item := heap.Pop(&s.queue).(*expiryItem)
+		delete(s.items, item.entry)
+		expired = append(expired, item)
+	}
+
+	if len(s.queue) == 0 {
+		return expired, 0, false
+	}
+
+	return expired, s.queue[0].at.Sub(now), true
+}
+
+func (s *expiryScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		expired, next, ok := s.popExpired(time.Now())
+		for _, item := range expired {
+			// cleaning an entry may wait for its readers
+			go item.expire()
+		}
+
+		if ok {
+			timer.Reset(next)
+		}
+
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
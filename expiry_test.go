@@ -0,0 +1,117 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ExpiryTestSuite struct {
+	suite.Suite
+	scheduler *expiryScheduler
+}
+
+func (suite *ExpiryTestSuite) SetupTest() {
+	suite.scheduler = newExpiryScheduler()
+}
+
+func (suite *ExpiryTestSuite) TestExpireInOrder() {
+	expired := make(chan int, 3)
+	now := time.Now()
+
+	for i, delay := range []time.Duration{30, 10, 20} {
+		i := i
+		suite.scheduler.schedule(&Entry{}, now.Add(delay*time.Millisecond), func() { expired <- i })
+	}
+	suite.Equal(3, suite.scheduler.pending())
+
+	for _, want := range []int{1, 2, 0} {
+		select {
+		case got := <-expired:
+			suite.Equal(want, got)
+		case <-time.After(time.Second):
+			suite.FailNow("the entry is not expired")
+		}
+	}
+
+	suite.Equal(0, suite.scheduler.pending())
+}
+
+func (suite *ExpiryTestSuite) TestCancel() {
+	expired := make(chan struct{}, 1)
+	entry := &Entry{}
+
+	suite.scheduler.schedule(entry, time.Now().Add(20*time.Millisecond), func() { expired <- struct{}{} })
+	suite.scheduler.cancel(entry)
+	suite.Equal(0, suite.scheduler.pending())
+
+	select {
+	case <-expired:
+		suite.Fail("the canceled entry should not be expired")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (suite *ExpiryTestSuite) TestReschedule() {
+	expired := make(chan time.Time, 1)
+	entry := &Entry{}
+	start := time.Now()
+
+	suite.scheduler.schedule(entry, start.Add(10*time.Millisecond), func() { expired <- time.Now() })
+	suite.scheduler.schedule(entry, start.Add(50*time.Millisecond), func() { expired <- time.Now() })
+	suite.Equal(1, suite.scheduler.pending())
+
+	select {
+	case at := <-expired:
+		suite.GreaterOrEqual(at.Sub(start), 50*time.Millisecond)
+	case <-time.After(time.Second):
+		suite.FailNow("the entry is not expired")
+	}
+}
+
+func (suite *ExpiryTestSuite) TestCleanExpiredEntry() {
+	config := getDefaultConfig()
+	config.Type = inMemory
+	cache := NewHTTPCache(config, false)
+	cache.expiry = suite.scheduler
+
+	req := makeRequest("/", http.Header{})
+	entry := NewEntry("expiry-clean", req, makeResponse(200, makeHeader("Cache-Control", "max-age=60")), config)
+	cache.Put(req, entry, config)
+	suite.Equal(1, cache.PendingExpiry())
+
+	// the replaced entry is not pending anymore
+	replacement := NewEntry("expiry-clean", req, makeResponse(200, makeHeader("Cache-Control", "max-age=60")), config)
+	replacement.expiration = time.Now().Add(20 * time.Millisecond)
+	cache.Put(req, replacement, config)
+	suite.Equal(1, cache.PendingExpiry())
+
+	suite.Eventually(func() bool {
+		_, exists := cache.Get("expiry-clean", req, true)
+		return !exists
+	}, time.Second, 10*time.Millisecond)
+	suite.Equal(0, cache.PendingExpiry())
+}
+
+func (suite *ExpiryTestSuite) TestRefreshPurgedEntry() {
+	config := getDefaultConfig()
+	config.Type = inMemory
+	cache := NewHTTPCache(config, false)
+	cache.expiry = suite.scheduler
+
+	req := makeRequest("/", http.Header{})
+	entry := NewEntry("expiry-refresh-purged", req, makeResponse(200, makeHeader("Cache-Control", "max-age=60")), config)
+	cache.Put(req, entry, config)
+	suite.Nil(cache.Del("expiry-refresh-purged"))
+	suite.Equal(0, cache.PendingExpiry())
+
+	// the entry purged while being revalidated is served but not rescheduled
+	suite.True(cache.refresh(entry, makeResponse(304, makeHeader("Cache-Control", "max-age=60")), config))
+	suite.Equal(0, cache.PendingExpiry())
+}
+
+func TestExpiryTestSuite(t *testing.T) {
+	suite.Run(t, new(ExpiryTestSuite))
+}
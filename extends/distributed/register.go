@@ -290,12 +290,16 @@ func (c *ConsulService) handleChecks(data interface{}) error {
 
 		if check.Status == "passing" {
 			peerIP := getIPFromServiceID(check.ServiceID)
-			address := fmt.Sprintf("http://%s", peerIP)
-			peers = append(peers, address)
+			peers = append(peers, backends.GroupCachePeerURL(peerIP))
 		}
 	}
 
+	// the groupcache is not shared when the storage is not in memory
 	pool := backends.GetGroupCachePool()
+	if pool == nil {
+		return nil
+	}
+
 	pool.Set(peers...)
 	caddy.Log().Named("distributed cache").Debug(fmt.Sprintf("Peers: %s", peers))
 
@@ -1,7 +1,9 @@
 package httpcache
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -10,6 +12,7 @@ import (
 	"net/http"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/hashicorp/consul/api"
 	"github.com/sillygod/cdp-cache/backends"
@@ -23,6 +26,13 @@ const (
 	cacheMiss   = "miss"
 	cacheSkip   = "skip"
 	cacheBypass = "bypass"
+
+	cacheRevalidated = "revalidated"
+	cacheStale       = "stale"
+
+	// refreshLockPrefix is prepended to the key to coalesce the background
+	// refreshes without blocking the requests of the key.
+	refreshLockPrefix = "refresh:"
 )
 
 var (
@@ -56,18 +66,79 @@ type Handler struct {
 	DistributedRaw json.RawMessage            `json:"distributed,omitempty" caddy:"namespace=distributed inline_key=distributed"`
 	Distributed    *distributed.ConsulService `json:"-"`
 
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=http.handlers.http_cache.storage inline_key=backend"`
+
 	logger *zap.Logger
 }
 
-func (h *Handler) addStatusHeaderIfConfigured(w http.ResponseWriter, status string) {
+func (h *Handler) addStatusHeaderIfConfigured(w http.ResponseWriter, status string, entry *Entry) {
+	h.addStatusHeaderWithDetail(w, status, entry, cacheStatusDetails[status])
+}
+
+// addBypassStatus adds the status headers of the bypassed request with the
+// reason it's bypassed
+func (h *Handler) addBypassStatus(w http.ResponseWriter, detail string) {
+	h.addStatusHeaderWithDetail(w, cacheBypass, nil, detail)
+}
+
+func (h *Handler) addStatusHeaderWithDetail(w http.ResponseWriter, status string, entry *Entry, detail string) {
 	if h.Config.StatusHeader != "" {
 		w.Header().Set(h.Config.StatusHeader, status)
 	}
+
+	if h.Config.CacheStatus != "" {
+		addCacheStatus(w.Header(), cacheStatusValue(h.Config.CacheStatus, status, entry, detail))
+	}
 }
 
-func (h *Handler) respond(w http.ResponseWriter, entry *Entry, cacheStatus string) error {
-	h.addStatusHeaderIfConfigured(w, cacheStatus)
-	copyHeaders(entry.Response.snapHeader, w.Header())
+// stripCacheHeaders removes the response headers which are only for this
+// cache before responding to the client.
+func (h *Handler) stripCacheHeaders(header http.Header) {
+	stripTargetedHeaders(header, h.Config)
+	if h.Config.CacheTagHeader != "" {
+		header.Del(h.Config.CacheTagHeader)
+	}
+}
+
+// stripHeadersWriter wraps the writer so the headers only for this cache are
+// stripped from the upstream's response passed through to the client.
+func (h *Handler) stripHeadersWriter(w http.ResponseWriter) caddyhttp.ResponseRecorder {
+	return caddyhttp.NewResponseRecorder(w, nil, func(status int, header http.Header) bool {
+		h.stripCacheHeaders(header)
+		return false
+	})
+}
+
+// passThrough serves the request from the upstream without the cache
+func (h *Handler) passThrough(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return next.ServeHTTP(h.stripHeadersWriter(w), r)
+}
+
+// writeHeaders sets the entry's headers to the response without writing them
+func (h *Handler) writeHeaders(w http.ResponseWriter, entry *Entry, cacheStatus string) {
+	copyHeaders(entry.header(), w.Header())
+	h.stripCacheHeaders(w.Header())
+	h.addStatusHeaderIfConfigured(w, cacheStatus, entry)
+	w.Header().Set("Age", formatAge(entry.currentAge()))
+
+	if warning, ok := entry.heuristicWarning(); ok {
+		w.Header().Add("Warning", warning)
+	}
+}
+
+func (h *Handler) respond(w http.ResponseWriter, r *http.Request, entry *Entry, cacheStatus string) error {
+	h.writeHeaders(w, entry, cacheStatus)
+
+	// answer the client's conditional request from the cache when the stored
+	// validators match so the body is not transferred again.
+	if entry.isPublic && entry.Response.Code == http.StatusOK && isNotModified(r, entry.header()) {
+		writeNotModified(w)
+		return nil
+	}
+
+	if entry.isPublic && entry.Response.Code == http.StatusOK && r.Header.Get("Range") != "" {
+		return entry.WriteRangeTo(w, r)
+	}
 
 	// when the request method is head, we don't need ot perform write body
 	if entry.Request.Method == "HEAD" {
@@ -93,6 +164,9 @@ func popOrNil(h *Handler, errChan chan error) (err error) {
 }
 
 func (h *Handler) fetchUpstream(req *http.Request, next caddyhttp.Handler, key string) (*Entry, error) {
+	// the upstream answers the variant of the normalized class
+	req = normalizeRequestHeaders(req, h.Config.NormalizeVary)
+
 	// Create a new empty response
 	response := NewResponse()
 
@@ -103,6 +177,14 @@ func (h *Handler) fetchUpstream(req *http.Request, next caddyhttp.Handler, key s
 
 		upstreamError := next.ServeHTTP(response, req)
 		errChan <- upstreamError
+
+		// the upstream may fail without writing the headers, ex. dial errors
+		// or timeouts. Write the error's status code so it's handled as the
+		// upstream's error response.
+		if upstreamError != nil {
+			response.WriteHeader(upstreamErrorStatus(upstreamError))
+		}
+
 		response.Close()
 
 	}(req, response)
@@ -114,6 +196,152 @@ func (h *Handler) fetchUpstream(req *http.Request, next caddyhttp.Handler, key s
 	return NewEntry(key, req, response, h.Config), popOrNil(h, errChan)
 }
 
+// upstreamErrorStatus returns the status code of the upstream's error.
+// The default one is 502 Bad Gateway.
+func upstreamErrorStatus(err error) int {
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+		return handlerErr.StatusCode
+	}
+
+	return http.StatusBadGateway
+}
+
+// conditionalRequest clones the request with the validators of the stale entry
+// so the upstream can answer 304 when the content is not modified.
+func conditionalRequest(r *http.Request, entry *Entry) *http.Request {
+	req := r.Clone(r.Context())
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	header := entry.header()
+	if etag := header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	return req
+}
+
+// revalidate fetches the upstream for the stale entry. A conditional request is
+// sent when the stale entry carries validators and the returned bool reports
+// whether the upstream answers 304.
+func (h *Handler) revalidate(r *http.Request, next caddyhttp.Handler, key string, staleEntry *Entry) (*Entry, bool, error) {
+	if staleEntry == nil || !staleEntry.isPublic || !staleEntry.hasValidators() {
+		entry, err := h.fetchUpstream(r, next, key)
+		return entry, false, err
+	}
+
+	entry, err := h.fetchUpstream(conditionalRequest(r, staleEntry), next, key)
+	if err == nil && entry.Response.Code == http.StatusNotModified {
+		// the 304 response has no body to be kept
+		entry.Response.SetBody(&discardBackend{})
+		return entry, true, nil
+	}
+
+	// keep the client's request instead of the conditional one
+	entry.Request = r
+	return entry, false, err
+}
+
+// respondRevalidated refreshes the stale entry with the upstream's 304 response
+// and serves it without fetching the body again.
+func (h *Handler) respondRevalidated(w http.ResponseWriter, r *http.Request, staleEntry *Entry, notModified *Entry) error {
+	if !h.Cache.refresh(staleEntry, notModified.Response, h.Config) {
+		// it's not cacheable anymore, serve it this time and drop it.
+		defer h.Cache.cleanEntry(staleEntry)
+	}
+
+	if err := h.respond(w, r, staleEntry, cacheRevalidated); err != nil {
+		if _, ok := err.(backends.NoPreCollectError); ok {
+			w.WriteHeader(staleEntry.Response.Code)
+			return nil
+		}
+
+		h.logger.Error("cache handler", zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	return nil
+}
+
+// detachedContext keeps the values of the parent context but it's never
+// canceled so the background work can outlive the client's request.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// detachRequest clones the request for the background work. The clone has its
+// own replacer so the placeholders set by the upstream handlers don't race with
+// the ones of the client's request.
+func detachRequest(r *http.Request) *http.Request {
+	ctx := context.Context(detachedContext{r.Context()})
+
+	if origRepl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl := caddy.NewReplacer()
+		repl.Map(origRepl.Get)
+		ctx = context.WithValue(ctx, caddy.ReplacerCtxKey, repl)
+	}
+
+	req := r.Clone(ctx)
+	// the body of the POST query is buffered so it can be sent again
+	if r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			req.Body = body
+		}
+	}
+
+	return req
+}
+
+// refreshInBackground refreshes the stale entry from the upstream without
+// blocking the client. The refreshes of the same key are coalesced so only one
+// of them reaches the upstream at a time.
+func (h *Handler) refreshInBackground(r *http.Request, next caddyhttp.Handler, key string, staleEntry *Entry) {
+	lock, ok := h.URLLocks.TryAcquire(refreshLockPrefix + key)
+	if !ok {
+		return
+	}
+
+	req := fullObjectRequest(detachRequest(r))
+
+	go func() {
+		defer lock.Unlock()
+
+		entry, notModified, err := h.revalidate(req, next, key, staleEntry)
+		if notModified {
+			if !h.Cache.refresh(staleEntry, entry.Response, h.Config) {
+				h.Cache.cleanEntry(staleEntry)
+			}
+			return
+		}
+
+		if err != nil || !entry.isPublic {
+			// keep serving the stale entry and drop the upstream's response
+			entry.Response.SetBody(&discardBackend{})
+			if err != nil {
+				h.logger.Error("background refresh", zap.Error(err))
+			}
+			return
+		}
+
+		if err := entry.setBackend(req.Context(), h.Config); err != nil {
+			h.logger.Error("background refresh", zap.Error(err))
+			return
+		}
+
+		h.Cache.Put(req, entry, h.Config)
+		entry.Response.WaitClose()
+	}()
+}
+
 // CaddyModule returns the Caddy module information
 func (Handler) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -223,6 +451,11 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		return err
 	}
 
+	h.Config.NormalizeVary, err = canonicalNormalizeVary(h.Config.NormalizeVary)
+	if err != nil {
+		return err
+	}
+
 	// NOTE: A dirty work to assign the config and cache to global vars
 	// There will be the corresponding functions to get each of them.
 	// Therefore, we can call its Del to purge the cache via the admin interface
@@ -231,17 +464,29 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	h.Cache = cache
 	h.URLLocks = NewURLLock(h.Config)
 
-	// Some type of the backends need extra initialization.
-	switch h.Config.Type {
-	case inMemory:
-		if err := backends.InitGroupCacheRes(h.Config.CacheMaxMemorySize); err != nil {
+	if err := h.provisionStorage(ctx); err != nil {
+		return err
+	}
+
+	// The storage shared with the peers serves them only when the cache is
+	// distributed. Otherwise, it runs in the process.
+	if peering, ok := h.Config.Storage.(backends.Peering); ok && distributedOn {
+		if err := peering.ServePeers(); err != nil {
 			return err
 		}
-
-	case redis:
-		return h.provisionRedisCache()
 	}
 
+	// the index is rebuilt in the background because loading a large store,
+	// ex. a bucket, shouldn't delay the start
+	rebuildOnce.Do(func() {
+		cache, config, logger := h.Cache, h.Config, h.logger
+		go func() {
+			if err := cache.rebuildIndex(config); err != nil {
+				logger.Warn("rebuild cache index", zap.Error(err))
+			}
+		}()
+	})
+
 	// load the guest module distributed
 	err = h.provisionDistributed(ctx)
 	if err != nil {
@@ -252,33 +497,78 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	return nil
 }
 
-func (h *Handler) provisionRedisCache() error {
-	opts, err := backends.ParseRedisConfig(h.Config.RedisConnectionSetting)
-	if err != nil {
-		return err
+// provisionStorage loads the storage module. The storage is typed by the
+// cache_type options when no storage module is configured.
+func (h *Handler) provisionStorage(ctx caddy.Context) error {
+	if h.StorageRaw == nil {
+		storage, err := typedStorage(h.Config)
+		if err != nil {
+			return err
+		}
+		h.StorageRaw = caddyconfig.JSONModuleObject(storage, "backend", string(h.Config.Type), nil)
 	}
 
-	if err := backends.InitRedisClient(opts.Addr, opts.Password, opts.DB); err != nil {
-		return err
+	val, err := ctx.LoadModule(h, "StorageRaw") // this will call provision
+	if err != nil {
+		return fmt.Errorf("loading storage module: %s", err.Error())
 	}
 
+	h.Config.Storage = val.(backends.Storage)
+	h.Config.Type = CacheType(val.(caddy.Module).CaddyModule().ID.Name())
 	return nil
 }
 
+// typedStorage returns the storage of the cache type
+func typedStorage(config *Config) (backends.Storage, error) {
+	switch config.Type {
+	case file:
+		return &backends.FileStorage{Path: config.Path}, nil
+	case inMemory:
+		return &backends.InMemoryStorage{MaxMemorySize: config.CacheMaxMemorySize}, nil
+	case redis:
+		opts, err := backends.ParseRedisConfig(config.RedisConnectionSetting)
+		if err != nil {
+			return nil, err
+		}
+		return &backends.RedisStorage{Addr: opts.Addr, DB: opts.DB, Password: opts.Password}, nil
+	case bolt:
+		return &backends.BoltStorage{Path: config.Path}, nil
+	}
+
+	return nil, fmt.Errorf("unknown cache type: %s", config.Type)
+}
+
+// errStorageNotProvisioned indicates the config's storage isn't loaded by the
+// handler, ex. the config is used before the handler is provisioned.
+var errStorageNotProvisioned = errors.New("the storage of the cache is not provisioned")
+
+// configStorage returns the provisioned storage of the config. The storage
+// is provisioned by the handler so a config without it can't store anything.
+func configStorage(config *Config) (backends.Storage, error) {
+	if config.Storage == nil {
+		return nil, errStorageNotProvisioned
+	}
+
+	return config.Storage, nil
+}
+
 // Validate validates httpcache's configuration.
 func (h *Handler) Validate() error {
+	if h.Config == nil {
+		return nil
+	}
+
+	limited := h.Config.MaxDiskSize > 0 || h.Config.MaxDiskEntries > 0
+	if limited && !isOnDisk(h.Config) {
+		return fmt.Errorf("max_disk_size and max_disk_entries need a storage on the disk, got %s", h.Config.Type)
+	}
+
 	return nil
 }
 
-// Cleanup release the resources
+// Cleanup release the resources. The storage module releases its own ones.
 func (h *Handler) Cleanup() error {
-	var err error
-
-	if h.Config.Type == inMemory {
-		err = backends.ReleaseGroupCacheRes()
-	}
-
-	return err
+	return nil
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
@@ -310,21 +600,57 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	}(h, start)
 
 	if !shouldUseCache(r, h.Config) {
-		h.addStatusHeaderIfConfigured(w, cacheBypass)
-		return next.ServeHTTP(w, r)
+		h.addBypassStatus(w, bypassDetail(r))
+		if isUnsafeMethod(r.Method) {
+			return h.serveAndInvalidate(w, r, next)
+		}
+		return h.passThrough(w, r, next)
 	}
 
-	key := getKey(h.Config.CacheKeyTemplate, r)
-	lock := h.URLLocks.Acquire(key)
+	// The POST queries are cached by their body's hash unless the body
+	// is too large or it's a GraphQL mutation. The bypassed ones don't
+	// invalidate the stored responses because the POST requests are the
+	// queries in this mode.
+	if err := preparePostRequest(r, h.Config); err != nil {
+		if err != errBodyTooLarge && err != errGraphQLMutation {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+
+		h.addBypassStatus(w, postBypassDetail(err))
+		return h.passThrough(w, r, next)
+	}
+
+	key := postCacheKey(r, h.Config)
+
+	// The object is cached by slices and assembled for each request
+	// so that a range request only loads the slices it needs.
+	if h.Config.SliceSize > 0 && r.Method == http.MethodGet {
+		return h.serveSlices(w, r, next, key)
+	}
+
+	// Only one request fills the cache for a key. The others wait for it and
+	// stream the content being written. They fetch the upstream by themselves
+	// if it takes longer than the lock timeout.
+	lock, ok := h.URLLocks.AcquireWithTimeout(key, h.Config.LockTimeout)
+	if !ok {
+		h.addStatusHeaderWithDetail(w, cacheSkip, nil, detailLockTimeout)
+		return h.passThrough(w, r, next)
+	}
 	defer lock.Unlock()
 
-	previousEntry, exists := h.Cache.Get(key, r, false)
+	// the client's Cache-Control decides which stored entry can be served
+	directives := getRequestDirectives(r, h.Config)
+
+	previousEntry, exists := h.Cache.Get(key, r, directives.acceptsStale())
 
 	// First case: CACHE HIT
 	// The response exists in cache and is public
 	// It should be served as saved
-	if exists && previousEntry.isPublic {
-		if err := h.respond(w, previousEntry, cacheHit); err == nil {
+	if exists && previousEntry.isPublic && directives.accepts(previousEntry, false) {
+		// the other requests for the key needn't wait for this one
+		lock.Unlock()
+
+		if err := h.respond(w, r, previousEntry, cacheHit); err == nil {
 			return nil
 		} else if _, ok := err.(backends.NoPreCollectError); ok {
 			// if the err is No pre collect, just return nil
@@ -333,6 +659,26 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		}
 	}
 
+	// The expired entry is found here when it's kept by stale_max_age,
+	// stale-while-revalidate or stale-if-error, or by revalidate_max_age
+	// when it carries a validator.
+	staleEntry, hasStale := h.Cache.Get(key, r, true)
+
+	// The response exists in cache and is public but it is stale
+	// It should be served as saved when it is in the stale-while-revalidate
+	// window and be refreshed from upstream in the background
+	if hasStale && staleEntry.isPublic && staleEntry.isStaleWhileRevalidate() && directives.accepts(staleEntry, true) {
+		h.refreshInBackground(r, next, key, staleEntry)
+		lock.Unlock()
+
+		if err := h.respond(w, r, staleEntry, cacheStale); err == nil {
+			return nil
+		} else if _, ok := err.(backends.NoPreCollectError); ok {
+			w.WriteHeader(staleEntry.Response.Code)
+			return nil
+		}
+	}
+
 	// Check whether the key exists in the groupcahce when the
 	// distributed cache is enabled.
 	// Currently, only support the memory backends
@@ -351,7 +697,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		// NOTE: should set the content-length to the header manually when distributed
 		// cache is enabled because we get the content from the other peer.
 		// In this case, the snapHeader will not contain the content-length info
-		if err = h.respond(w, entry, cacheHit); err == nil {
+		if err = h.respond(w, r, entry, cacheHit); err == nil {
 			return nil
 		}
 
@@ -362,6 +708,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		}
 	}
 
+	// The client only wants a stored response
+	if directives.onlyIfCached {
+		h.addStatusHeaderWithDetail(w, cacheMiss, nil, detailOnlyIfCached)
+		return caddyhttp.Error(http.StatusGatewayTimeout, errOnlyIfCached)
+	}
+
 	// Second case: CACHE SKIP
 	// The response is in cache but it is not public
 	// It should NOT be served from cache
@@ -372,29 +724,55 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	// The response is not in cache
 	// It should be fetched from upstream and save it in cache
 
+	// Fourth case: CACHE REVALIDATED
+	// The response is in cache but it is stale and carries validators
+	// It should be revalidated with a conditional request and served
+	// from cache when the upstream returns 304
 	t := time.Now()
-	entry, err := h.fetchUpstream(r, next, key)
+	entry, notModified, err := h.revalidate(fullObjectRequest(r), next, key, staleEntry)
 	upstreamDuration = time.Since(t)
 
+	if notModified {
+		return h.respondRevalidated(w, r, staleEntry, entry)
+	}
+
+	// the upstream's 5xx response and the transport errors are handled the same
 	if entry.Response.Code >= 500 {
 		// using stale entry when available
-		previousEntry, exists := h.Cache.Get(key, r, true)
-
-		if exists && previousEntry.isPublic {
-			if err := h.respond(w, previousEntry, cacheHit); err == nil {
+		if staleEntry != nil && staleEntry.isPublic && staleEntry.isStaleIfError(r, h.Config) {
+			if err := h.respond(w, r, staleEntry, cacheStale); err == nil {
+				entry.Response.SetBody(&discardBackend{})
 				return nil
 			} else if _, ok := err.(backends.NoPreCollectError); ok {
 				// if the err is No pre collect, just return nil
-				w.WriteHeader(previousEntry.Response.Code)
+				entry.Response.SetBody(&discardBackend{})
+				w.WriteHeader(staleEntry.Response.Code)
 				return nil
 			}
 		}
 	}
 
 	if err != nil {
+		entry.Response.SetBody(&discardBackend{})
 		return caddyhttp.Error(entry.Response.Code, err)
 	}
 
+	// the object out of the size limits is passed through without storing
+	admitted, sizeKnown := admitObjectSize(entry.Response.snapHeader, h.Config)
+	if !admitted {
+		entry.isPublic = false
+	}
+
+	if entry.isPublic && !sizeKnown {
+		err := h.admitAndRespond(w, r, entry, lock)
+		if err != nil {
+			h.logger.Error("cache handler", zap.Error(err))
+			return caddyhttp.Error(entry.Response.Code, err)
+		}
+
+		return nil
+	}
+
 	// Case when response was private but now is public
 	if entry.isPublic {
 		err := entry.setBackend(r.Context(), h.Config)
@@ -403,7 +781,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		}
 
 		h.Cache.Put(r, entry, h.Config)
-		err = h.respond(w, entry, cacheMiss)
+		// the waiting requests can be served from the entry being written now
+		lock.Unlock()
+
+		err = h.respond(w, r, entry, cacheMiss)
 		if err != nil {
 			h.logger.Error("cache handler", zap.Error(err))
 			return caddyhttp.Error(entry.Response.Code, err)
@@ -412,7 +793,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		return nil
 	}
 
-	err = h.respond(w, entry, cacheSkip)
+	// the waiting requests can't be served from the private response
+	lock.Unlock()
+
+	err = h.respond(w, r, entry, cacheSkip)
 	if err != nil {
 		h.logger.Error("cache handler", zap.Error(err))
 		return caddyhttp.Error(entry.Response.Code, err)
@@ -1,13 +1,21 @@
 package httpcache
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sillygod/cdp-cache/backends"
 	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
 )
 
 type CacheKeyTemplatingTestSuite struct {
@@ -30,6 +38,83 @@ func (suite *CacheKeyTemplatingTestSuite) TestKeyReplacer() {
 	suite.Equal("GET example.com/songa?age=20&class=A", result)
 }
 
+type ConditionalRequestTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ConditionalRequestTestSuite) TestValidatorsFromStaleEntry() {
+	req := makeRequest("/", makeHeader("If-None-Match", `"client"`))
+	res := makeResponse(200, http.Header{
+		"Etag":          []string{`"v1"`},
+		"Last-Modified": []string{"Wed, 21 Oct 2015 07:28:00 GMT"},
+	})
+	entry := NewEntry("conditional_key", req, res, getDefaultConfig())
+
+	condReq := conditionalRequest(req, entry)
+	suite.Equal(`"v1"`, condReq.Header.Get("If-None-Match"))
+	suite.Equal("Wed, 21 Oct 2015 07:28:00 GMT", condReq.Header.Get("If-Modified-Since"))
+	suite.Equal(`"client"`, req.Header.Get("If-None-Match"), "the original request should not be changed")
+}
+
+func (suite *ConditionalRequestTestSuite) TestOnlyETag() {
+	req := makeRequest("/", makeHeader("If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT"))
+	res := makeResponse(200, makeHeader("Etag", `"v1"`))
+	entry := NewEntry("conditional_key", req, res, getDefaultConfig())
+
+	condReq := conditionalRequest(req, entry)
+	suite.Equal(`"v1"`, condReq.Header.Get("If-None-Match"))
+	suite.Equal("", condReq.Header.Get("If-Modified-Since"))
+}
+
+func (suite *ConditionalRequestTestSuite) TestDetachRequest() {
+	req := httptest.NewRequest("GET", "/", nil)
+	repl := caddyhttp.NewTestReplacer(req)
+	repl.Set("test.placeholder", "value")
+	ctx, cancel := context.WithCancel(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	req = req.WithContext(ctx)
+
+	detached := detachRequest(req)
+	cancel()
+	suite.NoError(detached.Context().Err(), "the detached request should not be canceled")
+
+	detachedRepl := detached.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	value, _ := detachedRepl.GetString("test.placeholder")
+	suite.Equal("value", value)
+
+	detachedRepl.Set("test.placeholder", "changed")
+	value, _ = repl.GetString("test.placeholder")
+	suite.Equal("value", value, "the original replacer should not be changed")
+}
+
+type FetchUpstreamTestSuite struct {
+	suite.Suite
+	handler *Handler
+}
+
+func (suite *FetchUpstreamTestSuite) SetupSuite() {
+	suite.handler = &Handler{Config: getDefaultConfig(), logger: zap.NewNop()}
+}
+
+func (suite *FetchUpstreamTestSuite) TestTransportError() {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return caddyhttp.Error(http.StatusGatewayTimeout, errors.New("upstream timeout"))
+	})
+
+	req := makeRequest("/", http.Header{})
+	entry, err := suite.handler.fetchUpstream(req, next, "transport_error")
+	suite.Error(err)
+	suite.Equal(http.StatusGatewayTimeout, entry.Response.Code)
+	suite.False(entry.isPublic)
+
+	entry.Response.SetBody(&discardBackend{})
+	entry.Response.WaitClose()
+}
+
+func (suite *FetchUpstreamTestSuite) TestUpstreamErrorStatus() {
+	suite.Equal(http.StatusBadGateway, upstreamErrorStatus(errors.New("dial tcp: connection refused")))
+	suite.Equal(http.StatusServiceUnavailable, upstreamErrorStatus(caddyhttp.Error(http.StatusServiceUnavailable, nil)))
+}
+
 type HandlerProvisionTestSuite struct {
 	suite.Suite
 	handler *Handler
@@ -85,15 +170,36 @@ func (suite *HandlerProvisionTestSuite) TestProvisionDistributed() {
 }
 
 func (suite *HandlerProvisionTestSuite) TestProvisionRedisBackend() {
+	suite.handler.StorageRaw = nil
 	suite.handler.Config.Type = redis
 	suite.handler.Config.RedisConnectionSetting = "localhost:6379"
-	err := suite.handler.provisionRedisCache()
+	err := suite.handler.provisionStorage(caddy.Context{})
 
 	// In this case, it will encounter a dial error because I don't
 	// provide a running redis server.
 	suite.Assert().Error(err)
 }
 
+func (suite *HandlerProvisionTestSuite) TestProvisionStorage() {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	_, err := configStorage(getDefaultConfig())
+	suite.Equal(errStorageNotProvisioned, err, "the typed storage should not be used before being provisioned")
+
+	path := suite.T().TempDir()
+	suite.handler.Config.Type = file
+	suite.handler.StorageRaw = []byte(`{"backend": "file", "path": "` + path + `"}`)
+	suite.Nil(suite.handler.provisionStorage(ctx))
+	suite.Equal(&backends.FileStorage{Path: path}, suite.handler.Config.Storage)
+
+	suite.handler.Config.Storage = nil
+	suite.handler.Config.Type = "rocks"
+	err = suite.handler.provisionStorage(ctx)
+	suite.Error(err, "unknown cache type")
+	suite.handler.Config.Type = file
+}
+
 type DetermineShouldCacheTestSuite struct {
 	suite.Suite
 	Config *Config
@@ -132,6 +238,17 @@ func (suite *DetermineShouldCacheTestSuite) TestWebsocketConnection() {
 
 }
 
+func (suite *DetermineShouldCacheTestSuite) TestRangeRequest() {
+	req := makeRequest("/", makeHeader("Range", "bytes=0-99"))
+	suite.True(shouldUseCache(req, suite.Config))
+
+	req.Header.Set("If-Range", `"v1"`)
+	fullReq := fullObjectRequest(req)
+	suite.Equal("", fullReq.Header.Get("Range"), "the whole content should be fetched from the upstream")
+	suite.Equal("", fullReq.Header.Get("If-Range"))
+	suite.Equal("bytes=0-99", req.Header.Get("Range"))
+}
+
 func (suite *DetermineShouldCacheTestSuite) TestNonGETOrHeadMethod() {
 	r := httptest.NewRequest("POST", "/", nil)
 	shouldBeCached := shouldUseCache(r, suite.Config)
@@ -167,4 +284,144 @@ func TestCacheKeyTemplatingTestSuite(t *testing.T) {
 	suite.Run(t, new(DetermineShouldCacheTestSuite))
 	suite.Run(t, new(DetermineShouldCachePOSTOnlyTestSuite))
 	suite.Run(t, new(HandlerProvisionTestSuite))
+	suite.Run(t, new(ConditionalRequestTestSuite))
+	suite.Run(t, new(FetchUpstreamTestSuite))
+}
+
+// streamRecorder records the response and signals when the body is written
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	written chan struct{}
+	once    sync.Once
+}
+
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{})}
+}
+
+func (s *streamRecorder) Write(p []byte) (int, error) {
+	n, err := s.ResponseRecorder.Write(p)
+	s.once.Do(func() { close(s.written) })
+	return n, err
+}
+
+type CollapsedForwardingTestSuite struct {
+	suite.Suite
+	handler       *Handler
+	upstreamCalls int32
+	firstWritten  chan struct{}
+	release       chan struct{}
+	next          caddyhttp.Handler
+}
+
+func (suite *CollapsedForwardingTestSuite) SetupTest() {
+	config := getDefaultConfig()
+	config.Path = suite.T().TempDir()
+	useTypedStorage(config)
+
+	suite.handler = &Handler{
+		Config:   config,
+		Cache:    NewHTTPCache(config, false),
+		URLLocks: NewURLLock(config),
+		logger:   zap.NewNop(),
+	}
+
+	suite.upstreamCalls = 0
+	suite.firstWritten = make(chan struct{})
+	suite.release = make(chan struct{})
+
+	// the first call writes a part of the content and waits to be released
+	suite.next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		first := atomic.AddInt32(&suite.upstreamCalls, 1) == 1
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("CDN-Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("rain cats "))
+		w.(http.Flusher).Flush()
+
+		if first {
+			close(suite.firstWritten)
+			<-suite.release
+		}
+
+		w.Write([]byte("and dogs"))
+		return nil
+	})
+}
+
+func (suite *CollapsedForwardingTestSuite) serve(path string, w http.ResponseWriter) error {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	caddyhttp.NewTestReplacer(req)
+	return suite.handler.ServeHTTP(w, req, suite.next)
+}
+
+func (suite *CollapsedForwardingTestSuite) TestStreamFromSingleFill() {
+	var wg sync.WaitGroup
+	recorders := []*streamRecorder{}
+
+	fill := newStreamRecorder()
+	recorders = append(recorders, fill)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		suite.Nil(suite.serve("/collapsed", fill))
+	}()
+	<-suite.firstWritten
+
+	for i := 0; i < 4; i++ {
+		waiter := newStreamRecorder()
+		recorders = append(recorders, waiter)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			suite.Nil(suite.serve("/collapsed", waiter))
+		}()
+	}
+
+	// the waiters get the content being written before the fill completes
+	for _, recorder := range recorders {
+		select {
+		case <-recorder.written:
+		case <-time.After(time.Second):
+			suite.FailNow("the content being written is not streamed")
+		}
+	}
+
+	close(suite.release)
+	wg.Wait()
+
+	suite.Equal(int32(1), atomic.LoadInt32(&suite.upstreamCalls))
+	for _, recorder := range recorders {
+		suite.Equal("rain cats and dogs", recorder.Body.String())
+	}
+	suite.Equal(0, suite.handler.URLLocks.size(), "the locks should be removed")
+
+	// the metadata is persisted in the background after the fill completes
+	suite.Eventually(func() bool {
+		names, _ := filepath.Glob(filepath.Join(suite.handler.Config.Path, "*.meta"))
+		return len(names) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *CollapsedForwardingTestSuite) TestFallbackAfterLockTimeout() {
+	suite.handler.Config.LockTimeout = 50 * time.Millisecond
+	suite.handler.Config.CacheStatus = "cdp-cache"
+
+	locked, ok := suite.handler.URLLocks.TryAcquire("GET example.com/timeout?")
+	suite.True(ok)
+
+	rw := httptest.NewRecorder()
+	close(suite.release)
+	suite.Nil(suite.serve("/timeout", rw))
+	suite.Equal(cacheSkip, rw.Header().Get(defaultStatusHeader))
+	suite.Equal("cdp-cache; fwd=uri-miss; detail=lock-timeout", rw.Header().Get(cacheStatusHeader))
+	suite.Equal("", rw.Header().Get("CDN-Cache-Control"), "the targeted header should be stripped")
+	suite.Equal("rain cats and dogs", rw.Body.String())
+
+	locked.Unlock()
+	suite.Equal(0, suite.handler.URLLocks.size())
+}
+
+func TestCollapsedForwardingTestSuite(t *testing.T) {
+	suite.Run(t, new(CollapsedForwardingTestSuite))
 }
@@ -0,0 +1,102 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// unsafeMethods are the methods which may change the resource on the
+// upstream so the stored responses of the resource should be invalidated.
+// https://httpwg.org/specs/rfc7234.html#invalidation
+var unsafeMethods = map[string]struct{}{
+	http.MethodPost:   {},
+	http.MethodPut:    {},
+	http.MethodPatch:  {},
+	http.MethodDelete: {},
+}
+
+func isUnsafeMethod(method string) bool {
+	_, ok := unsafeMethods[method]
+	return ok
+}
+
+// keyForURI returns the cache key of the request with the method to the
+// uri on the same host. The request related placeholders in the cache key
+// template are replaced with the method and the uri.
+func keyForURI(r *http.Request, cacheKeyTemplate string, method string, uri *url.URL) string {
+	repl := caddy.NewReplacer()
+	if origRepl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Map(origRepl.Get)
+	}
+
+	repl.Set("http.request.method", method)
+	repl.Set("http.request.uri", uri.RequestURI())
+	repl.Set("http.request.uri.path", uri.Path)
+	repl.Set("http.request.uri.query", uri.RawQuery)
+
+	req := r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	return getKey(cacheKeyTemplate, req)
+}
+
+// urisToInvalidate returns the request's uri and the uris in the Location
+// and Content-Location headers of the response on the same host.
+func urisToInvalidate(r *http.Request, respHeaders http.Header) []*url.URL {
+	uris := []*url.URL{r.URL}
+
+	for _, header := range []string{"Location", "Content-Location"} {
+		value := respHeaders.Get(header)
+		if value == "" {
+			continue
+		}
+
+		uri, err := r.URL.Parse(value)
+		if err != nil || (uri.Host != "" && uri.Host != r.Host) {
+			continue
+		}
+
+		uris = append(uris, uri)
+	}
+
+	return uris
+}
+
+// invalidate deletes the stored GET and HEAD responses of the uris
+func (h *Handler) invalidate(r *http.Request, uris []*url.URL) {
+	for _, uri := range uris {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			key := keyForURI(r, h.Config.CacheKeyTemplate, method, uri)
+			keys := []string{key}
+			if h.Config.SliceSize > 0 {
+				// the other slices are checked against the first one
+				keys = append(keys, sliceKey(key, 0))
+			}
+
+			for _, k := range keys {
+				if err := h.Cache.Del(k); err != nil {
+					h.logger.Error("invalidate cache", zap.String("key", k), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// serveAndInvalidate passes the request with an unsafe method to the
+// upstream and invalidates the stored responses of the affected uris when
+// the upstream doesn't answer with an error.
+func (h *Handler) serveAndInvalidate(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	rec := h.stripHeadersWriter(w)
+	if err := next.ServeHTTP(rec, r); err != nil {
+		return err
+	}
+
+	if status := rec.Status(); status >= 200 && status < 400 {
+		h.invalidate(r, urisToInvalidate(r, rec.Header()))
+	}
+
+	return nil
+}
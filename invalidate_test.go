@@ -0,0 +1,127 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type InvalidateTestSuite struct {
+	suite.Suite
+	handler *Handler
+}
+
+func (suite *InvalidateTestSuite) SetupSuite() {
+	config := getDefaultConfig()
+	config.Type = inMemory
+	useTypedStorage(config)
+
+	suite.handler = &Handler{
+		Config:   config,
+		Cache:    NewHTTPCache(config, false),
+		URLLocks: NewURLLock(config),
+		logger:   zap.NewNop(),
+	}
+}
+
+func (suite *InvalidateTestSuite) makeRequest(method string, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	caddyhttp.NewTestReplacer(req)
+	return req
+}
+
+// put stores a fresh entry for the GET request of the target
+func (suite *InvalidateTestSuite) put(target string) string {
+	req := suite.makeRequest(http.MethodGet, target)
+	key := getKey(suite.handler.Config.CacheKeyTemplate, req)
+
+	entry := NewEntry(key, req, makeResponse(200, makeHeader("Cache-Control", "max-age=60")), suite.handler.Config)
+	suite.True(entry.isPublic)
+	suite.handler.Cache.Put(req, entry, suite.handler.Config)
+	return key
+}
+
+func (suite *InvalidateTestSuite) exists(key string) bool {
+	_, exists := suite.handler.Cache.Get(key, suite.makeRequest(http.MethodGet, "/"), true)
+	return exists
+}
+
+func (suite *InvalidateTestSuite) TestKeyForURI() {
+	req := suite.makeRequest(http.MethodPost, "http://example.com/articles?draft=1")
+	suite.Equal("GET example.com/articles?draft=1", keyForURI(req, defaultCacheKeyTemplate, http.MethodGet, req.URL))
+	suite.Equal("POST example.com/articles?draft=1", getKey(defaultCacheKeyTemplate, req), "the request's key should not be changed")
+}
+
+func (suite *InvalidateTestSuite) TestURIsToInvalidate() {
+	req := suite.makeRequest(http.MethodPost, "http://example.com/articles")
+	header := http.Header{}
+	header.Set("Location", "/articles/42")
+	header.Set("Content-Location", "http://other.com/articles/42")
+
+	uris := urisToInvalidate(req, header)
+	suite.Len(uris, 2, "the uri on the other host should be ignored")
+	suite.Equal("/articles", uris[0].Path)
+	suite.Equal("/articles/42", uris[1].Path)
+}
+
+func (suite *InvalidateTestSuite) TestInvalidateOnSuccess() {
+	articles := suite.put("http://example.com/articles")
+	created := suite.put("http://example.com/articles/42")
+	other := suite.put("http://example.com/users")
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Location", "/articles/42")
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveAndInvalidate(rw, suite.makeRequest(http.MethodPost, "http://example.com/articles"), next))
+	suite.Equal(http.StatusCreated, rw.Code)
+
+	suite.False(suite.exists(articles))
+	suite.False(suite.exists(created))
+	suite.True(suite.exists(other))
+}
+
+func (suite *InvalidateTestSuite) TestKeepOnError() {
+	key := suite.put("http://example.com/books")
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveAndInvalidate(rw, suite.makeRequest(http.MethodDelete, "http://example.com/books"), next))
+	suite.True(suite.exists(key))
+}
+
+func (suite *InvalidateTestSuite) TestStripCacheHeaders() {
+	suite.handler.Config.CacheTagHeader = "Surrogate-Key"
+	defer func() { suite.handler.Config.CacheTagHeader = "" }()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("CDN-Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", "articles")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveAndInvalidate(rw, suite.makeRequest(http.MethodPut, "http://example.com/articles/1"), next))
+	suite.Equal("", rw.Header().Get("CDN-Cache-Control"))
+	suite.Equal("", rw.Header().Get("Surrogate-Control"))
+	suite.Equal("", rw.Header().Get("Surrogate-Key"))
+	suite.Equal("no-cache", rw.Header().Get("Cache-Control"))
+}
+
+func TestInvalidateTestSuite(t *testing.T) {
+	suite.Run(t, new(InvalidateTestSuite))
+}
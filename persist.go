@@ -0,0 +1,166 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/sillygod/cdp-cache/backends"
+)
+
+// metadataVersion is the version of the entries' metadata format. The
+// metadata of the other versions is dropped when the index is rebuilt.
+const metadataVersion = 1
+
+// rebuildOnce makes the index rebuilt only when the process starts because
+// the entries are kept in memory across the config reloads.
+var rebuildOnce sync.Once
+
+// entryMetadata is the entry's metadata kept next to its body so the cache
+// index can be rebuilt after a restart.
+type entryMetadata struct {
+	Version              int           `json:"version"`
+	Key                  string        `json:"key"`
+	Method               string        `json:"method"`
+	URL                  string        `json:"url"`
+	RequestHeader        http.Header   `json:"request_header"`
+	Code                 int           `json:"code"`
+	Header               http.Header   `json:"header"`
+	Expiration           time.Time     `json:"expiration"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate"`
+	StaleIfError         time.Duration `json:"stale_if_error"`
+	Heuristic            bool          `json:"heuristic"`
+	ResponseTime         time.Time     `json:"response_time"`
+	Tags                 []string      `json:"tags"`
+}
+
+func newEntryMetadata(entry *Entry) *entryMetadata {
+	entry.lock.RLock()
+	defer entry.lock.RUnlock()
+
+	return &entryMetadata{
+		Version:              metadataVersion,
+		Key:                  entry.key,
+		Method:               entry.Request.Method,
+		URL:                  entry.Request.URL.String(),
+		RequestHeader:        entry.Request.Header,
+		Code:                 entry.Response.Code,
+		Header:               entry.Response.snapHeader,
+		Expiration:           entry.expiration,
+		StaleWhileRevalidate: entry.staleWhileRevalidate,
+		StaleIfError:         entry.staleIfError,
+		Heuristic:            entry.heuristic,
+		ResponseTime:         entry.responseTime,
+		Tags:                 entry.tags,
+	}
+}
+
+// restoreEntry rebuilds the entry from its metadata and stored body
+func restoreEntry(metadata *entryMetadata, body backends.Backend) (*Entry, error) {
+	request, err := http.NewRequest(metadata.Method, metadata.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.RequestHeader != nil {
+		request.Header = metadata.RequestHeader
+	}
+
+	response := NewResponse()
+	response.Code = metadata.Code
+	if metadata.Header != nil {
+		response.HeaderMap = metadata.Header.Clone()
+	}
+	response.snapHeader = response.HeaderMap.Clone()
+	response.wroteHeader = true
+	response.SetBody(body)
+	close(response.bodyCompleteChan)
+
+	return &Entry{
+		isPublic:             true,
+		key:                  metadata.Key,
+		expiration:           metadata.Expiration,
+		staleWhileRevalidate: metadata.StaleWhileRevalidate,
+		staleIfError:         metadata.StaleIfError,
+		heuristic:            metadata.Heuristic,
+		responseTime:         metadata.ResponseTime,
+		tags:                 metadata.Tags,
+		Request:              request,
+		Response:             response,
+	}, nil
+}
+
+// persist saves the entry's metadata next to its body if the backend
+// supports it
+func (h *HTTPCache) persist(entry *Entry) {
+	persister, ok := entry.Response.body.(backends.Persister)
+	if !ok || !h.contains(entry) {
+		return
+	}
+
+	metadata, err := json.Marshal(newEntryMetadata(entry))
+	if err == nil {
+		err = persister.SaveMetadata(metadata)
+	}
+
+	if err != nil {
+		caddy.Log().Named("http.handlers.http_cache").Error(fmt.Sprintf("persist entry error: %s", err.Error()))
+	}
+}
+
+// loadStored loads the bodies kept in the backend with their metadata
+func loadStored(config *Config) ([]backends.Stored, error) {
+	storage, err := configStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	loader, ok := storage.(backends.Loader)
+	if !ok {
+		return nil, nil
+	}
+
+	return loader.Load(context.Background())
+}
+
+// rebuildIndex adds the entries kept in the backend to the cache. The expired
+// ones and the ones in the other versions of the format are dropped, and so
+// are the ones replaced by the requests while the index is being rebuilt.
+func (h *HTTPCache) rebuildIndex(config *Config) error {
+	started := now()
+	stored, err := loadStored(config)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stored {
+		metadata := &entryMetadata{}
+		if err := json.Unmarshal(s.Metadata, metadata); err != nil || metadata.Version != metadataVersion {
+			s.Backend.Clean()
+			continue
+		}
+
+		entry, err := restoreEntry(metadata, s.Backend)
+		if err == nil && !entry.responseTime.Before(started) {
+			// it's written by the requests while the index is being rebuilt
+			// so it's either in the index or being removed from it
+			continue
+		}
+
+		if err != nil || !time.Now().Before(entry.expiration.Add(entry.staleMaxAge(config))) {
+			s.Backend.Clean()
+			continue
+		}
+
+		if !h.insertIfAbsent(entry, config) {
+			s.Backend.Clean()
+			continue
+		}
+		h.recordDiskSize(entry, config)
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package httpcache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/sillygod/cdp-cache/backends"
+	"github.com/stretchr/testify/suite"
+)
+
+type PersistTestSuite struct {
+	suite.Suite
+	config *Config
+}
+
+func (suite *PersistTestSuite) SetupTest() {
+	suite.config = getDefaultConfig()
+	suite.config.Path = suite.T().TempDir()
+	useTypedStorage(suite.config)
+}
+
+// newCache returns a cache with its own index as if the process is restarted
+func (suite *PersistTestSuite) newCache() *HTTPCache {
+	cache := &HTTPCache{
+		cacheBucketsNum: suite.config.CacheBucketsNum,
+		entries:         make([]map[string][]*Entry, suite.config.CacheBucketsNum),
+		entriesLock:     make([]*sync.RWMutex, suite.config.CacheBucketsNum),
+		tags:            newTagIndex(),
+		disk:            newDiskUsage(),
+		expiry:          newExpiryScheduler(),
+	}
+
+	for i := 0; i < suite.config.CacheBucketsNum; i++ {
+		cache.entries[i] = make(map[string][]*Entry)
+		cache.entriesLock[i] = new(sync.RWMutex)
+	}
+
+	return cache
+}
+
+func (suite *PersistTestSuite) put(cache *HTTPCache, key string, header http.Header, content string) *Entry {
+	req := makeRequest("/persisted", makeHeader("Accept-Encoding", "gzip"))
+	res := makeResponse(200, header)
+	copyHeaders(header, res.Header())
+	entry := NewEntry(key, req, res, suite.config)
+	suite.True(entry.isPublic)
+	suite.Nil(entry.setBackend(req.Context(), suite.config))
+
+	cache.Put(req, entry, suite.config)
+	res.Write([]byte(content))
+	res.Close()
+	return entry
+}
+
+// waitPersisted waits the metadata of the entries to be written
+func (suite *PersistTestSuite) waitPersisted(count int) {
+	suite.Eventually(func() bool {
+		names, _ := filepath.Glob(filepath.Join(suite.config.Path, "*.meta"))
+		return len(names) == count
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *PersistTestSuite) TestRebuildIndex() {
+	header := makeHeader("Cache-Control", "max-age=60")
+	header.Set("Vary", "Accept-Encoding")
+	header.Set("Cache-Tag", "article")
+	suite.config.CacheTagHeader = "Cache-Tag"
+
+	entry := suite.put(suite.newCache(), "GET /persisted", header, "hello world")
+	suite.waitPersisted(1)
+
+	cache := suite.newCache()
+	suite.Nil(cache.rebuildIndex(suite.config))
+
+	restored, exists := cache.Get("GET /persisted", makeRequest("/persisted", makeHeader("Accept-Encoding", "gzip")), false)
+	suite.True(exists)
+	suite.Equal(entry.Response.Code, restored.Response.Code)
+	suite.Equal("max-age=60", restored.Response.snapHeader.Get("Cache-Control"))
+	suite.Equal(entry.expiration.Unix(), restored.expiration.Unix())
+	suite.Equal([]string{"GET /persisted"}, cache.KeysByTag("article"))
+	suite.Equal(1, cache.PendingExpiry())
+
+	_, exists = cache.Get("GET /persisted", makeRequest("/persisted", makeHeader("Accept-Encoding", "br")), false)
+	suite.False(exists, "the other variant should not match")
+
+	reader, err := restored.Response.GetReader()
+	suite.Nil(err)
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	suite.Nil(err)
+	suite.Equal("hello world", string(content))
+}
+
+func (suite *PersistTestSuite) TestDropExpired() {
+	header := makeHeader("Cache-Control", "max-age=60")
+	req := makeRequest("/expired", http.Header{})
+	res := makeResponse(200, header)
+	copyHeaders(header, res.Header())
+	entry := NewEntry("GET /expired", req, res, suite.config)
+	suite.Nil(entry.setBackend(req.Context(), suite.config))
+	res.Write([]byte("hello"))
+	res.Close()
+
+	// the entry is indexed without persisting it in the background as Put
+	// does, so it's persisted only after it expires
+	cache := suite.newCache()
+	cache.insert(entry, suite.config)
+
+	entry.lock.Lock()
+	entry.expiration = time.Now().Add(-time.Minute)
+	entry.lock.Unlock()
+
+	cache.persist(entry)
+	suite.waitPersisted(1)
+
+	cache = suite.newCache()
+	suite.Nil(cache.rebuildIndex(suite.config))
+	suite.Empty(cache.Keys())
+
+	names, _ := filepath.Glob(filepath.Join(suite.config.Path, "*"))
+	suite.Empty(names, "the expired entry should be removed from the backend")
+}
+
+func (suite *PersistTestSuite) TestDropOtherVersion() {
+	suite.put(suite.newCache(), "GET /versioned", makeHeader("Cache-Control", "max-age=60"), "hello")
+	suite.waitPersisted(1)
+
+	names, _ := filepath.Glob(filepath.Join(suite.config.Path, "*.meta"))
+	suite.Nil(os.WriteFile(names[0], []byte(`{"version": 0}`), 0o644))
+
+	cache := suite.newCache()
+	suite.Nil(cache.rebuildIndex(suite.config))
+	suite.Empty(cache.Keys())
+}
+
+func (suite *PersistTestSuite) TestKeepEntriesCachedWhileRebuilding() {
+	suite.put(suite.newCache(), "GET /kept", makeHeader("Cache-Control", "max-age=60"), "old")
+	suite.waitPersisted(1)
+
+	// the fresh entry is cached after the rebuild starts
+	origNow := now
+	now = func() time.Time { return time.Now().UTC().Add(time.Minute) }
+	defer func() { now = origNow }()
+
+	cache := suite.newCache()
+	fresh := suite.put(cache, "GET /kept", makeHeader("Cache-Control", "max-age=60"), "new")
+	suite.waitPersisted(2)
+	now = origNow
+
+	suite.Nil(cache.rebuildIndex(suite.config))
+	entry, exists := cache.Get("GET /kept", makeRequest("/persisted", makeHeader("Accept-Encoding", "gzip")), false)
+	suite.True(exists)
+	suite.Equal(fresh, entry, "the entry cached while rebuilding shouldn't be replaced")
+	suite.waitPersisted(1)
+
+	reader, err := entry.Response.GetReader()
+	suite.Nil(err)
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	suite.Equal("new", string(content))
+}
+
+func (suite *PersistTestSuite) TestRemoveMetadataOnClean() {
+	cache := suite.newCache()
+	suite.put(cache, "GET /cleaned", makeHeader("Cache-Control", "max-age=60"), "hello")
+	suite.waitPersisted(1)
+
+	suite.Nil(cache.Del("GET /cleaned"))
+	names, _ := filepath.Glob(filepath.Join(suite.config.Path, "*"))
+	suite.Empty(names)
+}
+
+func (suite *PersistTestSuite) TestRebuildFromBolt() {
+	storage := &backends.BoltStorage{Path: suite.config.Path}
+	suite.Require().Nil(storage.Provision(caddy.Context{}))
+	defer storage.Cleanup()
+	suite.config.Type = bolt
+	suite.config.Storage = storage
+
+	suite.put(suite.newCache(), "GET /bolt", makeHeader("Cache-Control", "max-age=60"), "hello bolt")
+	suite.Eventually(func() bool {
+		stored, _ := storage.Load(context.Background())
+		return len(stored) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	cache := suite.newCache()
+	suite.Nil(cache.rebuildIndex(suite.config))
+
+	restored, exists := cache.Get("GET /bolt", makeRequest("/persisted", makeHeader("Accept-Encoding", "gzip")), false)
+	suite.True(exists)
+	reader, err := restored.Response.GetReader()
+	suite.Nil(err)
+	content, _ := io.ReadAll(reader)
+	suite.Equal("hello bolt", string(content))
+
+	names, _ := filepath.Glob(filepath.Join(suite.config.Path, "*"))
+	suite.Len(names, 1, "the contents should be kept in a single file")
+}
+
+func TestPersistTestSuite(t *testing.T) {
+	suite.Run(t, new(PersistTestSuite))
+}
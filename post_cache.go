@@ -0,0 +1,291 @@
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var (
+	// errBodyTooLarge indicates the request body is larger than the max
+	// body size of the POST cache mode.
+	errBodyTooLarge = errors.New("the request body is too large to be cached")
+
+	// errGraphQLMutation indicates the request is a GraphQL mutation which
+	// should not be cached.
+	errGraphQLMutation = errors.New("the GraphQL mutation should not be cached")
+)
+
+// PostCacheConfig is the configuration to cache the responses of the POST
+// queries, ex. GraphQL or the search APIs. The hash of the request body is
+// a part of the cache key.
+type PostCacheConfig struct {
+	// the requests with the larger body are bypassed
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// hash the canonical form of the JSON body so the order of the keys and
+	// the whitespaces don't affect the cache key
+	CanonicalJSON bool `json:"canonical_json,omitempty"`
+	// kept for the compatibility. The GraphQL requests containing a mutation
+	// are always bypassed.
+	GraphQL bool `json:"graphql,omitempty"`
+}
+
+// preparePostRequest hashes the body of the POST request when the POST
+// cache mode is on and keeps the hash in the request's replacer as the
+// {http.request.bodyhash} placeholder. The body is hashed while it's read
+// and at most max body size bytes are buffered so it can be sent to the
+// upstream again.
+func preparePostRequest(r *http.Request, config *Config) error {
+	if r.Method != http.MethodPost || config.PostCache == nil {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	hash := sha1.New()
+	_, err := io.Copy(buf, io.TeeReader(io.LimitReader(r.Body, config.PostCache.MaxBodySize+1), hash))
+	if err != nil {
+		return err
+	}
+
+	if int64(buf.Len()) > config.PostCache.MaxBodySize {
+		// the upstream gets the read part and the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(buf, r.Body), r.Body}
+		return errBodyTooLarge
+	}
+
+	body := buf.Bytes()
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	if isGraphQLMutation(r, body) {
+		return errGraphQLMutation
+	}
+
+	bodyHash := fmt.Sprintf("%x", hash.Sum(nil))
+	if config.PostCache.CanonicalJSON {
+		if canonical, err := canonicalJSON(body); err == nil {
+			bodyHash = fmt.Sprintf("%x", sha1.Sum(canonical))
+		}
+	}
+
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.request.bodyhash", bodyHash)
+	}
+
+	return nil
+}
+
+// postCacheKey returns the key of the POST request. The body hash is
+// appended when the cache key template doesn't contain it.
+func postCacheKey(r *http.Request, config *Config) string {
+	key := getKey(config.CacheKeyTemplate, r)
+	if r.Method != http.MethodPost || config.PostCache == nil ||
+		strings.Contains(config.CacheKeyTemplate, "{http.request.bodyhash}") {
+		return key
+	}
+
+	return key + " " + getKey("{http.request.bodyhash}", r)
+}
+
+// canonicalJSON re-encodes the JSON document in its compact form with the
+// object keys sorted.
+func canonicalJSON(body []byte) ([]byte, error) {
+	var v interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// graphQLRequest is the body of a GraphQL request over HTTP
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// isGraphQLMutation reports whether the POST query runs a GraphQL mutation.
+// The document is read from the query parameter, the JSON body (a request or
+// a batch) or the raw body, ex. application/graphql. The subscriptions are
+// treated the same because they can't be cached either, and so is the body
+// which looks like GraphQL but can't be parsed because it can't be proved
+// to be a query.
+func isGraphQLMutation(r *http.Request, body []byte) bool {
+	params := r.URL.Query()
+	if query := params.Get("query"); query != "" && isMutationDocument(query, params.Get("operationName")) {
+		return true
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if !looksLikeJSON(trimmed) {
+		return isMutationDocument(string(trimmed), params.Get("operationName"))
+	}
+
+	requests := []graphQLRequest{}
+	var err error
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		err = json.Unmarshal(trimmed, &requests)
+	} else {
+		req := graphQLRequest{}
+		err = json.Unmarshal(trimmed, &req)
+		requests = append(requests, req)
+	}
+
+	if err != nil {
+		return bytes.Contains(trimmed, []byte(`"query"`))
+	}
+
+	for _, req := range requests {
+		if isMutationDocument(req.Query, req.OperationName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// looksLikeJSON reports whether the body is a JSON object or array rather
+// than a raw GraphQL document, whose shorthand query starts with a brace too.
+func looksLikeJSON(body []byte) bool {
+	if bytes.HasPrefix(body, []byte("[")) {
+		return true
+	}
+
+	if !bytes.HasPrefix(body, []byte("{")) {
+		return false
+	}
+
+	rest := bytes.TrimLeft(body[1:], " \t\r\n")
+	return len(rest) == 0 || rest[0] == '"' || rest[0] == '}'
+}
+
+// isMutationDocument reports whether the operation to run in the GraphQL
+// document is a mutation or a subscription. All of them are checked when
+// the operation name isn't given. The broken document is treated as a
+// mutation.
+func isMutationDocument(query string, operationName string) bool {
+	ops, ok := graphQLOperations(query)
+	if !ok {
+		return true
+	}
+
+	for _, op := range ops {
+		if operationName != "" && op.name != operationName {
+			continue
+		}
+
+		if op.kind == "mutation" || op.kind == "subscription" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// graphQLOperation is an operation definition in the GraphQL document
+type graphQLOperation struct {
+	kind string
+	name string
+}
+
+// graphQLOperations scans the operation definitions at the top level of
+// the document. The selection sets, the strings and the comments are
+// skipped. The fragment definitions are ignored. It returns false when the
+// brackets aren't balanced or a string isn't terminated.
+func graphQLOperations(query string) ([]graphQLOperation, bool) {
+	ops := []graphQLOperation{}
+	depth := 0
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+
+		switch {
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			for i++; i < len(query) && query[i] != '"'; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(query) {
+				return nil, false
+			}
+		case c == '{' || c == '(':
+			if c == '{' && depth == 0 && isShorthandQuery(query, i) {
+				// the shorthand of an anonymous query
+				ops = append(ops, graphQLOperation{kind: "query"})
+			}
+			depth++
+		case c == '}' || c == ')':
+			depth--
+			if depth < 0 {
+				return nil, false
+			}
+		case depth == 0 && isNameStart(c):
+			start := i
+			for i < len(query) && isNameChar(query[i]) {
+				i++
+			}
+			word := query[start:i]
+			i--
+
+			switch word {
+			case "query", "mutation", "subscription":
+				ops = append(ops, graphQLOperation{kind: word, name: nextName(query[i+1:])})
+			}
+		}
+	}
+
+	return ops, depth == 0
+}
+
+// isShorthandQuery reports whether the selection set at the position starts
+// an anonymous query, ex. "{ user { id } }", rather than belongs to a
+// definition, ex. the brace in "query Q { ... }" or "fragment F on User { ... }".
+func isShorthandQuery(query string, pos int) bool {
+	j := pos - 1
+	for j >= 0 && strings.ContainsRune(" \t\r\n,", rune(query[j])) {
+		j--
+	}
+
+	return j < 0 || query[j] == '}'
+}
+
+func nextName(s string) string {
+	s = strings.TrimLeft(s, " \t\r\n,")
+	end := 0
+	for end < len(s) && isNameChar(s[end]) {
+		end++
+	}
+	if end == 0 || !isNameStart(s[0]) {
+		return ""
+	}
+	return s[:end]
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
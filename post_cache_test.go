@@ -0,0 +1,167 @@
+package httpcache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type PostCacheTestSuite struct {
+	suite.Suite
+	config *Config
+}
+
+func (suite *PostCacheTestSuite) SetupSuite() {
+	suite.config = getDefaultConfig()
+	suite.config.PostCache = &PostCacheConfig{
+		MaxBodySize:   64,
+		CanonicalJSON: true,
+		GraphQL:       true,
+	}
+}
+
+func (suite *PostCacheTestSuite) makeRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/graphql", strings.NewReader(body))
+	caddyhttp.NewTestReplacer(req)
+	return req
+}
+
+func (suite *PostCacheTestSuite) TestShouldUseCache() {
+	suite.True(shouldUseCache(suite.makeRequest(""), suite.config))
+	suite.False(shouldUseCache(suite.makeRequest(""), getDefaultConfig()), "POST is bypassed without the mode")
+}
+
+func (suite *PostCacheTestSuite) TestCanonicalKey() {
+	req := suite.makeRequest(`{"query": "{ user { id } }", "variables": {"b": 1, "a": 2}}`)
+	suite.Nil(preparePostRequest(req, suite.config))
+	key := postCacheKey(req, suite.config)
+	suite.True(strings.HasPrefix(key, "POST example.com/graphql? "))
+
+	other := suite.makeRequest(`{"variables":{"a":2,"b":1},"query":"{ user { id } }"}`)
+	suite.Nil(preparePostRequest(other, suite.config))
+	suite.Equal(key, postCacheKey(other, suite.config), "the order of the keys and the whitespaces should not matter")
+
+	different := suite.makeRequest(`{"query": "{ user { name } }"}`)
+	suite.Nil(preparePostRequest(different, suite.config))
+	suite.NotEqual(key, postCacheKey(different, suite.config))
+
+	// the body can still be read by the upstream
+	body, err := io.ReadAll(req.Body)
+	suite.Nil(err)
+	suite.Equal(`{"query": "{ user { id } }", "variables": {"b": 1, "a": 2}}`, string(body))
+
+	again, err := req.GetBody()
+	suite.Nil(err)
+	body, _ = io.ReadAll(again)
+	suite.Equal(`{"query": "{ user { id } }", "variables": {"b": 1, "a": 2}}`, string(body))
+}
+
+func (suite *PostCacheTestSuite) TestBodyTooLarge() {
+	content := strings.Repeat("a", 100)
+	req := suite.makeRequest(content)
+	suite.Equal(errBodyTooLarge, preparePostRequest(req, suite.config))
+
+	body, err := io.ReadAll(req.Body)
+	suite.Nil(err)
+	suite.Equal(content, string(body), "the whole body should be passed to the upstream")
+}
+
+func (suite *PostCacheTestSuite) TestGraphQLMutation() {
+	req := suite.makeRequest(`{"query": "mutation { like(id: 1) }"}`)
+	suite.Equal(errGraphQLMutation, preparePostRequest(req, suite.config))
+
+	config := getDefaultConfig()
+	config.PostCache = &PostCacheConfig{MaxBodySize: 64}
+	req = suite.makeRequest(`{"query": "mutation { like(id: 1) }"}`)
+	suite.Equal(errGraphQLMutation, preparePostRequest(req, config), "the mutation should be bypassed without the graphql option")
+}
+
+func (suite *PostCacheTestSuite) TestBypassWithoutInvalidation() {
+	config := getDefaultConfig()
+	config.Type = inMemory
+	config.PostCache = &PostCacheConfig{MaxBodySize: 64}
+	useTypedStorage(config)
+
+	handler := &Handler{
+		Config:   config,
+		Cache:    NewHTTPCache(config, false),
+		URLLocks: NewURLLock(config),
+		logger:   zap.NewNop(),
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "http://example.com/graphql", nil)
+	caddyhttp.NewTestReplacer(get)
+	key := getKey(config.CacheKeyTemplate, get)
+	handler.Cache.Put(get, NewEntry(key, get, makeResponse(200, makeHeader("Cache-Control", "max-age=60")), config), config)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	suite.Nil(handler.ServeHTTP(rw, suite.makeRequest(strings.Repeat("a", 100)), next))
+	suite.Equal(cacheBypass, rw.Header().Get(defaultStatusHeader))
+
+	_, exists := handler.Cache.Get(key, get, true)
+	suite.True(exists, "the query with a large body shouldn't invalidate the stored response")
+}
+
+// isMutation checks the body of the POST request to the target
+func (suite *PostCacheTestSuite) isMutation(target string, body string) bool {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	return isGraphQLMutation(req, []byte(body))
+}
+
+func (suite *PostCacheTestSuite) TestIsGraphQLMutation() {
+	suite.False(suite.isMutation("/graphql", `{"query": "query Q { user(name: \"mutation\") { id } }"}`))
+	suite.False(suite.isMutation("/graphql", `{"query": "# mutation\n{ user { id } }"}`))
+	suite.True(suite.isMutation("/graphql", `{"query": "mutation Like($id: ID) { like(id: $id) }"}`))
+	suite.True(suite.isMutation("/graphql", `[{"query": "{ a }"}, {"query": "mutation { b }"}]`), "any mutation in a batch")
+
+	document := `query Q { user { id } } mutation M { like }`
+	suite.False(suite.isMutation("/graphql", `{"query": "`+document+`", "operationName": "Q"}`))
+	suite.True(suite.isMutation("/graphql", `{"query": "`+document+`", "operationName": "M"}`))
+}
+
+func (suite *PostCacheTestSuite) TestRawGraphQLMutation() {
+	// the raw documents, ex. application/graphql
+	suite.False(suite.isMutation("/graphql", `{ user { id } }`))
+	suite.True(suite.isMutation("/graphql", `mutation { like(id: 1) }`))
+	suite.True(suite.isMutation("/graphql?operationName=M", `query Q { a } mutation M { b }`))
+	suite.False(suite.isMutation("/graphql?operationName=Q", `query Q { a } mutation M { b }`))
+
+	// the document in the query parameter
+	suite.True(suite.isMutation("/graphql?query=mutation%7Blike%7D", ``))
+	suite.False(suite.isMutation("/graphql?query=%7Buser%7D", ``))
+
+	// the non-GraphQL bodies are cached
+	suite.False(suite.isMutation("/search", `{"term": "rain"}`))
+	suite.False(suite.isMutation("/search", `term=rain`))
+}
+
+func (suite *PostCacheTestSuite) TestBrokenGraphQL() {
+	suite.True(suite.isMutation("/graphql", `{"query": "{ user { id } }"`), "the broken JSON should not be cached")
+	suite.True(suite.isMutation("/graphql", `{"query": 1}`))
+	suite.True(suite.isMutation("/graphql", `{ user { id }`), "the broken document should not be cached")
+	suite.True(suite.isMutation("/graphql", `{"query": "{ user(name: \"a) }"}`))
+}
+
+func (suite *PostCacheTestSuite) TestGraphQLOperations() {
+	ops, ok := graphQLOperations(`fragment F on User { id } { user { ...F } } subscription S { feed }`)
+	suite.True(ok)
+	suite.Equal([]graphQLOperation{{kind: "query"}, {kind: "subscription", name: "S"}}, ops)
+
+	_, ok = graphQLOperations(`{ user } }`)
+	suite.False(ok)
+}
+
+func TestPostCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(PostCacheTestSuite))
+}
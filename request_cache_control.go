@@ -0,0 +1,133 @@
+package httpcache
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// the request Cache-Control directives applied when looking up the cache
+const (
+	directiveNoCache      = "no-cache"
+	directiveMaxAge       = "max-age"
+	directiveMaxStale     = "max-stale"
+	directiveMinFresh     = "min-fresh"
+	directiveOnlyIfCached = "only-if-cached"
+)
+
+// errOnlyIfCached is returned with 504 when the only-if-cached request
+// can't be answered from the cache.
+var errOnlyIfCached = errors.New("no stored response for the only-if-cached request")
+
+var requestDirectiveNames = []string{
+	directiveNoCache,
+	directiveMaxAge,
+	directiveMaxStale,
+	directiveMinFresh,
+	directiveOnlyIfCached,
+}
+
+// requestDirectives are the client's Cache-Control directives which decide
+// whether a stored entry can be served. The ignored ones in the config are
+// left unset. The durations are -1 when they are absent.
+// https://httpwg.org/specs/rfc9111.html#cache-request-directive
+type requestDirectives struct {
+	noCache      bool
+	maxAge       time.Duration
+	maxStale     time.Duration
+	maxStaleSet  bool
+	minFresh     time.Duration
+	onlyIfCached bool
+}
+
+func isRequestDirectiveName(directive string) bool {
+	for _, name := range requestDirectiveNames {
+		if name == directive {
+			return true
+		}
+	}
+	return false
+}
+
+func isRequestDirectiveIgnored(directive string, config *Config) bool {
+	for _, ignored := range config.IgnoreRequestCacheControl {
+		if ignored == directive {
+			return true
+		}
+	}
+	return false
+}
+
+func deltaSeconds(seconds cacheobject.DeltaSeconds) time.Duration {
+	if seconds < 0 {
+		return -1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getRequestDirectives parses the request's Cache-Control. The malformed
+// header is treated as if there are no directives.
+func getRequestDirectives(r *http.Request, config *Config) *requestDirectives {
+	d := &requestDirectives{maxAge: -1, maxStale: -1, minFresh: -1}
+
+	reqDir, err := cacheobject.ParseRequestCacheControl(r.Header.Get("Cache-Control"))
+	if err != nil {
+		return d
+	}
+
+	if !isRequestDirectiveIgnored(directiveNoCache, config) {
+		d.noCache = reqDir.NoCache
+	}
+
+	if !isRequestDirectiveIgnored(directiveMaxAge, config) {
+		d.maxAge = deltaSeconds(reqDir.MaxAge)
+	}
+
+	if !isRequestDirectiveIgnored(directiveMaxStale, config) {
+		d.maxStale = deltaSeconds(reqDir.MaxStale)
+		// the parser only marks the max-stale without a value as set
+		d.maxStaleSet = reqDir.MaxStaleSet || reqDir.MaxStale >= 0
+	}
+
+	if !isRequestDirectiveIgnored(directiveMinFresh, config) {
+		d.minFresh = deltaSeconds(reqDir.MinFresh)
+	}
+
+	if !isRequestDirectiveIgnored(directiveOnlyIfCached, config) {
+		d.onlyIfCached = reqDir.OnlyIfCached
+	}
+
+	return d
+}
+
+// acceptsStale reports whether the client accepts a stale entry
+func (d *requestDirectives) acceptsStale() bool {
+	return d.maxStaleSet
+}
+
+// accepts reports whether the entry can be served to the client without
+// contacting the upstream. serveStale tells the stale entry is served by the
+// cache's own decision, ex. in the stale-while-revalidate window.
+func (d *requestDirectives) accepts(e *Entry, serveStale bool) bool {
+	if d.noCache {
+		return false
+	}
+
+	if d.maxAge >= 0 && e.currentAge() > d.maxAge {
+		return false
+	}
+
+	ttl := time.Until(e.freshUntil())
+	if d.minFresh >= 0 && ttl < d.minFresh {
+		return false
+	}
+
+	if ttl > 0 || serveStale {
+		return true
+	}
+
+	// max-stale without a value means the stale entry of any age is accepted
+	return d.maxStaleSet && (d.maxStale < 0 || -ttl <= d.maxStale)
+}
@@ -0,0 +1,74 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RequestDirectivesTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RequestDirectivesTestSuite) makeEntry(expiration time.Time) *Entry {
+	return &Entry{
+		isPublic:     true,
+		expiration:   expiration,
+		responseTime: now(),
+		Response:     makeResponse(200, makeHeader("Date", now().Format(http.TimeFormat))),
+	}
+}
+
+func (suite *RequestDirectivesTestSuite) directives(cacheControl string, config *Config) *requestDirectives {
+	return getRequestDirectives(makeRequest("/", makeHeader("Cache-Control", cacheControl)), config)
+}
+
+func (suite *RequestDirectivesTestSuite) TestNoDirectives() {
+	d := suite.directives("", &Config{})
+	suite.True(d.accepts(suite.makeEntry(time.Now().Add(time.Minute)), false))
+	suite.False(d.accepts(suite.makeEntry(time.Now().Add(-time.Minute)), false))
+	suite.True(d.accepts(suite.makeEntry(time.Now().Add(-time.Minute)), true), "the stale-while-revalidate entry should be accepted")
+}
+
+func (suite *RequestDirectivesTestSuite) TestNoCache() {
+	d := suite.directives("no-cache", &Config{})
+	suite.False(d.accepts(suite.makeEntry(time.Now().Add(time.Minute)), false))
+
+	d = suite.directives("no-cache", &Config{IgnoreRequestCacheControl: []string{directiveNoCache}})
+	suite.True(d.accepts(suite.makeEntry(time.Now().Add(time.Minute)), false), "no-cache should be ignored")
+}
+
+func (suite *RequestDirectivesTestSuite) TestMaxAge() {
+	entry := suite.makeEntry(time.Now().Add(time.Minute))
+	entry.Response.snapHeader.Set("Age", "30")
+
+	suite.False(suite.directives("max-age=10", &Config{}).accepts(entry, false))
+	suite.True(suite.directives("max-age=60", &Config{}).accepts(entry, false))
+}
+
+func (suite *RequestDirectivesTestSuite) TestMinFresh() {
+	entry := suite.makeEntry(time.Now().Add(time.Minute))
+	suite.False(suite.directives("min-fresh=120", &Config{}).accepts(entry, false))
+	suite.True(suite.directives("min-fresh=30", &Config{}).accepts(entry, false))
+}
+
+func (suite *RequestDirectivesTestSuite) TestMaxStale() {
+	entry := suite.makeEntry(time.Now().Add(-time.Minute))
+
+	d := suite.directives("max-stale=120", &Config{})
+	suite.True(d.acceptsStale())
+	suite.True(d.accepts(entry, false))
+	suite.False(suite.directives("max-stale=30", &Config{}).accepts(entry, false))
+	suite.True(suite.directives("max-stale", &Config{}).accepts(entry, false), "stale entry of any age should be accepted")
+}
+
+func (suite *RequestDirectivesTestSuite) TestOnlyIfCached() {
+	suite.True(suite.directives("only-if-cached", &Config{}).onlyIfCached)
+	suite.False(suite.directives("only-if-cached", &Config{IgnoreRequestCacheControl: requestDirectiveNames}).onlyIfCached)
+}
+
+func TestRequestDirectivesTestSuite(t *testing.T) {
+	suite.Run(t, new(RequestDirectivesTestSuite))
+}
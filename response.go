@@ -5,6 +5,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sillygod/cdp-cache/backends"
 )
@@ -18,6 +20,17 @@ func copyHeaders(from http.Header, to http.Header) {
 	}
 }
 
+// discardBackend drops the content written by the upstream. It is used
+// when the upstream's body is not needed, ex. the 304 of a revalidation.
+type discardBackend struct {
+	backends.Base
+}
+
+// Write discards the content
+func (discardBackend) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
 // Response encapsulates the entry
 type Response struct {
 	Code       int
@@ -26,10 +39,10 @@ type Response struct {
 	snapHeader http.Header
 
 	wroteHeader        bool
-	bodyComplete       bool
 	IsFirstByteWritten bool
 
-	bodyChan         chan struct{} // indicates whether the backend is set or not.
+	bodyOnce         sync.Once
+	bodyChan         chan struct{} // closed when the backend is set
 	bodyCompleteChan chan struct{}
 	closedChan       chan struct{}
 	headersChan      chan struct{}
@@ -41,7 +54,7 @@ func NewResponse() *Response {
 		Code:             200,
 		HeaderMap:        http.Header{},
 		body:             nil,
-		bodyChan:         make(chan struct{}, 1),
+		bodyChan:         make(chan struct{}),
 		closedChan:       make(chan struct{}, 1),
 		headersChan:      make(chan struct{}, 1),
 		bodyCompleteChan: make(chan struct{}, 1),
@@ -90,9 +103,7 @@ func (r *Response) Write(buf []byte) (int, error) {
 		r.writeHeader(buf, "")
 	}
 
-	if r.body == nil {
-		<-r.bodyChan
-	}
+	<-r.bodyChan
 
 	if r.body != nil {
 		if !r.IsFirstByteWritten {
@@ -109,18 +120,43 @@ func (r *Response) WaitClose() {
 	<-r.closedChan
 }
 
-// GetReader gets the reader from the setted backend
+// GetReader gets the reader from the setted backend. The content being
+// written is streamed if the backend supports it.
 func (r *Response) GetReader() (io.ReadCloser, error) {
-	if r.bodyComplete == false {
+	if !r.isBodyComplete() {
+		if streamer, ok := r.body.(backends.Streamer); ok {
+			return streamer.GetStreamReader()
+		}
 		<-r.bodyCompleteChan
 	}
 	return r.body.GetReader()
 }
 
-// SetBody sets the backend to body for the further write usage
+// isBodyComplete tells whether the content is completely written
+func (r *Response) isBodyComplete() bool {
+	select {
+	case <-r.bodyCompleteChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetSeekableReader gets the seekable reader from the setted backend
+func (r *Response) GetSeekableReader() (io.ReadSeekCloser, error) {
+	if !r.isBodyComplete() {
+		<-r.bodyCompleteChan
+	}
+	return r.body.GetSeekableReader()
+}
+
+// SetBody sets the backend to body for the further write usage. Only the
+// first backend is used.
 func (r *Response) SetBody(body backends.Backend) {
-	r.body = body
-	r.bodyChan <- struct{}{}
+	r.bodyOnce.Do(func() {
+		r.body = body
+		close(r.bodyChan)
+	})
 }
 
 // WaitHeaders waits the header to be written
@@ -146,7 +182,8 @@ func (r *Response) WriteHeader(code int) {
 
 func shouldUseCache(req *http.Request, config *Config) bool {
 
-	matchMethod := false
+	// the POST queries are cached in the POST cache mode
+	matchMethod := req.Method == http.MethodPost && config.PostCache != nil
 	for _, method := range config.MatchMethods {
 		if method == req.Method {
 			matchMethod = true
@@ -157,13 +194,6 @@ func shouldUseCache(req *http.Request, config *Config) bool {
 		return false
 	}
 
-	// Range requests still not supported
-	// It may happen that the previous request for this url has a successful response
-	// but for another Range. So a special handling is needed
-	if req.Header.Get("range") != "" {
-		return false
-	}
-
 	if isWebSocket(req.Header) {
 		return false
 	}
@@ -172,6 +202,19 @@ func shouldUseCache(req *http.Request, config *Config) bool {
 
 }
 
+// fullObjectRequest returns the request to fetch the whole content from the
+// upstream. The range requests are served from the completely cached entry.
+func fullObjectRequest(req *http.Request) *http.Request {
+	if req.Header.Get("Range") == "" {
+		return req
+	}
+
+	fullReq := req.Clone(req.Context())
+	fullReq.Header.Del("Range")
+	fullReq.Header.Del("If-Range")
+	return fullReq
+}
+
 func isWebSocket(h http.Header) bool {
 	if h == nil {
 		return false
@@ -198,29 +241,43 @@ func (r *Response) Flush() {
 		r.WriteHeader(200)
 	}
 
-	if r.body == nil {
+	// the content is written to the backend only after it's set
+	select {
+	case <-r.bodyChan:
+	default:
 		return
 	}
 
-	r.body.Flush()
+	if r.body != nil {
+		r.body.Flush()
+	}
 }
 
 // Close indicate the data is completely written to the body
 // so that we can close it.
 func (r *Response) Close() error {
-	if r.body == nil {
-		<-r.bodyChan
-	}
+	<-r.bodyChan
 
-	r.body.Close()
+	if r.body != nil {
+		r.body.Close()
+	}
 
-	r.bodyComplete = true
-	r.bodyCompleteChan <- struct{}{}
+	// close it instead of sending so that all the waiting readers are notified
+	close(r.bodyCompleteChan)
 	r.closedChan <- struct{}{}
 
 	return nil
 }
 
+// refresh extends the expiration of the backend's storage if it has one
+func (r *Response) refresh(expiration time.Time) error {
+	if refresher, ok := r.body.(backends.Refresher); ok {
+		return refresher.Refresh(expiration)
+	}
+
+	return nil
+}
+
 // Clean performs purge the cache
 func (r *Response) Clean() error {
 
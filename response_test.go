@@ -1,6 +1,7 @@
 package httpcache
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http/httptest"
@@ -49,6 +50,10 @@ func (t *TestBackend) GetReader() (io.ReadCloser, error) {
 	return t.recorder.Result().Body, nil
 }
 
+func (t *TestBackend) GetSeekableReader() (io.ReadSeekCloser, error) {
+	return nil, errors.New("not seekable")
+}
+
 type ResponseTestSuite struct {
 	suite.Suite
 }
@@ -130,6 +135,16 @@ func (suite *ResponseTestSuite) TestSetNilBody() {
 	suite.Error(err)
 }
 
+func (suite *ResponseTestSuite) TestSetBodyOnce() {
+	r := NewResponse()
+	backend := NewTestBackend()
+	r.SetBody(backend)
+	r.SetBody(NewTestBackend())
+
+	r.Write([]byte("hello"))
+	suite.Equal("hello", backend.recorder.Body.String(), "the first backend should be kept")
+}
+
 func TestResponseTestSuite(t *testing.T) {
 	suite.Run(t, new(ResponseTestSuite))
 }
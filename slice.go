@@ -0,0 +1,447 @@
+package httpcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// errNotSliceable indicates the upstream can't serve the object by slices,
+// ex. it doesn't support the range requests or the response is not cacheable.
+var errNotSliceable = errors.New("the upstream response is not sliceable")
+
+// errSliceChanged indicates the object is changed in the upstream after
+// its first slice is cached.
+var errSliceChanged = errors.New("the object is changed while loading its slices")
+
+// headersNotForSlice are the conditional headers which should not be sent
+// when fetching a slice because the upstream must answer with the content.
+var headersNotForSlice = []string{
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// sliceKey returns the cache key of the index-th slice of the object
+func sliceKey(key string, index int64) string {
+	return fmt.Sprintf("%s slice=%d", key, index)
+}
+
+// sliceRequest clones the request to fetch the index-th slice from the upstream
+func sliceRequest(r *http.Request, index int64, sliceSize int64) *http.Request {
+	req := r.Clone(r.Context())
+	for _, header := range headersNotForSlice {
+		req.Header.Del(header)
+	}
+
+	start := index * sliceSize
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+sliceSize-1))
+	return req
+}
+
+// parseContentRangeSize returns the complete length of the object in the
+// Content-Range header. ex. bytes 0-1023/4096
+func parseContentRangeSize(contentRange string) (int64, error) {
+	i := strings.LastIndex(contentRange, "/")
+	if !strings.HasPrefix(contentRange, "bytes ") || i == -1 {
+		return 0, fmt.Errorf("invalid content range: %s", contentRange)
+	}
+
+	// the complete length may be unknown which is represented by *
+	return strconv.ParseInt(contentRange[i+1:], 10, 64)
+}
+
+// sliceAsWhole returns the slice's response as if it's a whole response so
+// that its cacheability is decided the same way as the others.
+func sliceAsWhole(response *Response) *Response {
+	header := response.snapHeader.Clone()
+	header.Del("Content-Range")
+	return &Response{Code: http.StatusOK, snapHeader: header}
+}
+
+// sameETag reports whether the slice belongs to the same version of the
+// object as the first slice.
+func sameETag(entry *Entry, etag string) bool {
+	return etag == "" || entry.header().Get("ETag") == etag
+}
+
+// loadSlice gets the index-th slice from the cache or fetches it from the
+// upstream and caches it. The returned status tells whether it's served from
+// the cache. The client's directives decide which stored slice can be used
+// and the stale slice is served as the whole object's entry is, ex. in the
+// stale-while-revalidate window. When the upstream answers the first slice
+// with the whole response, ex. it ignores the Range header, the response is
+// returned with errNotSliceable so the caller can serve it without fetching
+// it again.
+func (h *Handler) loadSlice(r *http.Request, next caddyhttp.Handler, key string, index int64, etag string, directives *requestDirectives) (*Entry, string, error) {
+	skey := sliceKey(key, index)
+
+	// fetch the slice without the lock when the other request takes longer
+	// than the lock timeout
+	if lock, ok := h.URLLocks.AcquireWithTimeout(skey, h.Config.LockTimeout); ok {
+		defer lock.Unlock()
+	}
+
+	cached, exists := h.Cache.Get(skey, r, true)
+	if exists && (!cached.isPublic || !sameETag(cached, etag)) {
+		cached, exists = nil, false
+	}
+
+	if exists && directives.accepts(cached, false) {
+		return cached, cacheHit, nil
+	}
+
+	if exists && cached.isStaleWhileRevalidate() && directives.accepts(cached, true) {
+		h.refreshSliceInBackground(r, next, key, index, etag)
+		return cached, cacheStale, nil
+	}
+
+	if directives.onlyIfCached {
+		return nil, "", errOnlyIfCached
+	}
+
+	// the slice is fetched on a detached context so the client's disconnection
+	// doesn't leave a truncated slice in the cache
+	entry, err := h.fetchUpstream(detachRequest(sliceRequest(r, index, int64(h.Config.SliceSize))), next, skey)
+
+	// the upstream's 5xx response and the transport errors are handled the same
+	if (err != nil || entry.Response.Code >= 500) && exists && cached.isStaleIfError(r, h.Config) {
+		entry.Response.SetBody(&discardBackend{})
+		return cached, cacheStale, nil
+	}
+
+	if err != nil {
+		entry.Response.SetBody(&discardBackend{})
+		return nil, "", err
+	}
+
+	entry, err = h.cacheSlice(entry, index, etag)
+	return entry, cacheMiss, err
+}
+
+// cacheSlice caches the slice fetched from the upstream when it's a cacheable
+// part of the object and its complete length is admitted.
+func (h *Handler) cacheSlice(entry *Entry, index int64, etag string) (*Entry, error) {
+	if entry.Response.Code != http.StatusPartialContent {
+		if index == 0 {
+			return entry, errNotSliceable
+		}
+		entry.Response.SetBody(&discardBackend{})
+		return nil, errNotSliceable
+	}
+
+	if !sameETag(entry, etag) {
+		entry.Response.SetBody(&discardBackend{})
+		return nil, errSliceChanged
+	}
+
+	entry.isPublic, entry.expiration = getCacheStatus(entry.Request, sliceAsWhole(entry.Response), h.Config)
+	if !entry.isPublic || !admitSlice(entry, h.Config) {
+		entry.Response.SetBody(&discardBackend{})
+		return nil, errNotSliceable
+	}
+
+	if err := entry.setBackend(entry.Request.Context(), h.Config); err != nil {
+		return nil, err
+	}
+
+	h.Cache.Put(entry.Request, entry, h.Config)
+	return entry, nil
+}
+
+// admitSlice reports whether the object's complete length in the slice's
+// Content-Range is within the object size limits.
+func admitSlice(entry *Entry, config *Config) bool {
+	size, err := parseContentRangeSize(entry.header().Get("Content-Range"))
+	if err != nil {
+		// the object of the unknown length is passed through
+		return !hasObjectSizeLimits(config)
+	}
+	return isObjectSizeAdmitted(size, config)
+}
+
+// refreshSliceInBackground fetches the stale slice again without blocking the
+// client. Only one request refreshes the slice at the same time.
+func (h *Handler) refreshSliceInBackground(r *http.Request, next caddyhttp.Handler, key string, index int64, etag string) {
+	skey := sliceKey(key, index)
+	lock, ok := h.URLLocks.TryAcquire(refreshLockPrefix + skey)
+	if !ok {
+		return
+	}
+
+	req := detachRequest(sliceRequest(r, index, int64(h.Config.SliceSize)))
+
+	go func() {
+		defer lock.Unlock()
+
+		entry, err := h.fetchUpstream(req, next, skey)
+		if err != nil {
+			entry.Response.SetBody(&discardBackend{})
+		} else if entry, err = h.cacheSlice(entry, index, etag); err == errNotSliceable && entry != nil {
+			entry.Response.SetBody(&discardBackend{})
+		}
+
+		if err != nil {
+			// keep serving the stale slice
+			h.logger.Error("background refresh", zap.String("key", skey), zap.Error(err))
+			return
+		}
+
+		entry.Response.WaitClose()
+	}()
+}
+
+// slicesCached reports whether all the slices of the object can be served
+// from the cache, which the only-if-cached request requires.
+func (h *Handler) slicesCached(r *http.Request, key string, etag string, size int64, directives *requestDirectives) bool {
+	sliceSize := int64(h.Config.SliceSize)
+	for index := int64(1); index*sliceSize < size; index++ {
+		entry, exists := h.Cache.Get(sliceKey(key, index), r, true)
+		if !exists || !entry.isPublic || !sameETag(entry, etag) {
+			return false
+		}
+
+		if !directives.accepts(entry, entry.isStaleWhileRevalidate()) {
+			return false
+		}
+	}
+	return true
+}
+
+// serveSlices serves the object by assembling its slices. Only the slices
+// covering the requested ranges are loaded. The object whose upstream ignores
+// the Range header is cached as a whole, and the other ones are passed through
+// when the upstream can't serve them by slices.
+func (h *Handler) serveSlices(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, key string) error {
+	directives := getRequestDirectives(r, h.Config)
+
+	if entry, exists := h.Cache.Get(key, r, directives.acceptsStale()); exists && entry.isPublic && directives.accepts(entry, false) {
+		if err := h.respond(w, r, entry, cacheHit); err == nil {
+			return nil
+		}
+	}
+
+	// the first slice tells the complete length and the headers of the object
+	first, cacheStatus, err := h.loadSlice(r, next, key, 0, "", directives)
+	if err == errNotSliceable && first != nil {
+		return h.serveWholeObject(w, r, key, first)
+	}
+
+	if err == errNotSliceable {
+		h.addStatusHeaderIfConfigured(w, cacheSkip, nil)
+		return h.passThrough(w, r, next)
+	}
+
+	if err == errOnlyIfCached {
+		h.addStatusHeaderWithDetail(w, cacheMiss, nil, detailOnlyIfCached)
+		return caddyhttp.Error(http.StatusGatewayTimeout, err)
+	}
+
+	if err != nil {
+		return caddyhttp.Error(upstreamErrorStatus(err), err)
+	}
+
+	header := first.header()
+	size, err := parseContentRangeSize(header.Get("Content-Range"))
+	if err != nil {
+		h.addStatusHeaderIfConfigured(w, cacheSkip, nil)
+		return h.passThrough(w, r, next)
+	}
+
+	// the slices are checked before any of them is written because the
+	// response can't be failed after that
+	if directives.onlyIfCached && !h.slicesCached(r, key, header.Get("ETag"), size, directives) {
+		h.addStatusHeaderWithDetail(w, cacheMiss, nil, detailOnlyIfCached)
+		return caddyhttp.Error(http.StatusGatewayTimeout, errOnlyIfCached)
+	}
+
+	copyHeaders(header, w.Header())
+	h.stripCacheHeaders(w.Header())
+	h.addStatusHeaderIfConfigured(w, cacheStatus, first)
+	w.Header().Set("Age", formatAge(first.currentAge()))
+	w.Header().Del("Content-Range")
+	w.Header().Del("Content-Length")
+
+	reader := &sliceReader{
+		handler:    h,
+		request:    r,
+		next:       next,
+		key:        key,
+		etag:       header.Get("ETag"),
+		sliceSize:  int64(h.Config.SliceSize),
+		size:       size,
+		directives: directives,
+		first:      first,
+	}
+	defer reader.Close()
+
+	modtime, _ := http.ParseTime(header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, reader)
+	return nil
+}
+
+// serveWholeObject serves the whole response returned for the first slice and
+// caches it under the object's key if it's cacheable.
+func (h *Handler) serveWholeObject(w http.ResponseWriter, r *http.Request, key string, first *Entry) error {
+	entry := NewEntry(key, r, first.Response, h.Config)
+	if admitted, _ := admitObjectSize(entry.Response.snapHeader, h.Config); !admitted {
+		entry.isPublic = false
+	}
+
+	cacheStatus := cacheSkip
+	if entry.isPublic {
+		if err := entry.setBackend(r.Context(), h.Config); err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+
+		h.Cache.Put(r, entry, h.Config)
+		cacheStatus = cacheMiss
+	}
+
+	if err := h.respond(w, r, entry, cacheStatus); err != nil {
+		h.logger.Error("cache handler", zap.Error(err))
+		return caddyhttp.Error(entry.Response.Code, err)
+	}
+
+	return nil
+}
+
+// sliceReader reads the object across its slices. A slice is loaded from the
+// cache or the upstream only when the content in it is read.
+type sliceReader struct {
+	handler    *Handler
+	request    *http.Request
+	next       caddyhttp.Handler
+	key        string
+	etag       string
+	sliceSize  int64
+	size       int64
+	offset     int64
+	current    io.ReadSeekCloser
+	directives *requestDirectives
+	// the first slice is loaded already to serve the headers
+	first *Entry
+}
+
+// Read reads the content from the slice where the offset is
+func (s *sliceReader) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+
+	if s.current == nil {
+		if err := s.openSlice(); err != nil {
+			s.handler.logger.Error("load slice", zap.String("key", s.key), zap.Error(err))
+			return 0, err
+		}
+	}
+
+	n, err := s.current.Read(p)
+	s.offset += int64(n)
+
+	if err == io.EOF {
+		s.closeSlice()
+
+		// the slice is shorter than expected, ex. the upstream fails in the
+		// middle of it. Drop it so the next request fetches it again.
+		if s.offset%s.sliceSize != 0 && s.offset < s.size {
+			s.handler.Cache.Del(sliceKey(s.key, s.offset/s.sliceSize))
+			return n, io.ErrUnexpectedEOF
+		}
+
+		if n == 0 {
+			return s.Read(p)
+		}
+		return n, nil
+	}
+
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (s *sliceReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = s.offset + offset
+	case io.SeekEnd:
+		abs = s.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if abs != s.offset {
+		s.closeSlice()
+	}
+
+	s.offset = abs
+	return abs, nil
+}
+
+// Close closes the slice being read
+func (s *sliceReader) Close() error {
+	s.closeSlice()
+	return nil
+}
+
+func (s *sliceReader) openSlice() error {
+	index := s.offset / s.sliceSize
+	if index == 0 && s.first != nil {
+		return s.readSlice(s.first, index)
+	}
+
+	entry, _, err := s.handler.loadSlice(s.request, s.next, s.key, index, s.etag, s.directives)
+	if err == errNotSliceable && entry != nil {
+		// the whole response can't be read as a slice
+		entry.Response.SetBody(&discardBackend{})
+	}
+
+	if err == errSliceChanged {
+		// drop the first slice so the next request loads the new version
+		s.handler.Cache.Del(sliceKey(s.key, 0))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.readSlice(entry, index)
+}
+
+// readSlice opens the slice's content at the offset
+func (s *sliceReader) readSlice(entry *Entry, index int64) error {
+	reader, err := entry.Response.GetSeekableReader()
+	if err != nil {
+		return err
+	}
+
+	if _, err := reader.Seek(s.offset-index*s.sliceSize, io.SeekStart); err != nil {
+		reader.Close()
+		return err
+	}
+
+	s.current = reader
+	return nil
+}
+
+func (s *sliceReader) closeSlice() {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+}
@@ -0,0 +1,267 @@
+package httpcache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type SliceTestSuite struct {
+	suite.Suite
+	handler       *Handler
+	content       string
+	upstreamCalls int32
+	next          caddyhttp.Handler
+}
+
+func (suite *SliceTestSuite) SetupSuite() {
+	config := getDefaultConfig()
+	config.Path = "/tmp/caddy-cache-slice"
+	config.SliceSize = 4
+	useTypedStorage(config)
+
+	suite.handler = &Handler{
+		Config:   config,
+		Cache:    NewHTTPCache(config, false),
+		URLLocks: NewURLLock(config),
+		logger:   zap.NewNop(),
+	}
+
+	suite.content = "rain cats and dogs"
+	suite.next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		atomic.AddInt32(&suite.upstreamCalls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(suite.content))
+		return nil
+	})
+}
+
+func (suite *SliceTestSuite) TestParseContentRangeSize() {
+	size, err := parseContentRangeSize("bytes 0-1023/4096")
+	suite.Nil(err)
+	suite.Equal(int64(4096), size)
+
+	_, err = parseContentRangeSize("bytes 0-1023/*")
+	suite.Error(err, "the complete length is unknown")
+
+	_, err = parseContentRangeSize("")
+	suite.Error(err)
+}
+
+func (suite *SliceTestSuite) TestSliceRequest() {
+	req := makeRequest("/", http.Header{
+		"Range":         []string{"bytes=5-"},
+		"If-None-Match": []string{`"v1"`},
+	})
+	sliceReq := sliceRequest(req, 2, 4)
+	suite.Equal("bytes=8-11", sliceReq.Header.Get("Range"))
+	suite.Equal("", sliceReq.Header.Get("If-None-Match"))
+}
+
+func (suite *SliceTestSuite) TestServeRangeBySlices() {
+	atomic.StoreInt32(&suite.upstreamCalls, 0)
+
+	req := makeRequest("/", makeHeader("Range", "bytes=5-12"))
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, req, suite.next, "GET /range"))
+	suite.Equal(http.StatusPartialContent, rw.Code)
+	suite.Equal("cats and", rw.Body.String())
+	suite.Equal("bytes 5-12/18", rw.Header().Get("Content-Range"))
+	suite.Equal(cacheMiss, rw.Header().Get(defaultStatusHeader))
+	// the first slice and the slices cover 5-12 (1, 2, 3)
+	suite.Equal(int32(4), atomic.LoadInt32(&suite.upstreamCalls))
+
+	rw = httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", makeHeader("Range", "bytes=4-7")), suite.next, "GET /range"))
+	suite.Equal(" cat", rw.Body.String())
+	suite.Equal(cacheHit, rw.Header().Get(defaultStatusHeader))
+	suite.Equal(int32(4), atomic.LoadInt32(&suite.upstreamCalls), "the slices should be served from cache")
+}
+
+func (suite *SliceTestSuite) TestServeWholeObjectBySlices() {
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", http.Header{}), suite.next, "GET /whole"))
+	suite.Equal(http.StatusOK, rw.Code)
+	suite.Equal(suite.content, rw.Body.String())
+	suite.Equal("18", rw.Header().Get("Content-Length"))
+}
+
+func (suite *SliceTestSuite) TestNotSliceable() {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(suite.content))
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", http.Header{}), next, "GET /not_sliceable"))
+	suite.Equal(http.StatusOK, rw.Code)
+	suite.Equal(suite.content, rw.Body.String())
+	suite.Equal(cacheSkip, rw.Header().Get(defaultStatusHeader))
+}
+
+func (suite *SliceTestSuite) TestRangeIgnored() {
+	var calls int32
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "18")
+		w.Write([]byte(suite.content))
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", http.Header{}), next, "GET /range_ignored"))
+	suite.Equal(http.StatusOK, rw.Code)
+	suite.Equal(suite.content, rw.Body.String())
+	suite.Equal(cacheMiss, rw.Header().Get(defaultStatusHeader))
+	suite.Equal(int32(1), atomic.LoadInt32(&calls), "the whole response shouldn't be fetched again")
+
+	rw = httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", makeHeader("Range", "bytes=5-8")), next, "GET /range_ignored"))
+	suite.Equal(http.StatusPartialContent, rw.Code)
+	suite.Equal("cats", rw.Body.String())
+	suite.Equal(cacheHit, rw.Header().Get(defaultStatusHeader))
+	suite.Equal(int32(1), atomic.LoadInt32(&calls), "the whole object should be served from cache")
+}
+
+// expireSlices makes the cached slices of the object stale
+func (suite *SliceTestSuite) expireSlices(key string, staleIfError time.Duration) {
+	for index := int64(0); index*4 < int64(len(suite.content)); index++ {
+		entry, exists := suite.handler.Cache.Get(sliceKey(key, index), makeRequest("/", http.Header{}), true)
+		suite.True(exists)
+
+		entry.lock.Lock()
+		entry.expiration = time.Now().Add(-time.Second)
+		entry.staleIfError = staleIfError
+		entry.lock.Unlock()
+	}
+}
+
+func (suite *SliceTestSuite) TestRequestDirectivesForSlices() {
+	atomic.StoreInt32(&suite.upstreamCalls, 0)
+
+	rw := httptest.NewRecorder()
+	req := makeRequest("/", makeHeader("Cache-Control", "only-if-cached"))
+	err := suite.handler.serveSlices(rw, req, suite.next, "GET /directives")
+	suite.Equal(http.StatusGatewayTimeout, err.(caddyhttp.HandlerError).StatusCode)
+	suite.Equal(int32(0), atomic.LoadInt32(&suite.upstreamCalls))
+
+	rw = httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", makeHeader("Range", "bytes=0-3")), suite.next, "GET /directives"))
+	suite.Equal("rain", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	err = suite.handler.serveSlices(rw, req, suite.next, "GET /directives")
+	suite.Equal(http.StatusGatewayTimeout, err.(caddyhttp.HandlerError).StatusCode, "the other slices are not cached")
+
+	atomic.StoreInt32(&suite.upstreamCalls, 0)
+	rw = httptest.NewRecorder()
+	req = makeRequest("/", makeHeader("Range", "bytes=0-3"))
+	req.Header.Set("Cache-Control", "no-cache")
+	suite.Nil(suite.handler.serveSlices(rw, req, suite.next, "GET /directives"))
+	suite.Equal("rain", rw.Body.String())
+	suite.Equal(cacheMiss, rw.Header().Get(defaultStatusHeader))
+	suite.Equal(int32(1), atomic.LoadInt32(&suite.upstreamCalls), "the slice should be fetched again")
+}
+
+func (suite *SliceTestSuite) TestStaleSliceIfError() {
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", http.Header{}), suite.next, "GET /stale_if_error"))
+	suite.Equal(suite.content, rw.Body.String())
+	suite.expireSlices("GET /stale_if_error", time.Minute)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusBadGateway)
+		return nil
+	})
+
+	rw = httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", http.Header{}), next, "GET /stale_if_error"))
+	suite.Equal(http.StatusOK, rw.Code)
+	suite.Equal(suite.content, rw.Body.String())
+	suite.Equal(cacheStale, rw.Header().Get(defaultStatusHeader))
+}
+
+func (suite *SliceTestSuite) TestSliceNotAdmitted() {
+	config := getDefaultConfig()
+	config.SliceSize = 4
+	config.MaxObjectSize = 10
+	useTypedStorage(config)
+
+	handler := &Handler{
+		Config:   config,
+		Cache:    NewHTTPCache(config, false),
+		URLLocks: NewURLLock(config),
+		logger:   zap.NewNop(),
+	}
+
+	rw := httptest.NewRecorder()
+	suite.Nil(handler.serveSlices(rw, makeRequest("/", http.Header{}), suite.next, "GET /not_admitted"))
+	suite.Equal(suite.content, rw.Body.String())
+	suite.Equal(cacheSkip, rw.Header().Get(defaultStatusHeader))
+
+	_, exists := handler.Cache.Get(sliceKey("GET /not_admitted", 0), makeRequest("/", http.Header{}), true)
+	suite.False(exists, "the slice of the object larger than the max object size shouldn't be cached")
+}
+
+func (suite *SliceTestSuite) TestSliceFetchedAfterDisconnection() {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		return suite.next.ServeHTTP(w, r)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", http.Header{}).WithContext(ctx), next, "GET /disconnected"))
+
+	rw = httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", http.Header{}), next, "GET /disconnected"))
+	suite.Equal(suite.content, rw.Body.String())
+	suite.Equal(cacheHit, rw.Header().Get(defaultStatusHeader))
+}
+
+func (suite *SliceTestSuite) TestDropShortSlice() {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 4-7/%d", len(suite.content)))
+		if r.Header.Get("Range") == "bytes=0-3" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-3/%d", len(suite.content)))
+		}
+		w.WriteHeader(http.StatusPartialContent)
+
+		// the slices except the first one are truncated
+		if r.Header.Get("Range") == "bytes=0-3" {
+			w.Write([]byte(suite.content[:4]))
+		} else {
+			w.Write([]byte("ca"))
+		}
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	suite.Nil(suite.handler.serveSlices(rw, makeRequest("/", makeHeader("Range", "bytes=4-7")), next, "GET /short"))
+
+	_, exists := suite.handler.Cache.Get(sliceKey("GET /short", 1), makeRequest("/", http.Header{}), true)
+	suite.False(exists, "the short slice should be dropped")
+}
+
+func TestSliceTestSuite(t *testing.T) {
+	suite.Run(t, new(SliceTestSuite))
+}
@@ -0,0 +1,76 @@
+package httpcache
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tagIndex maps the cache tags to the keys of the entries carrying them so
+// that the entries can be purged by their tags.
+type tagIndex struct {
+	lock sync.RWMutex
+	keys map[string]map[string]struct{} // tag -> keys
+	tags map[string]map[string]struct{} // key -> tags
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys: make(map[string]map[string]struct{}),
+		tags: make(map[string]map[string]struct{}),
+	}
+}
+
+// set replaces the tags of the key
+func (t *tagIndex) set(key string, tags []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for tag := range t.tags[key] {
+		delete(t.keys[tag], key)
+		if len(t.keys[tag]) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+	delete(t.tags, key)
+
+	if len(tags) == 0 {
+		return
+	}
+
+	t.tags[key] = make(map[string]struct{})
+	for _, tag := range tags {
+		if _, ok := t.keys[tag]; !ok {
+			t.keys[tag] = make(map[string]struct{})
+		}
+		t.keys[tag][key] = struct{}{}
+		t.tags[key][tag] = struct{}{}
+	}
+}
+
+// remove drops the key from all of its tags
+func (t *tagIndex) remove(key string) {
+	t.set(key, nil)
+}
+
+// keysOf returns the keys carrying the tag
+func (t *tagIndex) keysOf(tag string) []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	keys := make([]string, 0, len(t.keys[tag]))
+	for key := range t.keys[tag] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// parseCacheTags splits the value of the cache tag header. Surrogate-Key and
+// xkey separate the tags by spaces and Cache-Tag by commas.
+func parseCacheTags(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t'
+	})
+}
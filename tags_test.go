@@ -0,0 +1,39 @@
+package httpcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TagIndexTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TagIndexTestSuite) TestParseCacheTags() {
+	suite.Equal([]string{"article-42", "home"}, parseCacheTags("article-42 home"))
+	suite.Equal([]string{"article-42", "home"}, parseCacheTags("article-42, home"))
+	suite.Empty(parseCacheTags(""))
+}
+
+func (suite *TagIndexTestSuite) TestSetAndRemove() {
+	index := newTagIndex()
+	index.set("GET localhost/a?", []string{"article-42", "home"})
+	index.set("GET localhost/b?", []string{"article-42"})
+
+	suite.Equal([]string{"GET localhost/a?", "GET localhost/b?"}, index.keysOf("article-42"))
+	suite.Equal([]string{"GET localhost/a?"}, index.keysOf("home"))
+
+	index.remove("GET localhost/a?")
+	suite.Equal([]string{"GET localhost/b?"}, index.keysOf("article-42"))
+	suite.Empty(index.keysOf("home"))
+	suite.NotContains(index.keys, "home", "the tag without keys should be dropped")
+
+	index.set("GET localhost/b?", []string{"home"})
+	suite.Empty(index.keysOf("article-42"), "the tags should be replaced")
+	suite.Equal([]string{"GET localhost/b?"}, index.keysOf("home"))
+}
+
+func TestTagIndexTestSuite(t *testing.T) {
+	suite.Run(t, new(TagIndexTestSuite))
+}
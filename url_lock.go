@@ -4,23 +4,48 @@ import (
 	"hash/crc32"
 	"math"
 	"sync"
+	"time"
 )
 
 // URLLock is a lock to control the incoming request in a request-response cycle
 type URLLock struct {
 	globalLocks        []*sync.Mutex
-	keys               []map[string]*sync.Mutex
+	keys               []map[string]*keyLock
 	urlLockBucketsSize int
 }
 
+// keyLock is the lock of a key. It's counted by the holder and the waiters
+// and removed when no one uses it so the locks of the keys don't pile up.
+type keyLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// KeyLock is the held lock of a key
+type KeyLock struct {
+	owner *URLLock
+	key   string
+	lock  *keyLock
+	once  sync.Once
+}
+
+// Unlock releases the lock. It can be called more than once so the lock can
+// be released early and in a defer as well.
+func (l *KeyLock) Unlock() {
+	l.once.Do(func() {
+		<-l.lock.ch
+		l.owner.release(l.key)
+	})
+}
+
 // NewURLLock new a request lock
 func NewURLLock(config *Config) *URLLock {
 	globalLocks := make([]*sync.Mutex, config.CacheBucketsNum)
-	keys := make([]map[string]*sync.Mutex, config.CacheBucketsNum)
+	keys := make([]map[string]*keyLock, config.CacheBucketsNum)
 
 	for i := 0; i < config.CacheBucketsNum; i++ {
 		globalLocks[i] = new(sync.Mutex)
-		keys[i] = make(map[string]*sync.Mutex)
+		keys[i] = make(map[string]*keyLock)
 	}
 
 	return &URLLock{
@@ -31,20 +56,87 @@ func NewURLLock(config *Config) *URLLock {
 }
 
 // Acquire a lock for given key
-func (allLocks *URLLock) Acquire(key string) *sync.Mutex {
+func (allLocks *URLLock) Acquire(key string) *KeyLock {
+	lock := allLocks.retain(key)
+	lock.ch <- struct{}{}
+	return &KeyLock{owner: allLocks, key: key, lock: lock}
+}
+
+// AcquireWithTimeout acquires a lock for given key. It reports false when
+// the lock is not acquired within the timeout. A zero timeout waits forever.
+func (allLocks *URLLock) AcquireWithTimeout(key string, timeout time.Duration) (*KeyLock, bool) {
+	if timeout <= 0 {
+		return allLocks.Acquire(key), true
+	}
+
+	lock := allLocks.retain(key)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case lock.ch <- struct{}{}:
+		return &KeyLock{owner: allLocks, key: key, lock: lock}, true
+	case <-timer.C:
+		allLocks.release(key)
+		return nil, false
+	}
+}
+
+// TryAcquire tries to acquire a lock for given key without waiting.
+// It reports false when the lock is held by others.
+func (allLocks *URLLock) TryAcquire(key string) (*KeyLock, bool) {
+	lock := allLocks.retain(key)
+
+	select {
+	case lock.ch <- struct{}{}:
+		return &KeyLock{owner: allLocks, key: key, lock: lock}, true
+	default:
+		allLocks.release(key)
+		return nil, false
+	}
+}
+
+// retain gets the lock of the key and counts the reference
+func (allLocks *URLLock) retain(key string) *keyLock {
 	bucketIndex := allLocks.getBucketIndexForKey(key)
 	allLocks.globalLocks[bucketIndex].Lock()
 	defer allLocks.globalLocks[bucketIndex].Unlock()
 
 	lock, exists := allLocks.keys[bucketIndex][key]
 	if !exists {
-		lock = new(sync.Mutex)
+		lock = &keyLock{ch: make(chan struct{}, 1)}
 		allLocks.keys[bucketIndex][key] = lock
 	}
-	lock.Lock()
+
+	lock.refs++
 	return lock
 }
 
+// release drops the reference of the lock and removes it when it's unused
+func (allLocks *URLLock) release(key string) {
+	bucketIndex := allLocks.getBucketIndexForKey(key)
+	allLocks.globalLocks[bucketIndex].Lock()
+	defer allLocks.globalLocks[bucketIndex].Unlock()
+
+	lock := allLocks.keys[bucketIndex][key]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(allLocks.keys[bucketIndex], key)
+	}
+}
+
+// size returns the number of the locks kept
+func (allLocks *URLLock) size() int {
+	n := 0
+	for i, l := range allLocks.globalLocks {
+		l.Lock()
+		n += len(allLocks.keys[i])
+		l.Unlock()
+	}
+
+	return n
+}
+
 func (allLocks *URLLock) getBucketIndexForKey(key string) uint32 {
 	return uint32(math.Mod(float64(crc32.ChecksumIEEE([]byte(key))), float64(allLocks.urlLockBucketsSize)))
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -38,6 +39,57 @@ func (suite *URLLockTestSuite) TestAcquireAndUnLock() {
 	l.Unlock()
 }
 
+func (suite *URLLockTestSuite) TestTryAcquire() {
+	c := getDefaultConfig()
+	lock := NewURLLock(c)
+
+	l, ok := lock.TryAcquire("hello")
+	suite.True(ok)
+
+	_, ok = lock.TryAcquire("hello")
+	suite.False(ok, "the lock is held")
+
+	l.Unlock()
+	l, ok = lock.TryAcquire("hello")
+	suite.True(ok)
+	l.Unlock()
+}
+
+func (suite *URLLockTestSuite) TestAcquireWithTimeout() {
+	c := getDefaultConfig()
+	lock := NewURLLock(c)
+
+	l, ok := lock.AcquireWithTimeout("hello", 10*time.Millisecond)
+	suite.True(ok)
+
+	_, ok = lock.AcquireWithTimeout("hello", 10*time.Millisecond)
+	suite.False(ok, "the lock is held")
+
+	l.Unlock()
+	l.Unlock() // unlocking again does nothing
+	l, ok = lock.AcquireWithTimeout("hello", 10*time.Millisecond)
+	suite.True(ok)
+	l.Unlock()
+}
+
+func (suite *URLLockTestSuite) TestRemoveUnusedLocks() {
+	c := getDefaultConfig()
+	lock := NewURLLock(c)
+
+	l := lock.Acquire("hello")
+	suite.Equal(1, lock.size())
+
+	acquired := make(chan *KeyLock)
+	go func() { acquired <- lock.Acquire("hello") }()
+
+	l.Unlock()
+	l = <-acquired
+	suite.Equal(1, lock.size(), "the lock is held by the waiter")
+
+	l.Unlock()
+	suite.Equal(0, lock.size())
+}
+
 func TestURLLockTestSuite(t *testing.T) {
 	suite.Run(t, new(URLLockTestSuite))
 }
@@ -0,0 +1,222 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// varyNormalizer reduces the request header's value to a small set of
+// classes so that the clients sending different values which get the same
+// response from the upstream share a variant. args are the arguments of the
+// normalize_vary directive.
+type varyNormalizer func(value string, args []string) string
+
+// varyNormalizers are the supported normalizers for the headers in Vary
+var varyNormalizers = map[string]varyNormalizer{
+	"Accept-Encoding": normalizeAcceptEncoding,
+	"Accept":          normalizeAccept,
+	"Accept-Language": normalizeAcceptLanguage,
+	"User-Agent":      normalizeUserAgent,
+}
+
+// varyForwardValues are the request header's values sent to the upstream for
+// the classes which aren't the valid values by themselves. Each of them is
+// normalized to its own class again, and the formats of the other classes
+// are not acceptable so the upstream can't answer one of them.
+var varyForwardValues = map[string]map[string]string{
+	"Accept": {
+		"avif":    "image/avif,image/webp;q=0,*/*;q=0.8",
+		"webp":    "image/webp,image/avif;q=0,*/*;q=0.8",
+		"default": "image/avif;q=0,image/webp;q=0,*/*",
+	},
+	"User-Agent": {
+		"tablet":  "Mozilla/5.0 (Tablet)",
+		"mobile":  "Mozilla/5.0 (Mobile)",
+		"desktop": "Mozilla/5.0 (Desktop)",
+	},
+}
+
+// normalizeRequestHeaders returns the request to forward to the upstream with
+// the normalized headers replaced by their classes. Otherwise, the upstream
+// may answer the client's representation which isn't implied by the class,
+// ex. zstd, and it's served to the other clients of the class.
+func normalizeRequestHeaders(r *http.Request, normalizeVary map[string][]string) *http.Request {
+	if len(normalizeVary) == 0 {
+		return r
+	}
+
+	req := r.Clone(r.Context())
+	for header := range normalizeVary {
+		value := varyValue(req, header, normalizeVary)
+		if forward, ok := varyForwardValues[header][value]; ok {
+			value = forward
+		}
+		req.Header.Set(header, value)
+	}
+
+	return req
+}
+
+// varyValue returns the value of the request header listed in Vary. It's
+// normalized when the header's normalizer is configured.
+func varyValue(r *http.Request, header string, normalizeVary map[string][]string) string {
+	header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+	value := r.Header.Get(header)
+
+	args, ok := normalizeVary[header]
+	if !ok {
+		return value
+	}
+
+	normalizer, ok := varyNormalizers[header]
+	if !ok {
+		return value
+	}
+
+	return normalizer(value, args)
+}
+
+// canonicalNormalizeVary canonicalizes the headers of the normalize_vary
+// config and rejects the ones without a normalizer. The JSON config isn't
+// checked by the Caddyfile parser.
+func canonicalNormalizeVary(normalizeVary map[string][]string) (map[string][]string, error) {
+	if normalizeVary == nil {
+		return nil, nil
+	}
+
+	result := make(map[string][]string, len(normalizeVary))
+	for header, args := range normalizeVary {
+		canonical := http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if _, ok := varyNormalizers[canonical]; !ok {
+			return nil, fmt.Errorf("normalize_vary: unsupported header %s", header)
+		}
+
+		if canonical == "Accept-Language" && len(args) == 0 {
+			return nil, fmt.Errorf("normalize_vary: the languages should be specified for Accept-Language")
+		}
+
+		result[canonical] = args
+	}
+
+	return result, nil
+}
+
+// qualityValue is an element of the header with the quality value,
+// ex. gzip;q=0.8
+type qualityValue struct {
+	value   string
+	quality float64
+}
+
+// parseQualityValues parses the elements sorted by their quality values.
+// The elements with q=0 are not acceptable so they are dropped.
+func parseQualityValues(header string) []qualityValue {
+	values := []qualityValue{}
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if quality > 0 {
+			values = append(values, qualityValue{value: value, quality: quality})
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].quality > values[j].quality
+	})
+
+	return values
+}
+
+func acceptsValue(values []qualityValue, value string) bool {
+	for _, v := range values {
+		if v.value == value || v.value == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAcceptEncoding reduces Accept-Encoding to br, gzip or identity
+func normalizeAcceptEncoding(value string, args []string) string {
+	values := parseQualityValues(value)
+
+	for _, encoding := range []string{"br", "gzip"} {
+		if acceptsValue(values, encoding) {
+			return encoding
+		}
+	}
+
+	return "identity"
+}
+
+// normalizeAccept reduces Accept to the best modern image format the client
+// supports, avif, webp or default for the others.
+func normalizeAccept(value string, args []string) string {
+	values := parseQualityValues(value)
+
+	for _, format := range []string{"avif", "webp"} {
+		for _, v := range values {
+			if v.value == "image/"+format {
+				return format
+			}
+		}
+	}
+
+	return "default"
+}
+
+// normalizeAcceptLanguage reduces Accept-Language to the most preferred one
+// in the configured languages. The first configured language is the default.
+// The language range is matched by its prefix, ex. en-US matches en.
+func normalizeAcceptLanguage(value string, args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	for _, v := range parseQualityValues(value) {
+		for _, lang := range args {
+			lang = strings.ToLower(lang)
+			if v.value == lang || strings.HasPrefix(v.value, lang+"-") {
+				return lang
+			}
+		}
+	}
+
+	return strings.ToLower(args[0])
+}
+
+// normalizeUserAgent reduces User-Agent to the device classes, tablet, mobile
+// or desktop.
+func normalizeUserAgent(value string, args []string) string {
+	ua := strings.ToLower(value)
+
+	switch {
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet"):
+		return "tablet"
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone"):
+		return "mobile"
+	case strings.Contains(ua, "android"):
+		// android tablets don't have mobile in their user agents
+		return "tablet"
+	default:
+		return "desktop"
+	}
+}
@@ -0,0 +1,135 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type VaryTestSuite struct {
+	suite.Suite
+}
+
+func (suite *VaryTestSuite) TestNormalizeAcceptEncoding() {
+	suite.Equal("br", normalizeAcceptEncoding("gzip, deflate, br", nil))
+	suite.Equal("gzip", normalizeAcceptEncoding("gzip;q=0.8, br;q=0", nil))
+	suite.Equal("identity", normalizeAcceptEncoding("deflate", nil))
+	suite.Equal("identity", normalizeAcceptEncoding("", nil))
+}
+
+func (suite *VaryTestSuite) TestNormalizeAccept() {
+	suite.Equal("avif", normalizeAccept("image/avif,image/webp,image/apng,*/*;q=0.8", nil))
+	suite.Equal("webp", normalizeAccept("image/webp,*/*", nil))
+	suite.Equal("default", normalizeAccept("text/html,*/*;q=0.8", nil))
+}
+
+func (suite *VaryTestSuite) TestNormalizeAcceptLanguage() {
+	languages := []string{"en", "fr", "de"}
+	suite.Equal("fr", normalizeAcceptLanguage("fr-CH, fr;q=0.9, en;q=0.8", languages))
+	suite.Equal("de", normalizeAcceptLanguage("ja, de;q=0.5", languages))
+	suite.Equal("en", normalizeAcceptLanguage("ja", languages), "the first language should be the default")
+}
+
+func (suite *VaryTestSuite) TestNormalizeUserAgent() {
+	suite.Equal("mobile", normalizeUserAgent("Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) Mobile/15E148", nil))
+	suite.Equal("tablet", normalizeUserAgent("Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X)", nil))
+	suite.Equal("tablet", normalizeUserAgent("Mozilla/5.0 (Linux; Android 13; SM-X700) Safari/537.36", nil))
+	suite.Equal("desktop", normalizeUserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64)", nil))
+}
+
+func (suite *VaryTestSuite) TestVaryValue() {
+	req := makeRequest("/", http.Header{"Accept-Encoding": []string{"gzip"}})
+	suite.Equal("gzip", varyValue(req, " accept-encoding", nil), "the raw value should be used without the normalizer")
+	suite.Equal("gzip", varyValue(req, "Accept-Encoding", map[string][]string{"Accept-Encoding": {}}))
+
+	req = makeRequest("/", http.Header{"Cookie": []string{"a=b"}})
+	suite.Equal("a=b", varyValue(req, "Cookie", map[string][]string{"Cookie": {}}), "the header without the normalizer shouldn't panic")
+}
+
+func (suite *VaryTestSuite) TestCanonicalNormalizeVary() {
+	normalizeVary, err := canonicalNormalizeVary(map[string][]string{"accept-encoding": {}, "ACCEPT-LANGUAGE": {"en"}})
+	suite.Nil(err)
+	suite.Equal(map[string][]string{"Accept-Encoding": {}, "Accept-Language": {"en"}}, normalizeVary)
+
+	_, err = canonicalNormalizeVary(map[string][]string{"Cookie": {}})
+	suite.Error(err, "the header without the normalizer should be rejected")
+
+	_, err = canonicalNormalizeVary(map[string][]string{"Accept-Language": {}})
+	suite.Error(err, "the languages are required")
+}
+
+func (suite *VaryTestSuite) TestNormalizeRequestHeaders() {
+	normalizeVary := map[string][]string{"Accept": {}, "User-Agent": {}, "Accept-Encoding": {}}
+	req := makeRequest("/", http.Header{
+		"Accept":          []string{"image/webp,*/*"},
+		"User-Agent":      []string{"Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) Mobile/15E148"},
+		"Accept-Encoding": []string{"gzip, br, zstd"},
+	})
+
+	forwarded := normalizeRequestHeaders(req, normalizeVary)
+	suite.Equal("br", forwarded.Header.Get("Accept-Encoding"))
+	suite.Equal("image/webp,*/*", req.Header.Get("Accept"), "the client's request should not be changed")
+
+	// the forwarded values stay in the same classes
+	for header := range normalizeVary {
+		suite.Equal(varyValue(req, header, normalizeVary), varyValue(forwarded, header, normalizeVary))
+	}
+}
+
+func (suite *VaryTestSuite) TestUpstreamAnswersTheClass() {
+	config := getDefaultConfig()
+	config.Path = suite.T().TempDir()
+	config.NormalizeVary = map[string][]string{"Accept-Encoding": {}}
+	useTypedStorage(config)
+
+	handler := &Handler{
+		Config:   config,
+		Cache:    NewHTTPCache(config, false),
+		URLLocks: NewURLLock(config),
+		logger:   zap.NewNop(),
+	}
+
+	// the upstream prefers zstd when the client accepts it
+	var upstreamCalls int32
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		atomic.AddInt32(&upstreamCalls, 1)
+		encoding := "br"
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") {
+			encoding = "zstd"
+		}
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("Content-Encoding", encoding)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(encoding))
+		return nil
+	})
+
+	serve := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/vary-class", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		caddyhttp.NewTestReplacer(req)
+
+		w := httptest.NewRecorder()
+		suite.Nil(handler.ServeHTTP(w, req, next))
+		return w
+	}
+
+	// both browsers are in the class br so neither gets zstd
+	suite.Equal("br", serve("gzip, deflate, br, zstd").Header().Get("Content-Encoding"))
+	w := serve("gzip, br")
+	suite.Equal("br", w.Header().Get("Content-Encoding"))
+	suite.Equal("br", w.Body.String())
+	suite.Equal(int32(1), atomic.LoadInt32(&upstreamCalls))
+}
+
+func TestVaryTestSuite(t *testing.T) {
+	suite.Run(t, new(VaryTestSuite))
+}